@@ -24,6 +24,7 @@ func (c *App) CreateAccount() http.HandlerFunc {
 			Email    string `json:"email"`
 			Session  string `json:"session"`
 			Code     string `json:"code"`
+			Invite   string `json:"invite_code"`
 		}{})
 
 		if err != nil {
@@ -153,6 +154,23 @@ func (c *App) CreateAccount() http.HandlerFunc {
 			return
 		}
 
+		p.Invite = strings.TrimSpace(p.Invite)
+
+		if c.Config.Features.RequireInviteCode {
+			err := c.ConsumeInviteCode(p.Invite)
+			if err != nil {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"created":        false,
+						"invalid_invite": true,
+						"error":          "That invite code is invalid or has expired.",
+					},
+				})
+				return
+			}
+		}
+
 		// create the matrix account first
 		resp, err := c.CreateMatrixUserAccount(p.Username, p.Password)
 
@@ -160,6 +178,10 @@ func (c *App) CreateAccount() http.HandlerFunc {
 
 		if err != nil {
 
+			if c.Config.Features.RequireInviteCode {
+				c.ReleaseInviteCode(p.Invite)
+			}
+
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -170,6 +192,10 @@ func (c *App) CreateAccount() http.HandlerFunc {
 			return
 		}
 
+		if c.Config.Features.RequireInviteCode {
+			c.RecordInviteCodeUse(p.Invite, resp.Response.UserID)
+		}
+
 		if c.Config.Features.RequireEmail && isValid {
 			err = c.MatrixDB.Queries.VerifyEmail(context.Background(), matrix_db.VerifyEmailParams{
 				Email: pgtype.Text{
@@ -222,7 +248,7 @@ func (c *App) CreateAccount() http.HandlerFunc {
 			user.Verified = true
 		}
 
-		err = c.StoreUserSession(user)
+		err = c.CreateUserSession(r, user)
 
 		spaces, err := c.MatrixDB.Queries.GetUserSpaces(context.Background(), pgtype.Text{String: user.MatrixUserID, Valid: true})
 		if err != nil {
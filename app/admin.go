@@ -48,6 +48,19 @@ func (c *App) MatrixAdminProxy() http.HandlerFunc {
 			return
 		}
 
+		// reads don't change anything, everything else is kept
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			c.Audit(&AuditEntry{
+				Actor:  user.MatrixUserID,
+				Action: AuditAdminAPI,
+				Target: r.URL.Path,
+				Details: map[string]any{
+					"method": r.Method,
+					"query":  r.URL.RawQuery,
+				},
+			})
+		}
+
 		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.MatrixAccessToken))
 		w.Header().Del("Access-Control-Allow-Origin")
 
@@ -56,6 +69,19 @@ func (c *App) MatrixAdminProxy() http.HandlerFunc {
 
 }
 
+// SuspendMatrixUser deactivates the user in Synapse and logs them out.
+func (c *App) SuspendMatrixUser(id string) error {
+	err := c.MatrixDB.Queries.DeactivateUser(context.Background(), pgtype.Text{
+		String: id,
+		Valid:  true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.PurgeUserSessions(id)
+}
+
 func (c *App) SuspendUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -78,10 +104,7 @@ func (c *App) SuspendUser() http.HandlerFunc {
 			return
 		}
 
-		err := c.MatrixDB.Queries.DeactivateUser(context.Background(), pgtype.Text{
-			String: id,
-			Valid:  true,
-		})
+		err := c.SuspendMatrixUser(id)
 		if err != nil {
 			log.Println("error deleting user", err)
 			RespondWithJSON(w, &JSONResponse{
@@ -94,18 +117,12 @@ func (c *App) SuspendUser() http.HandlerFunc {
 			return
 		}
 
-		err = c.PurgeUserSessions(id)
-		if err != nil {
-			log.Println("error deleting user", err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error":     "Error deleting user.",
-					"suspended": false,
-				},
-			})
-			return
-		}
+		c.Audit(&AuditEntry{
+			Actor:        user.MatrixUserID,
+			Action:       AuditSuspendUser,
+			TargetUserID: id,
+			Reason:       query.Get("reason"),
+		})
 
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusOK,
@@ -205,6 +222,12 @@ func (c *App) PinEventToIndex() http.HandlerFunc {
 			}
 		}
 
+		c.Audit(&AuditEntry{
+			Actor:  user.MatrixUserID,
+			Action: AuditPinEvent,
+			Target: slug,
+		})
+
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusOK,
 			JSON: map[string]any{
@@ -298,6 +321,12 @@ func (c *App) UnpinIndexEvent() http.HandlerFunc {
 			}
 		}
 
+		c.Audit(&AuditEntry{
+			Actor:  user.MatrixUserID,
+			Action: AuditUnpinEvent,
+			Target: slug,
+		})
+
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusOK,
 			JSON: map[string]any{
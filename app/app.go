@@ -16,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-chi/chi"
 	"github.com/go-redis/redis"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/sessions"
 	"github.com/meilisearch/meilisearch-go"
 	"github.com/robfig/cron/v3"
@@ -40,6 +41,11 @@ type App struct {
 	DefaultMatrixSpace   string
 	Version              string
 	SearchStore          *meilisearch.Client
+	Hub                  *Hub
+	Fanout               *Fanout
+	PolicyLists          *PolicyLists
+	FilterCache          *FilterCache
+	WebAuthn             *webauthn.WebAuthn
 }
 
 func (c *App) Activate() {
@@ -70,8 +76,9 @@ func (c *App) Activate() {
 }
 
 type StartRequest struct {
-	Config    string
-	MakeViews bool
+	Config      string
+	Migrate     []string
+	VerifyViews bool
 }
 
 var CONFIG_FILE string
@@ -95,12 +102,22 @@ func Start(s *StartRequest) {
 		panic(err)
 	}
 
-	// On first run, check to see if Migrations & MVs exist
-	// If not, create them
+	if len(s.Migrate) > 0 {
+		err := RunMigrateCommand(mdb, s.Migrate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Apply any pending view migrations
 	InitViews(mdb)
 
-	if s.MakeViews {
-		MakeViews(mdb)
+	if s.VerifyViews {
+		err := VerifyViews(mdb)
+		if err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
@@ -153,6 +170,10 @@ func Start(s *StartRequest) {
 		Sessions:      sess,
 		Cron:          cron,
 		Cache:         cache,
+		Hub:           NewHub(),
+		Fanout:        NewFanout(cache.Notifications),
+		PolicyLists:   NewPolicyLists(),
+		FilterCache:   NewFilterCache(),
 	}
 
 	if conf.Search.Enabled {
@@ -169,6 +190,14 @@ func Start(s *StartRequest) {
 	}
 	c.MediaStorage = media
 
+	if conf.Authentication.Passkeys {
+		wa, err := c.NewWebAuthn()
+		if err != nil {
+			log.Println("passkeys are disabled: ", err)
+		}
+		c.WebAuthn = wa
+	}
+
 	c.Version = func() string {
 		if info, ok := debug.ReadBuildInfo(); ok {
 			for _, setting := range info.Settings {
@@ -200,6 +229,12 @@ func Start(s *StartRequest) {
 
 	c.UpdateIndexEventsCache()
 
+	go c.StartFanout()
+	c.StartEventSubscribers()
+	c.StartDigests()
+	c.StartSessionSweeper()
+	c.StartAccountJobs()
+
 	go c.StartNotifyListener()
 	go c.StartPresenceListener()
 
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// actions the audit log records
+const (
+	AuditSuspendUser   = "suspend_user"
+	AuditPinEvent      = "pin_event"
+	AuditUnpinEvent    = "unpin_event"
+	AuditRedact        = "redact"
+	AuditAdminAPI      = "admin_api"
+	AuditResolveReport = "resolve_report"
+
+	AuditSubscribePolicyList   = "subscribe_policy_list"
+	AuditUnsubscribePolicyList = "unsubscribe_policy_list"
+	AuditContentFilters        = "update_content_filters"
+	AuditReviewHeldPost        = "review_held_post"
+)
+
+type AuditEntry struct {
+	Actor        string
+	Action       string
+	TargetUserID string
+	Target       string
+	SpaceRoomID  string
+	Reason       string
+	Details      map[string]any
+}
+
+// Audit records something an admin or moderator did. A failed write is
+// logged, it never stops the action.
+func (c *App) Audit(e *AuditEntry) {
+
+	details := []byte("{}")
+	if e.Details != nil {
+		serialized, err := json.Marshal(e.Details)
+		if err != nil {
+			log.Println(err)
+		} else {
+			details = serialized
+		}
+	}
+
+	err := c.MatrixDB.Queries.CreateAuditLogEntry(context.Background(), matrix_db.CreateAuditLogEntryParams{
+		Actor:        e.Actor,
+		Action:       e.Action,
+		TargetUserID: e.TargetUserID,
+		Target:       e.Target,
+		SpaceRoomID:  e.SpaceRoomID,
+		Reason:       e.Reason,
+		Details:      string(details),
+		CreatedAt:    time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Println("error writing audit log: ", err)
+	}
+}
+
+func optionalText(s string) pgtype.Text {
+	return pgtype.Text{
+		String: s,
+		Valid:  s != "",
+	}
+}
+
+func (c *App) getAuditLog(w http.ResponseWriter, r *http.Request, spaceRoomID string) {
+
+	query := r.URL.Query()
+
+	p := matrix_db.GetAuditLogParams{
+		Actor:       optionalText(query.Get("actor")),
+		Target:      optionalText(query.Get("target")),
+		SpaceRoomID: optionalText(spaceRoomID),
+	}
+
+	if before, err := strconv.ParseInt(query.Get("before"), 10, 64); err == nil {
+		p.Before = pgtype.Int8{
+			Int64: before,
+			Valid: true,
+		}
+	}
+
+	entries, err := c.MatrixDB.Queries.GetAuditLog(context.Background(), p)
+	if err != nil {
+		log.Println(err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error": "could not get audit log",
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"entries": entries,
+		},
+	})
+}
+
+// AuditLog is the whole log for admins, filtered by actor, target and space
+// slug.
+func (c *App) AuditLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			respondNotModerator(w)
+			return
+		}
+
+		var spaceRoomID string
+
+		if space := r.URL.Query().Get("space"); space != "" {
+			roomID, err := c.MatrixDB.Queries.DoesDefaultSpaceExist(context.Background(), c.ConstructMatrixRoomID(strings.ToLower(space)))
+			if err != nil {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"error": "space does not exist",
+					},
+				})
+				return
+			}
+			spaceRoomID = roomID
+		}
+
+		c.getAuditLog(w, r, spaceRoomID)
+	}
+}
+
+// SpaceAuditLog shows a space's owner what its moderators did.
+func (c *App) SpaceAuditLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		state, err := c.GetSpaceState(&SpaceStateParams{
+			Slug:         strings.ToLower(chi.URLParam(r, "space")),
+			MatrixUserID: user.MatrixUserID,
+		})
+		if err != nil || (!state.IsOwner && !user.Admin) {
+			respondNotModerator(w)
+			return
+		}
+
+		c.getAuditLog(w, r, state.RoomID)
+	}
+}
@@ -35,6 +35,7 @@ func (c *App) ValidateLogin() http.HandlerFunc {
 		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "GetCredentials failed: %v\n", err)
+			c.RecordAuthFailure(r)
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -106,6 +107,7 @@ func (c *App) ValidateLogin() http.HandlerFunc {
 		resp, err := matrix.Login(rl)
 		if err != nil || resp == nil {
 			log.Println(err)
+			c.RecordAuthFailure(r)
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -172,7 +174,35 @@ func (c *App) ValidateLogin() http.HandlerFunc {
 			Admin:             admin,
 		}
 
-		err = c.StoreUserSession(user)
+		if factors := c.SecondFactors(user.MatrixUserID); len(factors) > 0 {
+			challenge, err := c.NewTwoFactorChallenge(user)
+			if err != nil {
+				log.Println(err)
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"authenticated": false,
+						"error":         "internal server error",
+					},
+				})
+				return
+			}
+
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"2fa":           true,
+					"challenge":     challenge,
+					"methods":       factors,
+				},
+			})
+			return
+		}
+
+		c.ClearAuthFailures(r)
+
+		err = c.CreateUserSession(r, user)
 
 		spaces, err := c.MatrixDB.Queries.GetUserSpaces(context.Background(), pgtype.Text{String: resp.UserID, Valid: true})
 		if err != nil {
@@ -595,13 +625,15 @@ func (c *App) SendRecoveryCode() http.HandlerFunc {
 
 		log.Println("recieved payload ", p)
 
-		exists, err := c.MatrixDB.Queries.DoesEmailExist(context.Background(), pgtype.Text{
+		// recovery codes only go to the address people log in with
+		creds, err := c.MatrixDB.Queries.GetCredentials(context.Background(), pgtype.Text{
 			String: p.Email,
 			Valid:  true,
 		})
 		if err != nil {
 			log.Println(err)
 		}
+		exists := err == nil && creds.Email.String == p.Email
 		log.Println("does email exist?", exists)
 		log.Println("does email exist?", exists)
 		log.Println("does email exist?", exists)
@@ -657,6 +689,7 @@ func (c *App) VerifyRecoveryCode() http.HandlerFunc {
 		valid, err := c.DoesEmailCodeExist(p)
 
 		if err != nil || !valid {
+			c.RecordAuthFailure(r)
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -720,6 +753,7 @@ func (c *App) ResetPassword() http.HandlerFunc {
 		valid, err := c.DoesEmailCodeExist(p)
 
 		if err != nil || !valid {
+			c.RecordAuthFailure(r)
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -80,6 +80,16 @@ func (c *App) AddCodeToCache(key string, t any) error {
 	return nil
 }
 
+func (c *App) RemoveCodeFromCache(key string) {
+	err := c.Cache.VerificationCodes.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(key)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (c *App) DoesEmailCodeExist(t *CodeVerification) (bool, error) {
 
 	exists := false
@@ -0,0 +1,878 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// state event spaces and the instance's public space keep their content
+// filters in, so they federate with the space
+const ContentFilterType = "space.content_filters"
+
+// what a filter matches
+const (
+	FilterWord  = "word"
+	FilterRegex = "regex"
+	FilterLink  = "link"
+)
+
+// what happens to a post that matches, from least to most severe
+const (
+	FilterFlag   = "flag"
+	FilterHold   = "hold"
+	FilterReject = "reject"
+)
+
+var filterSeverity = map[string]int{
+	FilterFlag:   1,
+	FilterHold:   2,
+	FilterReject: 3,
+}
+
+const (
+	HeldPostOpen      = "open"
+	HeldPostApproving = "approving"
+	HeldPostApproved  = "approved"
+	HeldPostRejected  = "rejected"
+)
+
+const (
+	maxFilterRules   = 500
+	maxFilterPattern = 256
+)
+
+// ContentFilterRule matches words, regexes or link domains. Words match
+// whole words, ignoring case. Links match the domain and its subdomains.
+type ContentFilterRule struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ContentFilters is the content of a space.content_filters state event.
+type ContentFilters struct {
+	Rules []*ContentFilterRule `json:"rules"`
+
+	// room the filters were set in
+	RoomID string `json:"-"`
+
+	// compiled patterns of Rules, in the same order
+	patterns []*regexp.Regexp
+}
+
+// FilterCache keeps the compiled patterns of each room's current
+// space.content_filters event, so posts don't compile them again.
+type FilterCache struct {
+	mu sync.RWMutex
+	// room -> patterns of its filters event
+	rooms map[string]*filterPatterns
+}
+
+type filterPatterns struct {
+	eventID  string
+	patterns []*regexp.Regexp
+}
+
+func NewFilterCache() *FilterCache {
+	return &FilterCache{
+		rooms: map[string]*filterPatterns{},
+	}
+}
+
+// get returns the patterns of the rules of a filters event, compiling
+// them the first time the event is seen. Rules that aren't words or
+// regexes get nil.
+func (fc *FilterCache) get(roomID, eventID string, rules []*ContentFilterRule) []*regexp.Regexp {
+
+	fc.mu.RLock()
+	cached, ok := fc.rooms[roomID]
+	fc.mu.RUnlock()
+
+	if ok && cached.eventID == eventID {
+		return cached.patterns
+	}
+
+	patterns := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		pattern, err := rule.compile()
+		if err != nil {
+			log.Println("error compiling content filter: ", err)
+			continue
+		}
+		patterns[i] = pattern
+	}
+
+	fc.mu.Lock()
+	fc.rooms[roomID] = &filterPatterns{
+		eventID:  eventID,
+		patterns: patterns,
+	}
+	fc.mu.Unlock()
+
+	return patterns
+}
+
+// ContentFilterMatch is a rule a post matched and where it was set.
+type ContentFilterMatch struct {
+	RuleID  string `json:"rule_id"`
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason,omitempty"`
+	RoomID  string `json:"room_id"`
+}
+
+// ContentFilterResult is the most severe action of every rule a post
+// matched.
+type ContentFilterResult struct {
+	Action  string
+	Matches []*ContentFilterMatch
+}
+
+// a word is anything between letters, numbers and underscores, \b only
+// knows ASCII
+const wordBoundary = `[^\p{L}\p{N}_]`
+
+var linkPattern = regexp.MustCompile(`(?i)https?://[^\s<>"']+`)
+
+func (rule *ContentFilterRule) compile() (*regexp.Regexp, error) {
+	switch rule.Type {
+	case FilterWord:
+		return regexp.Compile(`(?i)(?:^|` + wordBoundary + `)` + regexp.QuoteMeta(rule.Pattern) + `(?:$|` + wordBoundary + `)`)
+	case FilterRegex:
+		return regexp.Compile(rule.Pattern)
+	}
+	return nil, nil
+}
+
+func (rule *ContentFilterRule) validate() error {
+	if _, ok := filterSeverity[rule.Action]; !ok {
+		return errors.New("action must be reject, hold or flag")
+	}
+
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	if rule.Pattern == "" || len(rule.Pattern) > maxFilterPattern {
+		return errors.New("patterns can't be empty or longer than 256 characters")
+	}
+
+	switch rule.Type {
+	case FilterWord, FilterRegex:
+		_, err := rule.compile()
+		if err != nil {
+			return errors.New("invalid regex: " + rule.Pattern)
+		}
+	case FilterLink:
+		rule.Pattern = strings.TrimPrefix(strings.ToLower(rule.Pattern), "*.")
+	default:
+		return errors.New("type must be word, regex or link")
+	}
+
+	if rule.ID == "" {
+		rule.ID = RandomString(8)
+	}
+
+	return nil
+}
+
+// linkDomains are the hosts of every link in the text.
+func linkDomains(text string) []string {
+	domains := []string{}
+	for _, link := range linkPattern.FindAllString(text, -1) {
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		domains = append(domains, strings.ToLower(u.Hostname()))
+	}
+	return domains
+}
+
+// matches takes the rule's compiled pattern, which link rules don't have.
+func (rule *ContentFilterRule) matches(pattern *regexp.Regexp, text string, domains []string) bool {
+	switch rule.Type {
+	case FilterLink:
+		for _, domain := range domains {
+			if domain == rule.Pattern || strings.HasSuffix(domain, "."+rule.Pattern) {
+				return true
+			}
+		}
+	case FilterWord, FilterRegex:
+		return pattern != nil && pattern.MatchString(text)
+	}
+	return false
+}
+
+// postText is the text of a post that filters look at, including the new
+// content of edits.
+func postText(content any) string {
+
+	serialized, err := json.Marshal(content)
+	if err != nil {
+		return ""
+	}
+
+	var fields map[string]any
+	if json.Unmarshal(serialized, &fields) != nil {
+		return ""
+	}
+
+	parts := []string{}
+	for _, key := range []string{"title", "body", "formatted_body"} {
+		if s, ok := fields[key].(string); ok && s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	if edit, ok := fields["m.new_content"]; ok {
+		parts = append(parts, postText(edit))
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// GetContentFilters returns the filters of roomID, of the space it belongs
+// to and of the instance.
+func (c *App) GetContentFilters(roomID string) ([]*ContentFilters, error) {
+
+	rows, err := c.MatrixDB.Queries.GetContentFilters(context.Background(), matrix_db.GetContentFiltersParams{
+		RoomID:         roomID,
+		InstanceRoomID: c.DefaultMatrixSpace,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []*ContentFilters{}
+
+	for _, row := range rows {
+		var f ContentFilters
+		err := json.Unmarshal([]byte(row.Content), &f)
+		if err != nil {
+			log.Println("error parsing content filters: ", err)
+			continue
+		}
+		f.RoomID = row.RoomID
+		f.patterns = c.FilterCache.get(row.RoomID, row.EventID, f.Rules)
+		filters = append(filters, &f)
+	}
+
+	return filters, nil
+}
+
+// CheckContentFilters runs the filters that apply to a new post. It returns
+// nothing when the post matches none.
+func (c *App) CheckContentFilters(user *User, p *NewPostBody) *ContentFilterResult {
+
+	if user == nil || p.RoomID == "" || user.Admin {
+		return nil
+	}
+
+	text := postText(p.Content)
+	if text == "" {
+		return nil
+	}
+
+	filters, err := c.GetContentFilters(p.RoomID)
+	if err != nil {
+		log.Println("error getting content filters: ", err)
+		return nil
+	}
+
+	domains := linkDomains(text)
+
+	result := &ContentFilterResult{
+		Matches: []*ContentFilterMatch{},
+	}
+
+	for _, f := range filters {
+		for i, rule := range f.Rules {
+			if !rule.matches(f.patterns[i], text, domains) {
+				continue
+			}
+
+			result.Matches = append(result.Matches, &ContentFilterMatch{
+				RuleID:  rule.ID,
+				Type:    rule.Type,
+				Pattern: rule.Pattern,
+				Action:  rule.Action,
+				Reason:  rule.Reason,
+				RoomID:  f.RoomID,
+			})
+
+			if filterSeverity[rule.Action] > filterSeverity[result.Action] {
+				result.Action = rule.Action
+			}
+		}
+	}
+
+	if len(result.Matches) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+// filterMessage is what the author is told, the reason of the first rule
+// that decided the action when there is one.
+func (r *ContentFilterResult) filterMessage(fallback string) string {
+	for _, match := range r.Matches {
+		if match.Action == r.Action && match.Reason != "" {
+			return match.Reason
+		}
+	}
+	return fallback
+}
+
+// RespondWithContentFilter rejects or holds a post that matched a filter.
+// Handlers return when it returns true, flagged posts go through.
+func (c *App) RespondWithContentFilter(w http.ResponseWriter, user *User, p *NewPostBody, result *ContentFilterResult) bool {
+
+	if result == nil || result.Action == FilterFlag {
+		return false
+	}
+
+	if result.Action == FilterReject {
+		message := result.filterMessage("Your post contains something that isn't allowed here.")
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success":   false,
+				"forbidden": true,
+				"error":     message,
+				"reasons": []*PolicyRejection{{
+					Rule:    "content_filter",
+					Message: message,
+					RoomID:  result.Matches[0].RoomID,
+				}},
+			},
+		})
+		return true
+	}
+
+	err := c.HoldPost(user, p, result)
+	if err != nil {
+		log.Println("error holding post: ", err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error":   "could not create post",
+				"success": false,
+			},
+		})
+		return true
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"success": true,
+			"held":    true,
+			"message": "Your post is waiting for a moderator to approve it.",
+			"session": p.Session,
+			"txn_id":  p.TransactionID,
+		},
+	})
+
+	return true
+}
+
+// HoldPost keeps a post for the space's moderators to review instead of
+// sending it.
+func (c *App) HoldPost(user *User, p *NewPostBody, result *ContentFilterResult) error {
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	matches, err := json.Marshal(result.Matches)
+	if err != nil {
+		return err
+	}
+
+	spaceRoomID, err := c.MatrixDB.Queries.GetRoomSpace(context.Background(), p.RoomID)
+	if err != nil {
+		return err
+	}
+
+	return c.MatrixDB.Queries.CreateHeldPost(context.Background(), matrix_db.CreateHeldPostParams{
+		ID:          RandomString(24),
+		Sender:      user.MatrixUserID,
+		RoomID:      p.RoomID,
+		SpaceRoomID: spaceRoomID,
+		Body:        string(body),
+		Matches:     string(matches),
+		CreatedAt:   time.Now().UnixMilli(),
+	})
+}
+
+// FlagPost reports a post that matched a flag filter. The room that set
+// the filter is the reporter.
+func (c *App) FlagPost(user *User, event *Event, p *NewPostBody, result *ContentFilterResult) {
+
+	spaceRoomID, err := c.MatrixDB.Queries.GetRoomSpace(context.Background(), p.RoomID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, match := range result.Matches {
+		reason := match.Reason
+		if reason == "" {
+			reason = "matched " + match.Type + " filter " + match.Pattern
+		}
+
+		err := c.CreateReport(&NewReportParams{
+			Reporter:     match.RoomID,
+			TargetType:   reportTargetType(p.Type),
+			TargetUserID: user.MatrixUserID,
+			EventID:      event.EventID,
+			RoomID:       p.RoomID,
+			SpaceRoomID:  spaceRoomID,
+			Category:     "content_filter",
+			Reason:       reason,
+		})
+		if err != nil {
+			log.Println("error flagging post: ", err)
+		}
+	}
+}
+
+// ReviewHeldPost approves or rejects a held post. Approved posts are sent
+// as their author through a device made for the job.
+func (c *App) ReviewHeldPost(user *User, held *matrix_db.CommuneHeldPost, approve bool, note string) (*Event, error) {
+
+	review := matrix_db.ReviewHeldPostParams{
+		ID:         held.ID,
+		Status:     HeldPostRejected,
+		ReviewedBy: user.MatrixUserID,
+		ReviewedAt: time.Now().UnixMilli(),
+		Note:       note,
+		FromStatus: HeldPostOpen,
+	}
+
+	// claim the post before anything is sent, only one review gets it
+	if approve {
+		review.Status = HeldPostApproving
+	}
+
+	err := c.reviewHeldPost(review)
+	if err != nil {
+		return nil, err
+	}
+
+	var event *Event
+
+	if approve {
+		event, err = c.sendHeldPost(held)
+		if err != nil {
+			// let another moderator approve or reject it
+			release := c.reviewHeldPost(matrix_db.ReviewHeldPostParams{
+				ID:         held.ID,
+				Status:     HeldPostOpen,
+				FromStatus: HeldPostApproving,
+			})
+			if release != nil {
+				log.Println("error releasing held post: ", release)
+			}
+			return nil, err
+		}
+
+		review.Status = HeldPostApproved
+		review.FromStatus = HeldPostApproving
+		review.EventID = event.EventID
+
+		err = c.reviewHeldPost(review)
+		if err != nil {
+			log.Println("error approving held post: ", err)
+		}
+	}
+
+	c.Audit(&AuditEntry{
+		Actor:        user.MatrixUserID,
+		Action:       AuditReviewHeldPost,
+		TargetUserID: held.Sender,
+		Target:       review.EventID,
+		SpaceRoomID:  held.SpaceRoomID,
+		Reason:       note,
+		Details: map[string]any{
+			"held_post": held.ID,
+			"status":    review.Status,
+		},
+	})
+
+	return event, nil
+}
+
+// reviewHeldPost moves a held post to its new status, failing when it's no
+// longer in the status it's moved from.
+func (c *App) reviewHeldPost(review matrix_db.ReviewHeldPostParams) error {
+
+	rows, err := c.MatrixDB.Queries.ReviewHeldPost(context.Background(), review)
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return errors.New("post was already reviewed")
+	}
+
+	return nil
+}
+
+// sendHeldPost sends a held post as its author, as long as they could
+// still post it themselves. They may have been banned or muted since.
+func (c *App) sendHeldPost(held *matrix_db.CommuneHeldPost) (*Event, error) {
+
+	var body NewPostBody
+	err := json.Unmarshal([]byte(held.Body), &body)
+	if err != nil {
+		return nil, err
+	}
+	body.TransactionID = ""
+
+	banned, err := c.MatrixDB.Queries.IsBannedFromRooms(context.Background(), matrix_db.IsBannedFromRoomsParams{
+		UserID:  held.Sender,
+		RoomIds: []string{held.RoomID, held.SpaceRoomID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, errors.New("author was banned")
+	}
+
+	pl, err := c.RoomPowerLevels(held.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if pl.UserLevel(held.Sender) < pl.level("events_default", 0) {
+		return nil, errors.New("author was muted")
+	}
+
+	author, err := c.LoginUser(held.Sender)
+	if err != nil {
+		return nil, err
+	}
+	defer c.logoutMatrixDevice(author)
+
+	rejections := c.CheckPostingPolicy(&PolicyRequest{
+		User:   author,
+		RoomID: held.RoomID,
+		Action: PostAction(&body),
+	})
+	if len(rejections) > 0 {
+		return nil, errors.New(rejections[0].Message)
+	}
+
+	return c.NewPost(&NewPostParams{
+		Body:              &body,
+		MatrixUserID:      author.MatrixUserID,
+		MatrixAccessToken: author.MatrixAccessToken,
+	})
+}
+
+// a content filter scope resolver returns the room whose filters a request
+// manages and whether the user may manage them
+type filterScope func(r *http.Request, user *User) (string, bool)
+
+// InstanceFilterScope is the instance's public space, for admins.
+func (c *App) InstanceFilterScope(r *http.Request, user *User) (string, bool) {
+	return c.DefaultMatrixSpace, user.Admin && c.DefaultMatrixSpace != ""
+}
+
+// SpaceFilterScope is a space, for its owner.
+func (c *App) SpaceFilterScope(r *http.Request, user *User) (string, bool) {
+
+	state, err := c.GetSpaceState(&SpaceStateParams{
+		Slug:         strings.ToLower(chi.URLParam(r, "space")),
+		MatrixUserID: user.MatrixUserID,
+	})
+	if err != nil {
+		return "", false
+	}
+
+	return state.RoomID, state.IsOwner || user.Admin
+}
+
+func (c *App) ContentFilters(scope filterScope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := scope(r, user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		rules := []*ContentFilterRule{}
+
+		filters, err := c.GetContentFilters(roomID)
+		if err != nil {
+			log.Println(err)
+		}
+		for _, f := range filters {
+			if f.RoomID == roomID {
+				rules = f.Rules
+			}
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"rules": rules,
+			},
+		})
+	}
+}
+
+// UpdateContentFilters replaces the rules with the ones in the request.
+// The instance's rules are set by the instance account, which owns the
+// public space.
+func (c *App) UpdateContentFilters(scope filterScope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &ContentFilters{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := scope(r, user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		if p.Rules == nil {
+			p.Rules = []*ContentFilterRule{}
+		}
+
+		if len(p.Rules) > maxFilterRules {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "too many rules",
+				},
+			})
+			return
+		}
+
+		for _, rule := range p.Rules {
+			err := rule.validate()
+			if err != nil {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"error": err.Error(),
+					},
+				})
+				return
+			}
+		}
+
+		// the instance account sets the instance's filters, through a device
+		// that's logged out once they're set
+		sender := user
+		if roomID == c.DefaultMatrixSpace {
+			sender, err = c.instanceModerator()
+			if err != nil {
+				log.Println(err)
+				RespondWithBadRequestError(w)
+				return
+			}
+			defer c.logoutMatrixDevice(sender)
+		}
+
+		matrix, err := c.matrixClient(sender)
+		if err != nil {
+			log.Println(err)
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		resp, err := matrix.SendStateEvent(roomID, ContentFilterType, "", p)
+		if err != nil {
+			log.Println("error setting content filters: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   "could not update content filters",
+					"success": false,
+				},
+			})
+			return
+		}
+
+		c.Audit(&AuditEntry{
+			Actor:       user.MatrixUserID,
+			Action:      AuditContentFilters,
+			Target:      resp.EventID,
+			SpaceRoomID: roomID,
+			Details: map[string]any{
+				"rules": len(p.Rules),
+			},
+		})
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success":  true,
+				"event_id": resp.EventID,
+				"rules":    p.Rules,
+			},
+		})
+	}
+}
+
+func (c *App) reviewHeldPostRequest(w http.ResponseWriter, r *http.Request, user *User, held *matrix_db.CommuneHeldPost) {
+
+	p, err := ReadRequestJSON(r, w, &struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}{})
+	if err != nil || (p.Action != "approve" && p.Action != "reject") {
+		RespondWithBadRequestError(w)
+		return
+	}
+
+	event, err := c.ReviewHeldPost(user, held, p.Action == "approve", p.Note)
+	if err != nil {
+		log.Println("error reviewing held post: ", err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error":    err.Error(),
+				"reviewed": false,
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"reviewed": true,
+			"event":    event,
+		},
+	})
+}
+
+func respondHeldPosts(w http.ResponseWriter, held []matrix_db.CommuneHeldPost, err error) {
+	if err != nil {
+		log.Println(err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error": "could not get held posts",
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"held": held,
+		},
+	})
+}
+
+func (c *App) SpaceHeldPosts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := c.SpaceModerator(chi.URLParam(r, "space"), user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		held, err := c.MatrixDB.Queries.GetSpaceHeldPosts(context.Background(), roomID)
+		respondHeldPosts(w, held, err)
+	}
+}
+
+func (c *App) ReviewSpaceHeldPost() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := c.SpaceModerator(chi.URLParam(r, "space"), user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		held, err := c.MatrixDB.Queries.GetHeldPost(context.Background(), chi.URLParam(r, "id"))
+		if err != nil || held.SpaceRoomID != roomID {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "held post not found",
+				},
+			})
+			return
+		}
+
+		c.reviewHeldPostRequest(w, r, user, &held)
+	}
+}
+
+// InstanceHeldPosts is every held post, for admins.
+func (c *App) InstanceHeldPosts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			respondNotModerator(w)
+			return
+		}
+
+		held, err := c.MatrixDB.Queries.GetInstanceHeldPosts(context.Background())
+		respondHeldPosts(w, held, err)
+	}
+}
+
+func (c *App) ReviewInstanceHeldPost() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			respondNotModerator(w)
+			return
+		}
+
+		held, err := c.MatrixDB.Queries.GetHeldPost(context.Background(), chi.URLParam(r, "id"))
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "held post not found",
+				},
+			})
+			return
+		}
+
+		c.reviewHeldPostRequest(w, r, user, &held)
+	}
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// counterTable is a table that is kept up to date incrementally by triggers
+// on event_relations. Expected is the full aggregation the table should
+// always match, and Equal compares a table row (t) with an expected row (e).
+type counterTable struct {
+	Table    string
+	Keys     []string
+	Columns  []string
+	Expected string
+	Equal    string
+}
+
+var counterTables = []counterTable{
+	{
+		Table:   "event_votes",
+		Keys:    []string{"relates_to_id"},
+		Columns: []string{"upvotes", "downvotes"},
+		Expected: `SELECT relates_to_id,
+			COUNT(CASE WHEN aggregation_key = 'upvote' THEN 1 END) AS upvotes,
+			COUNT(CASE WHEN aggregation_key = 'downvote' THEN 1 END) AS downvotes
+			FROM event_relations
+			WHERE relation_type = 'm.annotation'
+			AND aggregation_key IN ('upvote', 'downvote')
+			GROUP BY relates_to_id`,
+		Equal: `t.upvotes = e.upvotes AND t.downvotes = e.downvotes`,
+	},
+	{
+		Table:   "reply_count",
+		Keys:    []string{"relates_to_id"},
+		Columns: []string{"count"},
+		Expected: `WITH RECURSIVE reply_tree AS (
+				SELECT er.event_id, er.relates_to_id
+				FROM event_relations er
+				LEFT JOIN redactions ON redactions.redacts = er.event_id
+				WHERE er.relation_type = 'm.nested_reply'
+				AND redactions.redacts IS NULL
+				UNION ALL
+				SELECT rt.event_id, er.relates_to_id
+				FROM reply_tree rt
+				JOIN event_relations er ON er.event_id = rt.relates_to_id
+				AND er.relation_type = 'm.nested_reply'
+			)
+			SELECT relates_to_id, COUNT(event_id) AS count
+			FROM reply_tree
+			GROUP BY relates_to_id`,
+		Equal: `t.count = e.count`,
+	},
+	{
+		Table:   "event_reactions",
+		Keys:    []string{"relates_to_id", "aggregation_key"},
+		Columns: []string{"url", "senders"},
+		Expected: `SELECT er.relates_to_id, er.aggregation_key,
+			MAX(ej.json::jsonb->'content'->'m.relates_to'->>'url') as url,
+			jsonb_agg(jsonb_build_object('sender', ev.sender, 'event_id', er.event_id)) as senders
+			FROM event_relations er
+			JOIN events ev ON ev.event_id = er.event_id AND er.relation_type = 'm.annotation'
+			LEFT JOIN event_json ej ON ej.event_id = er.event_id
+			WHERE aggregation_key != 'upvote' AND aggregation_key != 'downvote'
+			GROUP BY er.aggregation_key, er.relates_to_id`,
+		// senders order depends on arrival, so compare as sets
+		Equal: `t.senders @> e.senders AND e.senders @> t.senders`,
+	},
+}
+
+// VerifyViews compares every counter table against the relations it is
+// derived from, logs any drift and repairs it in place.
+func VerifyViews(db *MatrixDB) error {
+
+	for _, ct := range counterTables {
+		drift, err := VerifyCounterTable(db, &ct)
+		if err != nil {
+			log.Printf("error verifying %s: %v", ct.Table, err)
+			return err
+		}
+
+		if drift > 0 {
+			log.Printf("%s: repaired %d drifted rows", ct.Table, drift)
+		} else {
+			log.Printf("%s: no drift", ct.Table)
+		}
+	}
+
+	return nil
+}
+
+func VerifyCounterTable(db *MatrixDB, ct *counterTable) (int64, error) {
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// block trigger writes while we compare, so deltas applied by
+	// concurrent relations land on top of the repaired rows
+	_, err = tx.Exec(ctx, fmt.Sprintf(`LOCK TABLE %s IN SHARE ROW EXCLUSIVE MODE`, ct.Table))
+	if err != nil {
+		return 0, err
+	}
+
+	expected := "expected_" + ct.Table
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS %s`, expected, ct.Expected))
+	if err != nil {
+		return 0, err
+	}
+
+	join := []string{}
+	for _, key := range ct.Keys {
+		join = append(join, fmt.Sprintf("t.%s = e.%s", key, key))
+	}
+	on := strings.Join(join, " AND ")
+
+	var drift int64
+
+	err = tx.QueryRow(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s t
+		FULL OUTER JOIN %s e ON %s
+		WHERE t.%s IS NULL OR e.%s IS NULL OR NOT (%s)`,
+		ct.Table, expected, on, ct.Keys[0], ct.Keys[0], ct.Equal)).Scan(&drift)
+	if err != nil {
+		return 0, err
+	}
+
+	if drift == 0 {
+		return 0, tx.Commit(ctx)
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s t
+		WHERE NOT EXISTS (SELECT 1 FROM %s e WHERE %s)`,
+		ct.Table, expected, on))
+	if err != nil {
+		return 0, err
+	}
+
+	set := []string{}
+	for _, col := range ct.Columns {
+		set = append(set, fmt.Sprintf("%s = e.%s", col, col))
+	}
+
+	columns := append(append([]string{}, ct.Keys...), ct.Columns...)
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`UPDATE %s t SET %s FROM %s e
+		WHERE %s AND NOT (%s)`,
+		ct.Table, strings.Join(set, ", "), expected, on, ct.Equal))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (%s)
+		SELECT %s FROM %s e
+		WHERE NOT EXISTS (SELECT 1 FROM %s t WHERE %s)`,
+		ct.Table, strings.Join(columns, ", "), strings.Join(columns, ", "), expected, ct.Table, on))
+	if err != nil {
+		return 0, err
+	}
+
+	return drift, tx.Commit(ctx)
+}
@@ -0,0 +1,337 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func (c *App) deletionGracePeriod() time.Duration {
+	days := c.Config.Account.DeletionGracePeriod
+	if days < 0 {
+		days = 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StartAccountJobs erases accounts whose grace period is over and clears
+// out old data exports.
+func (c *App) StartAccountJobs() {
+
+	_, err := c.Cron.AddFunc("@hourly", func() {
+		now := time.Now()
+
+		if !c.Fanout.Claim("account", now.Truncate(time.Minute).Format(time.RFC3339)) {
+			return
+		}
+
+		c.EraseDueAccounts(now)
+		c.DeleteExpiredDataExports()
+	})
+	if err != nil {
+		log.Println("error scheduling account jobs: ", err)
+		return
+	}
+
+	c.Cron.Start()
+}
+
+func (c *App) EraseDueAccounts(now time.Time) {
+
+	due, err := c.MatrixDB.Queries.GetDueAccountDeletions(context.Background(), now.UnixMilli())
+	if err != nil {
+		log.Println("error getting account deletions: ", err)
+		return
+	}
+
+	for _, matrixUserID := range due {
+		err := c.EraseAccount(matrixUserID)
+		if err != nil {
+			log.Println("error erasing account ", matrixUserID, ": ", err)
+			continue
+		}
+
+		err = c.MatrixDB.Queries.CompleteAccountDeletion(context.Background(), matrix_db.CompleteAccountDeletionParams{
+			UserID:      matrixUserID,
+			CompletedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// EraseAccount redacts everything the user posted, deactivates them in
+// Synapse and removes their sessions and data. The user's sessions may be
+// long gone by now, so redactions go through a device made for the job.
+func (c *App) EraseAccount(matrixUserID string) error {
+
+	log.Println("erasing account", matrixUserID)
+
+	did := RandomString(12)
+
+	_, err := c.MatrixDB.Queries.UNSAFECreateDevice(context.Background(), matrix_db.UNSAFECreateDeviceParams{
+		UserID:   matrixUserID,
+		DeviceID: did,
+	})
+	if err != nil {
+		return err
+	}
+
+	token, err := c.MatrixDB.Queries.UNSAFECreateAccessToken(context.Background(), matrix_db.UNSAFECreateAccessTokenParams{
+		UserID: matrixUserID,
+		DeviceID: pgtype.Text{
+			String: did,
+			Valid:  true,
+		},
+		Token: RandomString(32),
+	})
+	if err != nil {
+		return err
+	}
+
+	events, err := c.GetUserEvents(matrixUserID)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		_, err := c.RedactEvent(&RedactEventParams{
+			RoomID:            event.RoomID,
+			EventID:           event.EventID,
+			Reason:            "account deleted",
+			MatrixUserID:      matrixUserID,
+			MatrixAccessToken: token,
+		})
+		if err != nil {
+			log.Println("error redacting ", event.EventID, ": ", err)
+		}
+	}
+
+	// clearing the profile through the homeserver updates it in every room
+	// the user was in
+	matrix, err := c.matrixClient(&User{
+		MatrixUserID:      matrixUserID,
+		MatrixAccessToken: token,
+	})
+	if err == nil {
+		err = matrix.SetDisplayName("")
+		if err == nil {
+			err = matrix.SetAvatarURL("")
+		}
+	}
+	if err != nil {
+		log.Println("error clearing profile: ", err)
+	}
+
+	err = c.MatrixDB.Queries.DeactivateUser(context.Background(), pgtype.Text{
+		String: matrixUserID,
+		Valid:  true,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.logoutMatrixDevice(&User{
+		MatrixUserID:      matrixUserID,
+		MatrixAccessToken: token,
+	})
+
+	err = c.PurgeUserSessions(matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.EraseProfile(context.Background(), pgtype.Text{
+		String: matrixUserID,
+		Valid:  true,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteUserDirectory(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteUserDirectorySearch(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteUserThreepids(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeletePrimaryEmail(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteTwoFactor(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteRecoveryCodes(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteUserDataExports(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = c.MatrixDB.Queries.DeleteUserPasskeys(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+func (c *App) AccountDeletion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		deletion, err := c.MatrixDB.Queries.GetAccountDeletion(context.Background(), user.MatrixUserID)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"scheduled": false,
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"scheduled":    true,
+				"requested_at": deletion.RequestedAt,
+				"delete_at":    deletion.DeleteAt,
+			},
+		})
+	}
+}
+
+// DeleteAccount schedules the account to be erased once the grace period is
+// over. People with a password confirm with it, and with a code when they
+// have two-factor on.
+func (c *App) DeleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if c.RespondIfLockedOut(w, accountSubject(user)) {
+			return
+		}
+
+		hash, err := c.MatrixDB.Queries.GetPasswordHash(context.Background(), pgtype.Text{
+			String: user.MatrixUserID,
+			Valid:  true,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		if hash.String != "" && !CheckPasswordHash(p.Password, hash.String) {
+			c.RecordAuthFailure(r, accountSubject(user))
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "password is incorrect",
+				},
+			})
+			return
+		}
+
+		if c.TwoFactorEnabled(user.MatrixUserID) && !c.VerifyTwoFactorCode(user.MatrixUserID, p.Code) {
+			c.RecordAuthFailure(r, accountSubject(user))
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "code is incorrect",
+					"2fa":   true,
+				},
+			})
+			return
+		}
+
+		now := time.Now()
+
+		deletion, err := c.MatrixDB.Queries.ScheduleAccountDeletion(context.Background(), matrix_db.ScheduleAccountDeletionParams{
+			UserID:      user.MatrixUserID,
+			RequestedAt: now.UnixMilli(),
+			DeleteAt:    now.Add(c.deletionGracePeriod()).UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not delete account",
+				},
+			})
+			return
+		}
+
+		// without a grace period there's nothing to wait for
+		if c.deletionGracePeriod() == 0 {
+			go c.EraseDueAccounts(now)
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"scheduled": true,
+				"delete_at": deletion.DeleteAt,
+			},
+		})
+	}
+}
+
+func (c *App) CancelAccountDeletion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		cancelled, err := c.MatrixDB.Queries.CancelAccountDeletion(context.Background(), user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not cancel account deletion",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"cancelled": cancelled > 0,
+			},
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// digest frequencies
+const (
+	DigestOff    = "off"
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+var digestIntervals = map[string]time.Duration{
+	DigestHourly: time.Hour,
+	DigestDaily:  time.Hour * 24,
+	DigestWeekly: time.Hour * 24 * 7,
+}
+
+// cron doesn't fire at exactly the same second every time
+const digestSlack = time.Minute * 5
+
+func IsValidDigestFrequency(f string) bool {
+	_, ok := digestIntervals[f]
+	return ok || f == DigestOff
+}
+
+func (c *App) defaultDigestFrequency() string {
+	if IsValidDigestFrequency(c.Config.Digest.DefaultFrequency) {
+		return c.Config.Digest.DefaultFrequency
+	}
+	return DigestDaily
+}
+
+// StartDigests schedules email digests on the app's cron.
+func (c *App) StartDigests() {
+
+	if !c.Config.Digest.Enabled {
+		return
+	}
+
+	schedule := c.Config.Digest.Schedule
+	if schedule == "" {
+		schedule = "@hourly"
+	}
+
+	_, err := c.Cron.AddFunc(schedule, c.SendDigests)
+	if err != nil {
+		log.Println("error scheduling digests: ", err)
+		return
+	}
+
+	c.Cron.Start()
+}
+
+// digestItem is a notification or mention as shown in a digest. Rows from
+// the notification and mention queries decode into it.
+type digestItem struct {
+	Type             string `json:"type"`
+	FromMatrixUserID string `json:"from_matrix_user_id"`
+	DisplayName      string `json:"display_name"`
+	Body             string `json:"body"`
+	RoomAlias        string `json:"room_alias"`
+	CreatedAt        int64  `json:"created_at"`
+	Read             bool   `json:"read"`
+}
+
+func toDigestItem(row any) (*digestItem, error) {
+	serialized, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+
+	var item digestItem
+	err = json.Unmarshal(serialized, &item)
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// SendDigests emails everyone who is due a digest and has unseen
+// notifications since their last one.
+func (c *App) SendDigests() {
+
+	now := time.Now()
+
+	// every instance runs the same schedule, only one of them sends
+	if !c.Fanout.Claim("digest", now.Truncate(time.Minute).Format(time.RFC3339)) {
+		return
+	}
+
+	// the longest interval bounds how far back anyone's digest can reach
+	since := now.Add(-digestIntervals[DigestWeekly]).UnixMilli()
+
+	candidates, err := c.MatrixDB.Queries.GetDigestCandidates(context.Background(), pgtype.Int8{
+		Int64: since,
+		Valid: true,
+	})
+	if err != nil {
+		log.Println("error getting digest candidates: ", err)
+		return
+	}
+
+	sent := 0
+
+	for _, candidate := range candidates {
+
+		frequency := candidate.Frequency
+		if frequency == "" {
+			frequency = c.defaultDigestFrequency()
+		}
+
+		interval, ok := digestIntervals[frequency]
+		if !ok {
+			continue
+		}
+
+		if now.Sub(time.UnixMilli(candidate.LastSentAt)) < interval-digestSlack {
+			continue
+		}
+
+		cutoff := now.Add(-interval).UnixMilli()
+		if candidate.LastSentAt > cutoff {
+			cutoff = candidate.LastSentAt
+		}
+
+		ok, err := c.sendDigest(&digestRecipient{
+			MatrixUserID: candidate.UserID,
+			Username:     candidate.Username.String,
+			Email:        candidate.Address,
+			Frequency:    frequency,
+		}, cutoff)
+		if err != nil {
+			log.Println("error sending digest to", candidate.UserID, err)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		err = c.MatrixDB.Queries.UpdateDigestSentAt(context.Background(), matrix_db.UpdateDigestSentAtParams{
+			UserID:     candidate.UserID,
+			Frequency:  frequency,
+			LastSentAt: now.UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		sent++
+	}
+
+	log.Printf("sent %d digests", sent)
+}
+
+type digestRecipient struct {
+	MatrixUserID string
+	Username     string
+	Email        string
+	Frequency    string
+}
+
+// sendDigest returns false when there was nothing to send.
+func (c *App) sendDigest(r *digestRecipient, cutoff int64) (bool, error) {
+
+	userspace, err := c.MatrixDB.Queries.GetUserSpaceID(context.Background(), matrix_db.GetUserSpaceIDParams{
+		RoomAlias: fmt.Sprintf("#@%s:%s", r.Username, c.Config.Matrix.PublicServer),
+		Creator: pgtype.Text{
+			String: r.MatrixUserID,
+			Valid:  true,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	notifications, err := c.MatrixDB.Queries.GetNotifications(context.Background(), matrix_db.GetNotificationsParams{
+		Sender: pgtype.Text{
+			String: r.MatrixUserID,
+			Valid:  true,
+		},
+		RoomID: pgtype.Text{
+			String: userspace,
+			Valid:  true,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	settings, err := c.GetNotificationSettings(r.MatrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	replies := []*digestItem{}
+	follows := []*digestItem{}
+
+	for _, n := range notifications {
+		if settings.Mutes(n) {
+			continue
+		}
+
+		item, err := toDigestItem(n)
+		if err != nil || item.Read || item.CreatedAt <= cutoff {
+			continue
+		}
+
+		switch item.Type {
+		case "space.follow":
+			follows = append(follows, item)
+		case "post.reply", "reply.reply":
+			replies = append(replies, item)
+		}
+	}
+
+	mentions := []*digestItem{}
+
+	rows, err := c.MatrixDB.Queries.GetUnreadMentions(context.Background(), matrix_db.GetUnreadMentionsParams{
+		UserID: r.MatrixUserID,
+		Since: pgtype.Int8{
+			Int64: cutoff,
+			Valid: true,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, row := range rows {
+		item, err := toDigestItem(row)
+		if err != nil {
+			continue
+		}
+		mentions = append(mentions, item)
+	}
+
+	total := len(replies) + len(follows) + len(mentions)
+	if total == 0 {
+		return false, nil
+	}
+
+	unsubscribe := fmt.Sprintf("%s/account/notifications/unsubscribe?token=%s",
+		c.URLScheme(c.Config.App.Domain), c.digestUnsubscribeToken(r.MatrixUserID))
+
+	var body bytes.Buffer
+
+	err = c.Templates.ExecuteTemplate(&body, "digest", map[string]any{
+		"Name":           c.Config.Name,
+		"Username":       r.Username,
+		"Frequency":      r.Frequency,
+		"Replies":        replies,
+		"Mentions":       mentions,
+		"Follows":        follows,
+		"Link":           c.Config.App.PublicDomain + "/notifications",
+		"UnsubscribeURL": unsubscribe,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	subject := fmt.Sprintf("You have %d new notifications on %s", total, c.Config.Name)
+	if total == 1 {
+		subject = fmt.Sprintf("You have a new notification on %s", c.Config.Name)
+	}
+
+	err = c.SendEmail(r.Email, subject, body.String(), map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribe + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// digestUnsubscribeToken signs the user ID, so unsubscribe links work
+// without logging in.
+func (c *App) digestUnsubscribeToken(mid string) string {
+	mac := hmac.New(sha256.New, []byte(c.Config.App.JWTKey))
+	mac.Write([]byte("digest-unsubscribe:" + mid))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(mid)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c *App) verifyDigestUnsubscribeToken(token string) (string, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	mid, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	expected := c.digestUnsubscribeToken(string(mid))
+	if !hmac.Equal([]byte(expected), []byte(token)) {
+		return "", false
+	}
+
+	return string(mid), true
+}
+
+// UnsubscribeDigest turns digests off from the link in a digest email.
+// Opening the link only asks to confirm, since mail scanners open links
+// too. The confirmation and one-click List-Unsubscribe both POST.
+func (c *App) UnsubscribeDigest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		token := r.URL.Query().Get("token")
+
+		mid, ok := c.verifyDigestUnsubscribeToken(token)
+
+		if ok && r.Method == http.MethodGet {
+			c.Templates.ExecuteTemplate(w, "digest-unsubscribe", map[string]any{
+				"Name":  c.Config.Name,
+				"Token": token,
+			})
+			return
+		}
+
+		if ok {
+			err := c.MatrixDB.Queries.UpdateDigestFrequency(context.Background(), matrix_db.UpdateDigestFrequencyParams{
+				UserID:    mid,
+				Frequency: DigestOff,
+			})
+			if err != nil {
+				log.Println(err)
+				ok = false
+			}
+		}
+
+		// one-click clients only look at the status, the page posts confirm
+		if r.Method == http.MethodPost && r.FormValue("confirm") == "" {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"success": ok,
+				},
+			})
+			return
+		}
+
+		c.Templates.ExecuteTemplate(w, "digest-unsubscribed", map[string]any{
+			"Name":    c.Config.Name,
+			"Success": ok,
+		})
+	}
+}
+
+func (c *App) DigestSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		frequency := c.defaultDigestFrequency()
+
+		ds, err := c.MatrixDB.Queries.GetDigestSettings(context.Background(), user.MatrixUserID)
+		if err == nil {
+			frequency = ds.Frequency
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"enabled":   c.Config.Digest.Enabled,
+				"frequency": frequency,
+			},
+		})
+	}
+}
+
+func (c *App) UpdateDigestSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		type request struct {
+			Frequency string `json:"frequency"`
+		}
+
+		p, err := ReadRequestJSON(r, w, &request{})
+		if err != nil || !IsValidDigestFrequency(p.Frequency) {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		err = c.MatrixDB.Queries.UpdateDigestFrequency(context.Background(), matrix_db.UpdateDigestFrequencyParams{
+			UserID:    user.MatrixUserID,
+			Frequency: p.Frequency,
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error":   "Could not update digest settings",
+					"success": false,
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success":   true,
+				"frequency": p.Frequency,
+			},
+		})
+	}
+}
@@ -9,10 +9,6 @@ import (
 
 func (c *App) SendVerificationCode(email string, code string) error {
 
-	password := c.Config.SMTP.Password
-
-	to := []string{email}
-
 	var body bytes.Buffer
 
 	type Values struct {
@@ -25,12 +21,43 @@ func (c *App) SendVerificationCode(email string, code string) error {
 
 	c.Templates.ExecuteTemplate(&body, "verification-code", v)
 
+	return c.SendEmail(email, code+" is your code", body.String(), nil)
+}
+
+// SendEmailChanged tells an address about a change to the emails on its
+// account.
+func (c *App) SendEmailChanged(email string, message string) error {
+
+	var body bytes.Buffer
+
+	c.Templates.ExecuteTemplate(&body, "email-changed", struct {
+		Message string
+	}{
+		Message: message,
+	})
+
+	return c.SendEmail(email, "The email on your account changed", body.String(), nil)
+}
+
+// SendEmail sends an HTML email. headers are added to the defaults.
+func (c *App) SendEmail(email string, subject string, body string, headers map[string]string) error {
+
+	password := c.Config.SMTP.Password
+
+	to := []string{email}
+
+	var extra string
+	for k, v := range headers {
+		extra += k + ": " + v + "\r\n"
+	}
+
 	message := []byte("From:" + c.Config.SMTP.Account + "\r\n" +
 		"To: " + email + "\r\n" +
-		"Subject: " + code + " is your code\r\n" +
+		"Subject: " + subject + "\r\n" +
+		extra +
 		"Content-Type: text/html; charset=UTF-8\r\n" +
 		"\r\n" +
-		body.String() + "\r\n")
+		body + "\r\n")
 
 	auth := smtp.PlainAuth("", password, password, c.Config.SMTP.Server)
 
@@ -0,0 +1,410 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func normalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", false
+	}
+
+	return email, true
+}
+
+// codes for adding an address are keyed to the user, so one account can't
+// verify an address for another
+func emailCodeKey(matrixUserID, email string) string {
+	return "email:" + matrixUserID + ":" + email
+}
+
+func (c *App) primaryEmail(matrixUserID string) string {
+	email, err := c.MatrixDB.Queries.GetPrimaryEmail(context.Background(), matrixUserID)
+	if err != nil {
+		return ""
+	}
+	return email
+}
+
+func (c *App) notifyEmailChanged(email, message string) {
+	if email == "" {
+		return
+	}
+
+	go func() {
+		err := c.SendEmailChanged(email, message)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func (c *App) UserEmails() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		emails, err := c.MatrixDB.Queries.GetUserEmails(context.Background(), user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get emails",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"emails": emails,
+			},
+		})
+	}
+}
+
+// AddEmail sends a verification code to a new address. It's only added to
+// the account once the code is verified. An address can take over the
+// account, so the password or a code is needed.
+func (c *App) AddEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		email, ok := normalizeEmail(p.Email)
+		if !ok {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "email is not valid",
+				},
+			})
+			return
+		}
+
+		if c.Config.Authentication.BlockPopularEmailProviders && IsEmailBanned(email) {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"provider_forbidden": true,
+					"error":              "email provider is not allowed",
+				},
+			})
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if !c.confirmIdentity(w, r, user, p.Password, p.Code) {
+			return
+		}
+
+		exists, err := c.MatrixDB.Queries.DoesEmailExist(context.Background(), pgtype.Text{
+			String: email,
+			Valid:  true,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		// like signup, don't tell anyone which addresses are taken
+		if exists {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"sent": true,
+				},
+			})
+			return
+		}
+
+		code := GenerateMagicCode()
+		key := emailCodeKey(user.MatrixUserID, email)
+
+		err = c.AddCodeToCache(key, &CodeVerification{
+			Code:    code,
+			Session: key,
+			Email:   email,
+		})
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "code could not be sent",
+					"sent":  false,
+				},
+			})
+			return
+		}
+
+		go c.SendVerificationCode(email, code)
+
+		c.notifyEmailChanged(c.primaryEmail(user.MatrixUserID),
+			fmt.Sprintf("Someone asked to add %s to your account. It won't be added until it's verified.", email))
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"sent": true,
+			},
+		})
+	}
+}
+
+func (c *App) VerifyNewEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Email string `json:"email"`
+			Code  string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		email, _ := normalizeEmail(p.Email)
+
+		user := c.LoggedInUser(r)
+
+		key := emailCodeKey(user.MatrixUserID, email)
+
+		valid, err := c.DoesEmailCodeExist(&CodeVerification{
+			Email:   email,
+			Code:    p.Code,
+			Session: key,
+		})
+		if err != nil || !valid {
+			c.RecordAuthFailure(r)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"valid": false,
+				},
+			})
+			return
+		}
+
+		c.RemoveCodeFromCache(key)
+
+		// the current address stays primary, pin it before there are two
+		primary := c.primaryEmail(user.MatrixUserID)
+		if primary == "" {
+			primary = email
+		}
+
+		err = c.MatrixDB.Queries.InitPrimaryEmail(context.Background(), matrix_db.InitPrimaryEmailParams{
+			UserID:    user.MatrixUserID,
+			Address:   primary,
+			UpdatedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		err = c.MatrixDB.Queries.VerifyEmail(context.Background(), matrix_db.VerifyEmailParams{
+			Email: pgtype.Text{
+				String: email,
+				Valid:  true,
+			},
+			MatrixUserID: pgtype.Text{
+				String: user.MatrixUserID,
+				Valid:  true,
+			},
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not add email",
+				},
+			})
+			return
+		}
+
+		if primary != email {
+			c.notifyEmailChanged(primary, fmt.Sprintf("%s was added to your account.", email))
+		}
+
+		user.Email = primary
+		user.Verified = true
+
+		err = c.StoreUserSession(user)
+		if err != nil {
+			log.Println(err)
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"valid":   true,
+				"primary": primary == email,
+			},
+		})
+	}
+}
+
+// SetPrimaryEmail changes the address the account logs in and gets mail
+// with.
+func (c *App) SetPrimaryEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		email, _ := normalizeEmail(p.Email)
+
+		user := c.LoggedInUser(r)
+
+		if !c.confirmIdentity(w, r, user, p.Password, p.Code) {
+			return
+		}
+
+		has, err := c.MatrixDB.Queries.HasEmail(context.Background(), matrix_db.HasEmailParams{
+			UserID:  user.MatrixUserID,
+			Address: email,
+		})
+		if err != nil || !has {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "email is not on this account",
+				},
+			})
+			return
+		}
+
+		old := c.primaryEmail(user.MatrixUserID)
+
+		err = c.MatrixDB.Queries.SetPrimaryEmail(context.Background(), matrix_db.SetPrimaryEmailParams{
+			UserID:    user.MatrixUserID,
+			Address:   email,
+			UpdatedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not change primary email",
+				},
+			})
+			return
+		}
+
+		if old != email {
+			c.notifyEmailChanged(old, fmt.Sprintf("Your account's primary email is now %s. You'll log in with it from now on.", email))
+		}
+
+		user.Email = email
+
+		err = c.StoreUserSession(user)
+		if err != nil {
+			log.Println(err)
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success": true,
+			},
+		})
+	}
+}
+
+// RemoveEmail removes an address that isn't the primary one. The password
+// or a code comes in the body.
+func (c *App) RemoveEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		email, ok := normalizeEmail(r.URL.Query().Get("email"))
+		if !ok {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if !c.confirmIdentity(w, r, user, p.Password, p.Code) {
+			return
+		}
+
+		primary := c.primaryEmail(user.MatrixUserID)
+
+		if email == primary {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "the primary email can't be removed",
+				},
+			})
+			return
+		}
+
+		removed, err := c.MatrixDB.Queries.RemoveEmail(context.Background(), matrix_db.RemoveEmailParams{
+			UserID:  user.MatrixUserID,
+			Address: email,
+		})
+		if err != nil || removed == 0 {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "email is not on this account",
+				},
+			})
+			return
+		}
+
+		message := fmt.Sprintf("%s was removed from your account.", email)
+		c.notifyEmailChanged(primary, message)
+		c.notifyEmailChanged(email, message)
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success": true,
+			},
+		})
+	}
+}
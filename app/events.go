@@ -65,7 +65,7 @@ func (c *App) GetIndexEvents(p *IndexEventsParams) (*[]Event, error) {
 			if err != nil {
 				return nil, err
 			} else {
-				return &events, nil
+				return c.FilterPolicyEvents(&events), nil
 			}
 		}
 	}
@@ -160,7 +160,7 @@ func (c *App) GetIndexEvents(p *IndexEventsParams) (*[]Event, error) {
 		}()
 	}
 
-	return &items, nil
+	return c.FilterPolicyEvents(&items), nil
 }
 
 func (c *App) AllEvents() http.HandlerFunc {
@@ -608,6 +608,9 @@ type SpaceEventsParams struct {
 	Last   string
 	After  string
 	Topic  string
+	Sort   string
+	Time   string
+	Cursor string
 }
 
 func (c *App) GetSpaceEvents(p *SpaceEventsParams) (*[]Event, error) {
@@ -654,7 +657,7 @@ func (c *App) GetSpaceEvents(p *SpaceEventsParams) (*[]Event, error) {
 				log.Println(err)
 			} else {
 				log.Println("responding with cached events")
-				return &events, nil
+				return c.FilterPolicyEvents(&events), nil
 			}
 		}
 	}
@@ -730,7 +733,7 @@ func (c *App) GetSpaceEvents(p *SpaceEventsParams) (*[]Event, error) {
 		}()
 	}
 
-	return &items, nil
+	return c.FilterPolicyEvents(&items), nil
 }
 
 func (c *App) SpaceEvents() http.HandlerFunc {
@@ -804,6 +807,13 @@ func (c *App) SpaceEvents() http.HandlerFunc {
 			return
 		}
 
+		sort := r.URL.Query().Get("sort")
+
+		if IsValidSort(sort) {
+			c.RespondWithRankedSpaceEvents(w, r, state.RoomID)
+			return
+		}
+
 		// get events for this space
 		events, err := c.GetSpaceEvents(&SpaceEventsParams{
 			RoomID: state.RoomID,
@@ -911,6 +921,13 @@ func (c *App) SpaceRoomEvents() http.HandlerFunc {
 		}
 		log.Println("what is child room ID?", crs.ChildRoomID)
 
+		sort := r.URL.Query().Get("sort")
+
+		if IsValidSort(sort) {
+			c.RespondWithRankedSpaceEvents(w, r, crs.ChildRoomID.String)
+			return
+		}
+
 		// get events for this space
 		events, err := c.GetSpaceEvents(&SpaceEventsParams{
 			RoomID: crs.ChildRoomID.String,
@@ -941,3 +958,48 @@ func (c *App) SpaceRoomEvents() http.HandlerFunc {
 
 	}
 }
+
+func (c *App) RespondWithRankedSpaceEvents(w http.ResponseWriter, r *http.Request, roomID string) {
+
+	query := r.URL.Query()
+
+	if query.Get("cursor") != "" {
+		_, err := DecodeRankCursor(query.Get("cursor"))
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"error": "invalid cursor",
+				},
+			})
+			return
+		}
+	}
+
+	events, cursor, err := c.GetRankedSpaceEvents(&SpaceEventsParams{
+		RoomID: roomID,
+		Topic:  query.Get("topic"),
+		Sort:   query.Get("sort"),
+		Time:   query.Get("t"),
+		Cursor: query.Get("cursor"),
+	})
+
+	if err != nil {
+		log.Println("error getting events: ", err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: map[string]any{
+				"error": "could not get events",
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"events": events,
+			"cursor": cursor,
+		},
+	})
+}
@@ -0,0 +1,353 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+var mxcPattern = regexp.MustCompile(`mxc://[A-Za-z0-9.\-:]+/[A-Za-z0-9_\-]+`)
+
+// ExportedEvent is one of the user's events as it appears in an export.
+type ExportedEvent struct {
+	EventID   string          `json:"event_id"`
+	RoomID    string          `json:"room_id"`
+	RoomAlias string          `json:"room_alias,omitempty"`
+	Type      string          `json:"type"`
+	CreatedAt int64           `json:"created_at"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// ExportedMedia is a reference to something the user uploaded.
+type ExportedMedia struct {
+	URL     string `json:"url"`
+	EventID string `json:"event_id,omitempty"`
+	RoomID  string `json:"room_id,omitempty"`
+}
+
+func (c *App) exportExpiry() time.Duration {
+	days := c.Config.Account.ExportExpiry
+	if days <= 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// GetUserEvents pages through everything the user has posted that's still
+// around, newest first.
+func (c *App) GetUserEvents(matrixUserID string) ([]*ExportedEvent, error) {
+
+	events := []*ExportedEvent{}
+
+	// the oldest event seen so far, pages go by timestamp then event id
+	beforeTS := time.Now().UnixMilli() + 1
+	beforeID := ""
+
+	for {
+		rows, err := c.MatrixDB.Queries.GetUserEvents(context.Background(), matrix_db.GetUserEventsParams{
+			Sender: pgtype.Text{
+				String: matrixUserID,
+				Valid:  true,
+			},
+			BeforeTs: beforeTS,
+			BeforeID: beforeID,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			event := json.RawMessage(row.JSON.String)
+			if !json.Valid(event) {
+				event = json.RawMessage("null")
+			}
+
+			events = append(events, &ExportedEvent{
+				EventID:   row.EventID,
+				RoomID:    row.RoomID,
+				RoomAlias: row.RoomAlias,
+				Type:      row.Type,
+				CreatedAt: row.OriginServerTS.Int64,
+				Event:     event,
+			})
+
+			beforeTS = row.OriginServerTS.Int64
+			beforeID = row.EventID
+		}
+
+		// the next page starts after the oldest event of this one
+		if len(rows) < 500 {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// BuildDataExport zips up the user's profile, email addresses, posts,
+// replies, reactions, spaces and uploaded media references.
+func (c *App) BuildDataExport(matrixUserID string) ([]byte, error) {
+
+	profile, err := c.MatrixDB.Queries.GetUserExportProfile(context.Background(), pgtype.Text{
+		String: matrixUserID,
+		Valid:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := c.MatrixDB.Queries.GetUserEmails(context.Background(), matrixUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	spaces, err := c.MatrixDB.Queries.GetUserSpaces(context.Background(), pgtype.Text{
+		String: matrixUserID,
+		Valid:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := c.GetUserEvents(matrixUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []*ExportedEvent{}
+	replies := []*ExportedEvent{}
+	reactions := []*ExportedEvent{}
+	messages := []*ExportedEvent{}
+	media := []*ExportedMedia{}
+
+	if profile.AvatarUrl.String != "" {
+		media = append(media, &ExportedMedia{URL: profile.AvatarUrl.String})
+	}
+
+	for _, event := range events {
+		switch event.Type {
+		case "space.board.post":
+			posts = append(posts, event)
+		case "space.board.post.reply":
+			replies = append(replies, event)
+		case "m.reaction":
+			reactions = append(reactions, event)
+		default:
+			messages = append(messages, event)
+		}
+
+		for _, url := range mxcPattern.FindAllString(string(event.Event), -1) {
+			media = append(media, &ExportedMedia{
+				URL:     url,
+				EventID: event.EventID,
+				RoomID:  event.RoomID,
+			})
+		}
+	}
+
+	files := []struct {
+		Name string
+		Data any
+	}{
+		{"profile.json", profile},
+		{"emails.json", emails},
+		{"spaces.json", spaces},
+		{"posts.json", posts},
+		{"replies.json", replies},
+		{"reactions.json", reactions},
+		{"messages.json", messages},
+		{"media.json", media},
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	for _, file := range files {
+		f, err := archive.Create(file.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *App) runDataExport(id, matrixUserID string) {
+
+	archive, err := c.BuildDataExport(matrixUserID)
+	if err != nil {
+		log.Println("error building data export: ", err)
+		err = c.MatrixDB.Queries.FailDataExport(context.Background(), matrix_db.FailDataExportParams{
+			ID:          id,
+			CompletedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	err = c.MatrixDB.Queries.CompleteDataExport(context.Background(), matrix_db.CompleteDataExportParams{
+		ID:          id,
+		Archive:     archive,
+		CompletedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// DeleteExpiredDataExports drops exports nobody should be downloading any
+// more.
+func (c *App) DeleteExpiredDataExports() {
+	err := c.MatrixDB.Queries.DeleteExpiredDataExports(context.Background(), time.Now().Add(-c.exportExpiry()).UnixMilli())
+	if err != nil {
+		log.Println("error deleting expired data exports: ", err)
+	}
+}
+
+func (c *App) DataExports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		exports, err := c.MatrixDB.Queries.GetDataExports(context.Background(), user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get exports",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"exports":    exports,
+				"expires_in": int64(c.exportExpiry().Seconds()),
+			},
+		})
+	}
+}
+
+func (c *App) CreateDataExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		pending, err := c.MatrixDB.Queries.HasPendingDataExport(context.Background(), user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if pending {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "an export is already being built",
+				},
+			})
+			return
+		}
+
+		id := RandomString(24)
+
+		err = c.MatrixDB.Queries.CreateDataExport(context.Background(), matrix_db.CreateDataExportParams{
+			ID:        id,
+			UserID:    user.MatrixUserID,
+			CreatedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start export",
+				},
+			})
+			return
+		}
+
+		go c.runDataExport(id, user.MatrixUserID)
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"id":     id,
+				"status": ExportPending,
+			},
+		})
+	}
+}
+
+func (c *App) DownloadDataExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		id := chi.URLParam(r, "id")
+
+		export, err := c.MatrixDB.Queries.GetDataExportArchive(context.Background(), matrix_db.GetDataExportArchiveParams{
+			ID:     id,
+			UserID: user.MatrixUserID,
+		})
+		if err != nil || time.Since(time.UnixMilli(export.CreatedAt)) > c.exportExpiry() {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: map[string]any{
+					"error": "export not found",
+				},
+			})
+			return
+		}
+
+		if export.Status != ExportReady {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"status": export.Status,
+				},
+			})
+			return
+		}
+
+		filename := fmt.Sprintf("%s-export-%s.zip", c.Config.Name, time.UnixMilli(export.CreatedAt).Format("2006-01-02"))
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(export.Archive)
+	}
+}
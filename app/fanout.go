@@ -0,0 +1,182 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis pub/sub channels shared by every instance
+const (
+	fanoutNotificationsChannel = "commune:fanout:notifications"
+	fanoutRoomsChannel         = "commune:fanout:rooms"
+	fanoutPolicyListsChannel   = "commune:fanout:policy_lists"
+)
+
+// how long an instance's presence keys survive without a heartbeat
+const fanoutPresenceTTL = time.Minute
+
+// how long an event stays claimed, long enough to outlast any catch-up
+const fanoutClaimTTL = time.Hour
+
+// Fanout delivers websocket messages across instances. Every instance
+// subscribes to the same Redis channels and writes to the sockets it holds
+// locally, so a message published once reaches a socket on any instance.
+type Fanout struct {
+	InstanceID string
+	Redis      *redis.Client
+}
+
+type fanoutMessage struct {
+	Target string          `json:"target"`
+	Type   string          `json:"type,omitempty"`
+	Token  string          `json:"token,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func NewFanout(client *redis.Client) *Fanout {
+	return &Fanout{
+		InstanceID: RandomString(16),
+		Redis:      client,
+	}
+}
+
+func (f *Fanout) usersKey() string {
+	return "commune:instance:" + f.InstanceID + ":users"
+}
+
+func (f *Fanout) roomsKey() string {
+	return "commune:instance:" + f.InstanceID + ":rooms"
+}
+
+// Claim returns true for exactly one instance per key. All instances get
+// the same Postgres NOTIFY, so only the one that claims an event publishes it.
+func (f *Fanout) Claim(kind, eventID string) bool {
+	ok, err := f.Redis.SetNX("commune:claim:"+kind+":"+eventID, f.InstanceID, fanoutClaimTTL).Result()
+	if err != nil {
+		// without redis there is nothing to coordinate with
+		log.Println("error claiming event: ", err)
+		return true
+	}
+	return ok
+}
+
+// Connected records that this instance holds a socket for member, which is
+// either a matrix user ID or a room ID depending on key.
+func (f *Fanout) Connected(key, member string) {
+	err := f.Redis.SAdd(key, member).Err()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	f.Redis.Expire(key, fanoutPresenceTTL)
+}
+
+func (f *Fanout) Disconnected(key, member string) {
+	err := f.Redis.SRem(key, member).Err()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// heartbeat keeps this instance's presence keys alive, so sockets held by
+// an instance that died disappear once its keys expire.
+func (f *Fanout) heartbeat() {
+	for range time.Tick(fanoutPresenceTTL / 3) {
+		f.Redis.Expire(f.usersKey(), fanoutPresenceTTL)
+		f.Redis.Expire(f.roomsKey(), fanoutPresenceTTL)
+	}
+}
+
+func (c *App) publishFanout(channel string, target string, msg *SyncMessage) error {
+	serialized, err := json.Marshal(fanoutMessage{
+		Target: target,
+		Type:   msg.Type,
+		Token:  msg.Token,
+		Data:   msg.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Fanout.Redis.Publish(channel, serialized).Err()
+}
+
+// PublishNotification sends a notification to every socket mid has open,
+// on any instance.
+func (c *App) PublishNotification(mid string, msg *SyncMessage) {
+	err := c.publishFanout(fanoutNotificationsChannel, mid, msg)
+	if err != nil {
+		log.Println("error publishing notification, delivering locally: ", err)
+		c.sendNotification(mid, msg)
+	}
+}
+
+// PublishRoomMessage sends data to every socket open on roomID, on any
+// instance.
+func (c *App) PublishRoomMessage(roomID string, msg *SyncMessage) {
+	err := c.publishFanout(fanoutRoomsChannel, roomID, msg)
+	if err != nil {
+		log.Println("error publishing room message, delivering locally: ", err)
+		c.sendMessageNotification(roomID, msg)
+	}
+}
+
+// PublishPolicyListsChanged tells the other instances to reload the
+// subscribed policy lists. The target is this instance, which already has.
+func (c *App) PublishPolicyListsChanged() {
+	err := c.publishFanout(fanoutPolicyListsChannel, c.Fanout.InstanceID, &SyncMessage{})
+	if err != nil {
+		log.Println("error publishing policy list change: ", err)
+	}
+}
+
+// StartFanout delivers messages published by any instance to the sockets
+// connected to this one.
+func (c *App) StartFanout() {
+
+	go c.Fanout.heartbeat()
+
+	ps := c.Fanout.Redis.Subscribe(fanoutNotificationsChannel, fanoutRoomsChannel, fanoutPolicyListsChannel)
+
+	_, err := ps.Receive()
+	if err != nil {
+		log.Println("error subscribing to fanout channels: ", err)
+	}
+
+	log.Println("fanout started on instance", c.Fanout.InstanceID)
+
+	// Channel reconnects on its own when the redis connection drops
+	for msg := range ps.Channel() {
+		var fm fanoutMessage
+
+		err := json.Unmarshal([]byte(msg.Payload), &fm)
+		if err != nil {
+			log.Println("error unmarshalling fanout message: ", err)
+			continue
+		}
+
+		sm := &SyncMessage{
+			Type:  fm.Type,
+			Token: fm.Token,
+			Data:  fm.Data,
+		}
+
+		switch msg.Channel {
+		case fanoutNotificationsChannel:
+			c.sendNotification(fm.Target, sm)
+		case fanoutRoomsChannel:
+			c.sendMessageNotification(fm.Target, sm)
+		case fanoutPolicyListsChannel:
+			if fm.Target == c.Fanout.InstanceID {
+				continue
+			}
+			err := c.LoadPolicyLists()
+			if err != nil {
+				log.Println("error loading policy lists: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"log"
+	"sync"
+)
+
+// Hub topics
+const (
+	TopicEvents   = "events"
+	TopicPresence = "presence"
+)
+
+// Hub is an in-process pub/sub that fans out everything the database
+// listeners receive. Publishing never blocks: a subscriber that falls
+// behind by more than its buffer misses messages.
+type Hub struct {
+	subscribers map[string]map[*Subscription]bool
+	mutex       sync.RWMutex
+}
+
+type Subscription struct {
+	Topic string
+	C     chan any
+	hub   *Hub
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[string]map[*Subscription]bool),
+	}
+}
+
+func (h *Hub) Subscribe(topic string) *Subscription {
+	sub := &Subscription{
+		Topic: topic,
+		C:     make(chan any, 1024),
+		hub:   h,
+	}
+
+	h.mutex.Lock()
+	if _, ok := h.subscribers[topic]; !ok {
+		h.subscribers[topic] = make(map[*Subscription]bool)
+	}
+	h.subscribers[topic][sub] = true
+	h.mutex.Unlock()
+
+	return sub
+}
+
+// Unsubscribe removes the subscription and closes its channel
+func (s *Subscription) Unsubscribe() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+
+	if _, ok := s.hub.subscribers[s.Topic][s]; ok {
+		delete(s.hub.subscribers[s.Topic], s)
+		close(s.C)
+	}
+}
+
+func (h *Hub) Publish(topic string, msg any) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for sub := range h.subscribers[topic] {
+		select {
+		case sub.C <- msg:
+		default:
+			log.Println("hub subscriber is full, dropping message on", topic)
+		}
+	}
+}
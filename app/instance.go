@@ -13,11 +13,13 @@ func (c *App) HealthCheck() http.HandlerFunc {
 			"healthy":  true,
 			"version":  c.Version[:7],
 			"features": c.Config.Features,
+			"invites":  c.Config.Invites,
 			"restrictions": map[string]any{
 				"space": c.Config.Restrictions.Space,
 				"media": c.Config.Restrictions.Media,
 			},
 			"shortlink_server": c.Config.App.ShortlinkDomain,
+			"private":          c.Config.Privacy.DisablePublic,
 		}
 
 		oauth := make(map[string]any)
@@ -26,6 +28,8 @@ func (c *App) HealthCheck() http.HandlerFunc {
 			if item.Enabled {
 				oauth[item.Provider] = map[string]any{
 					"client_id": item.ClientID,
+					"name":      item.Name,
+					"generic":   item.Issuer != "" || item.AuthURL != "",
 				}
 			}
 		}
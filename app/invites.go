@@ -0,0 +1,421 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var ErrInvalidInviteCode = errors.New("invite code is invalid, used up or expired")
+
+// InviteCode is an invite code along with the accounts it produced.
+type InviteCode struct {
+	Code      string           `json:"code"`
+	CreatedBy string           `json:"created_by"`
+	MaxUses   int32            `json:"max_uses"`
+	Uses      int32            `json:"uses"`
+	ExpiresAt int64            `json:"expires_at"`
+	Revoked   bool             `json:"revoked"`
+	CreatedAt int64            `json:"created_at"`
+	Accounts  []InviteCodeUser `json:"accounts"`
+}
+
+type InviteCodeUser struct {
+	MatrixUserID string `json:"matrix_user_id"`
+	Username     string `json:"username"`
+	UsedAt       int64  `json:"used_at"`
+}
+
+// CanCreateInviteCodes returns why user can't mint invite codes, or an
+// empty string if they can. Admins always can.
+func (c *App) CanCreateInviteCodes(user *User) string {
+
+	if user.Admin {
+		return ""
+	}
+
+	if !c.Config.Invites.UsersCanInvite {
+		return "Only admins can create invite codes."
+	}
+
+	if c.Config.Invites.RequireVerified && !user.Verified {
+		return "You must verify your email to create invite codes."
+	}
+
+	age := int32(c.Config.Invites.MinAccountAge)
+	if age > 0 && !c.IsSenderAgeValid(user, age) {
+		day := "day"
+		if age > 1 {
+			day = "days"
+		}
+		return fmt.Sprintf("Your account needs to be at least %d %s old to create invite codes.", age, day)
+	}
+
+	if c.Config.Invites.CodesPerUser > 0 {
+		count, err := c.MatrixDB.Queries.CountActiveInviteCodes(context.Background(), matrix_db.CountActiveInviteCodesParams{
+			CreatedBy: user.MatrixUserID,
+			Now:       time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			return "Could not create invite code."
+		}
+		if count >= int64(c.Config.Invites.CodesPerUser) {
+			return fmt.Sprintf("You can only have %d unused invite codes at a time.", c.Config.Invites.CodesPerUser)
+		}
+	}
+
+	return ""
+}
+
+// ConsumeInviteCode takes one use of code. Call ReleaseInviteCode if the
+// registration it was taken for fails.
+func (c *App) ConsumeInviteCode(code string) error {
+	if code == "" {
+		return ErrInvalidInviteCode
+	}
+
+	_, err := c.MatrixDB.Queries.ConsumeInviteCode(context.Background(), matrix_db.ConsumeInviteCodeParams{
+		Code: code,
+		Now:  time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return ErrInvalidInviteCode
+	}
+
+	return nil
+}
+
+func (c *App) ReleaseInviteCode(code string) {
+	err := c.MatrixDB.Queries.ReleaseInviteCode(context.Background(), code)
+	if err != nil {
+		log.Println("error releasing invite code: ", err)
+	}
+}
+
+// RecordInviteCodeUse records which account a code produced.
+func (c *App) RecordInviteCodeUse(code string, mid string) {
+	err := c.MatrixDB.Queries.CreateInviteCodeUse(context.Background(), matrix_db.CreateInviteCodeUseParams{
+		Code:   code,
+		UserID: mid,
+		UsedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Println("error recording invite code use: ", err)
+	}
+}
+
+// GetInviteCodes lists codes newest first, with the accounts each produced.
+// An empty creator lists everyone's codes.
+func (c *App) GetInviteCodes(creator string, last string) ([]*InviteCode, error) {
+
+	params := matrix_db.GetInviteCodesParams{
+		Last: time.Now().UnixMilli() + 1,
+	}
+
+	if creator != "" {
+		params.CreatedBy = pgtype.Text{
+			String: creator,
+			Valid:  true,
+		}
+	}
+
+	if last != "" {
+		i, err := strconv.ParseInt(last, 10, 64)
+		if err == nil {
+			params.Last = i
+		}
+	}
+
+	rows, err := c.MatrixDB.Queries.GetInviteCodes(context.Background(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := []*InviteCode{}
+	byCode := map[string]*InviteCode{}
+	keys := []string{}
+
+	for _, row := range rows {
+		ic := &InviteCode{
+			Code:      row.Code,
+			CreatedBy: row.CreatedBy,
+			MaxUses:   row.MaxUses,
+			Uses:      row.Uses,
+			ExpiresAt: row.ExpiresAt,
+			Revoked:   row.Revoked,
+			CreatedAt: row.CreatedAt,
+			Accounts:  []InviteCodeUser{},
+		}
+		codes = append(codes, ic)
+		byCode[row.Code] = ic
+		keys = append(keys, row.Code)
+	}
+
+	if len(keys) == 0 {
+		return codes, nil
+	}
+
+	uses, err := c.MatrixDB.Queries.GetInviteCodeUses(context.Background(), keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, use := range uses {
+		ic, ok := byCode[use.Code]
+		if !ok {
+			continue
+		}
+		ic.Accounts = append(ic.Accounts, InviteCodeUser{
+			MatrixUserID: use.UserID,
+			Username:     use.Username.String,
+			UsedAt:       use.UsedAt,
+		})
+	}
+
+	return codes, nil
+}
+
+func (c *App) CreateInviteCode() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		type request struct {
+			MaxUses int `json:"max_uses"`
+			// hours until the code expires
+			Expiry *int `json:"expiry"`
+		}
+
+		p, err := ReadRequestJSON(r, w, &request{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		reason := c.CanCreateInviteCodes(user)
+		if reason != "" {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":     reason,
+					"forbidden": true,
+				},
+			})
+			return
+		}
+
+		maxUses := c.Config.Invites.MaxUses
+		expiry := c.Config.Invites.Expiry
+
+		// only admins get to pick limits beyond the configured defaults
+		if p.MaxUses > 0 && (user.Admin || p.MaxUses < maxUses) {
+			maxUses = p.MaxUses
+		}
+		if p.Expiry != nil && *p.Expiry >= 0 && (user.Admin || (*p.Expiry > 0 && *p.Expiry < expiry)) {
+			expiry = *p.Expiry
+		}
+
+		if maxUses < 1 {
+			maxUses = 1
+		}
+
+		now := time.Now()
+
+		var expiresAt int64
+		if expiry > 0 {
+			expiresAt = now.Add(time.Duration(expiry) * time.Hour).UnixMilli()
+		}
+
+		// codes can be checked without logging in, so they can't be guessable
+		token, err := randomToken(9)
+		if err != nil {
+			log.Println("error creating invite code: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "Could not create invite code.",
+				},
+			})
+			return
+		}
+
+		code, err := c.MatrixDB.Queries.CreateInviteCode(context.Background(), matrix_db.CreateInviteCodeParams{
+			Code:      token,
+			CreatedBy: user.MatrixUserID,
+			MaxUses:   int32(maxUses),
+			ExpiresAt: expiresAt,
+			CreatedAt: now.UnixMilli(),
+		})
+		if err != nil {
+			log.Println("error creating invite code: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "Could not create invite code.",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"created": true,
+				"invite":  code,
+			},
+		})
+	}
+}
+
+// UserInviteCodes lists the codes the logged in user created.
+func (c *App) UserInviteCodes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		codes, err := c.GetInviteCodes(user.MatrixUserID, r.URL.Query().Get("last"))
+		if err != nil {
+			log.Println("error getting invite codes: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "Could not get invite codes.",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"invites":    codes,
+				"can_create": c.CanCreateInviteCodes(user) == "",
+			},
+		})
+	}
+}
+
+// InviteCodeValid lets the registration form check a code before the
+// account is created.
+func (c *App) InviteCodeValid() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		code := strings.TrimSpace(chi.URLParam(r, "code"))
+
+		valid, err := c.MatrixDB.Queries.IsInviteCodeValid(context.Background(), matrix_db.IsInviteCodeValidParams{
+			Code: code,
+			Now:  time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"valid": valid,
+			},
+		})
+	}
+}
+
+func (c *App) AllInviteCodes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "Not authorized.",
+				},
+			})
+			return
+		}
+
+		query := r.URL.Query()
+
+		codes, err := c.GetInviteCodes(query.Get("created_by"), query.Get("last"))
+		if err != nil {
+			log.Println("error getting invite codes: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "Could not get invite codes.",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"invites": codes,
+			},
+		})
+	}
+}
+
+func (c *App) RevokeInviteCode() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		code := r.URL.Query().Get("code")
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   "Not authorized.",
+					"revoked": false,
+				},
+			})
+			return
+		}
+
+		_, err := c.MatrixDB.Queries.GetInviteCode(context.Background(), code)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   "Invite code does not exist.",
+					"revoked": false,
+				},
+			})
+			return
+		}
+
+		err = c.MatrixDB.Queries.RevokeInviteCode(context.Background(), code)
+		if err != nil {
+			log.Println("error revoking invite code: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   "Error revoking invite code.",
+					"revoked": false,
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"revoked": true,
+			},
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	listenerMinBackoff = time.Second
+	listenerMaxBackoff = time.Second * 30
+)
+
+// NotifyEvent is the payload sent by events_trigger_function
+type NotifyEvent struct {
+	EventID        string `json:"event_id"`
+	RoomID         string `json:"room_id"`
+	Type           string `json:"type"`
+	Sender         string `json:"sender"`
+	TransactionID  string `json:"txn_id"`
+	StreamOrdering int64  `json:"stream_ordering"`
+}
+
+// EventNotification is what the listener publishes on TopicEvents. Event is
+// nil for event types GetEvent can't resolve, such as membership changes.
+type EventNotification struct {
+	NotifyEvent
+	Event *Event
+}
+
+// Listen keeps a dedicated connection LISTENing on channel for as long as
+// the app runs, reconnecting with exponential backoff whenever it drops.
+// onConnect runs after every (re)connect, once LISTEN is active, so that
+// anything missed while disconnected can be caught up without gaps.
+func (c *App) Listen(channel string, onConnect func() error, onNotify func(*pgconn.Notification)) {
+
+	backoff := listenerMinBackoff
+
+	for {
+		connected, err := c.listenOnce(channel, onConnect, onNotify)
+
+		if connected {
+			backoff = listenerMinBackoff
+		}
+
+		log.Printf("listener on %s stopped: %v, reconnecting in %s", channel, err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > listenerMaxBackoff {
+			backoff = listenerMaxBackoff
+		}
+	}
+}
+
+func (c *App) listenOnce(channel string, onConnect func() error, onNotify func(*pgconn.Notification)) (bool, error) {
+	ctx := context.Background()
+
+	pc, err := c.MatrixDB.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// take the connection out of the pool so LISTEN and WaitForNotification
+	// run on the same connection, and nothing else can use it
+	conn := pc.Hijack()
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+	if err != nil {
+		return false, err
+	}
+
+	log.Println("listening on", channel)
+
+	if onConnect != nil {
+		err = onConnect()
+		if err != nil {
+			return true, err
+		}
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		if n != nil && n.Payload != "" {
+			onNotify(n)
+		}
+	}
+}
+
+// eventDeduper remembers the most recently published event IDs, since the
+// catch-up query and live notifications can overlap after a reconnect.
+type eventDeduper struct {
+	seen  map[string]bool
+	order []string
+	size  int
+}
+
+func newEventDeduper(size int) *eventDeduper {
+	return &eventDeduper{
+		seen: make(map[string]bool),
+		size: size,
+	}
+}
+
+func (d *eventDeduper) Seen(eventID string) bool {
+	if d.seen[eventID] {
+		return true
+	}
+
+	d.seen[eventID] = true
+	d.order = append(d.order, eventID)
+
+	if len(d.order) > d.size {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	return false
+}
+
+func (c *App) StartNotifyListener() {
+
+	last, err := c.MatrixDB.Queries.GetMaxStreamOrdering(context.Background())
+	if err != nil {
+		log.Println("error getting stream ordering: ", err)
+	}
+
+	// only touched from the listener goroutine
+	dedup := newEventDeduper(1000)
+
+	publish := func(ne NotifyEvent) {
+		if ne.EventID == "" || dedup.Seen(ne.EventID) {
+			return
+		}
+
+		if ne.StreamOrdering > last {
+			last = ne.StreamOrdering
+		}
+
+		en := &EventNotification{
+			NotifyEvent: ne,
+		}
+
+		if len(ne.EventID) > 11 {
+			event, err := c.GetEvent(&GetEventParams{
+				Slug: ne.EventID[len(ne.EventID)-11:],
+			})
+			if err == nil {
+				en.Event = event
+			}
+		}
+
+		c.Hub.Publish(TopicEvents, en)
+	}
+
+	catchUp := func() error {
+		for {
+			events, err := c.MatrixDB.Queries.GetEventsSinceStreamOrdering(context.Background(), pgtype.Int8{
+				Int64: last,
+				Valid: true,
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(events) > 0 {
+				log.Printf("catching up on %d events since %d", len(events), last)
+			}
+
+			for _, ev := range events {
+				publish(NotifyEvent{
+					EventID:        ev.EventID,
+					RoomID:         ev.RoomID,
+					Type:           ev.Type,
+					Sender:         ev.Sender.String,
+					StreamOrdering: ev.StreamOrdering.Int64,
+				})
+			}
+
+			// the query returns at most 500 events at a time
+			if len(events) < 500 {
+				return nil
+			}
+		}
+	}
+
+	c.Listen("events_notification", catchUp, func(n *pgconn.Notification) {
+		var ne NotifyEvent
+
+		err := json.Unmarshal([]byte(n.Payload), &ne)
+		if err != nil {
+			log.Println("error unmarshalling payload: ", err)
+			return
+		}
+
+		publish(ne)
+	})
+}
+
+func (c *App) StartPresenceListener() {
+	c.Listen("presence_notification", nil, func(n *pgconn.Notification) {
+		c.Hub.Publish(TopicPresence, json.RawMessage(n.Payload))
+	})
+}
+
+// StartEventSubscribers attaches everything that reacts to new events to
+// the hub. It must run before the listeners start publishing.
+func (c *App) StartEventSubscribers() {
+	go c.DispatchNotifications(c.Hub.Subscribe(TopicEvents))
+	go c.DispatchRoomEvents(c.Hub.Subscribe(TopicEvents))
+	go c.WatchPolicyLists(c.Hub.Subscribe(TopicEvents))
+
+	if c.Config.Cache.IndexEvents || c.Config.Cache.SpaceEvents {
+		go c.RefreshEventCaches(c.Hub.Subscribe(TopicEvents))
+	}
+
+	if c.Config.Search.Enabled {
+		go c.IndexEvents(c.Hub.Subscribe(TopicEvents))
+	}
+}
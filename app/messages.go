@@ -11,7 +11,6 @@ import (
 
 	"github.com/Jeffail/gabs/v2"
 	"github.com/go-chi/chi/v5"
-	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
@@ -165,7 +164,7 @@ func (c *App) GetSpaceMessages(p *SpaceMessagesParams) (*[]Event, error) {
 		}
 	}
 
-	return &items, nil
+	return c.FilterPolicyEvents(&items), nil
 }
 
 func (c *App) GetMessagesAtEventID(w http.ResponseWriter, r *http.Request, p *SpaceMessagesParams) {
@@ -232,111 +231,164 @@ func (c *App) GetMessagesAtEventID(w http.ResponseWriter, r *http.Request, p *Sp
 	})
 }
 
-var messageClients = make(map[string][]*Client)
+var messageClients = make(map[string][]*SyncClient)
 var messageClientsMutex sync.Mutex
 
-type Client struct {
-	Conn   *websocket.Conn
-	RoomID string
-}
-
 func (c *App) SyncMessages() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		roomID := chi.URLParam(r, "room")
 
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Println("Failed to upgrade connection to WebSocket:", err)
-			return
-		}
-		defer conn.Close()
+		c.ServeSync(w, r, &syncStream{
+			Framed: true,
+			Register: func(client *SyncClient) {
+				messageClientsMutex.Lock()
+				if len(messageClients[roomID]) == 0 {
+					c.Fanout.Connected(c.Fanout.roomsKey(), roomID)
+				}
+				messageClients[roomID] = append(messageClients[roomID], client)
+				messageClientsMutex.Unlock()
+			},
+			Unregister: func(client *SyncClient) {
+				c.removeMessageClient(roomID, client)
+			},
+			Replay: func(since int64) ([]*SyncMessage, error) {
+				return c.replayRoomEvents(roomID, since)
+			},
+			OnMessage: func(client *SyncClient, msg []byte) {
+				c.handleRoomSocketMessage(roomID, client, msg)
+			},
+		})
+	}
+}
+
+// handleRoomSocketMessage handles what websocket clients send on a room
+// stream: typing and receipts are relayed to the room, and sync asks for
+// everything after a token to be replayed.
+func (c *App) handleRoomSocketMessage(roomID string, client *SyncClient, msg []byte) {
 
-		client := &Client{Conn: conn, RoomID: roomID}
+	type roomSocketMessage struct {
+		Type    string          `json:"type"`
+		Since   string          `json:"since"`
+		Content json.RawMessage `json:"content"`
+	}
 
-		messageClientsMutex.Lock()
-		messageClients[roomID] = append(messageClients[roomID], client)
-		messageClientsMutex.Unlock()
+	var sm roomSocketMessage
+	err := json.Unmarshal(msg, &sm)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-		for {
+	switch sm.Type {
+	case "sync":
+		since, err := ParseStreamToken(sm.Since)
+		if err != nil {
+			log.Println("bad sync token: ", err)
+			return
+		}
+		client.RequestResync(since)
+	case EnvelopeTyping, EnvelopeReceipt:
+		if len(sm.Content) == 0 {
+			return
+		}
+		c.PublishRoomMessage(roomID, &SyncMessage{
+			Type: sm.Type,
+			Data: sm.Content,
+		})
+	}
+}
 
-			last := 0
+// roomEnvelopeType is the envelope a room event is framed in
+func roomEnvelopeType(eventType string) string {
+	switch eventType {
+	case "m.room.redaction":
+		return EnvelopeRedaction
+	case "m.room.name", "m.room.topic", "m.room.member":
+		return EnvelopeState
+	}
+	return EnvelopeEvent
+}
 
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("Failed to read message:", err)
-				break
-			}
+func (c *App) replayRoomEvents(roomID string, since int64) ([]*SyncMessage, error) {
 
-			type syncMessage struct {
-				Type  string `json:"type"`
-				Last  int    `json:"last"`
-				Value string `json:"value"`
-			}
+	items, err := c.MatrixDB.Queries.GetRoomEventsSinceStreamOrdering(context.Background(), matrix_db.GetRoomEventsSinceStreamOrderingParams{
+		RoomID: roomID,
+		StreamOrdering: pgtype.Int8{
+			Int64: since,
+			Valid: true,
+		},
+	})
+	if err != nil {
+		log.Println("error getting room events: ", err)
+		return nil, err
+	}
 
-			var sm syncMessage
-			err = json.Unmarshal(msg, &sm)
-			if err != nil {
-				log.Println(err)
-			}
+	msgs := []*SyncMessage{}
 
-			// let's check for messages since last sync
-			if sm.Type == "sync" && sm.Last != last {
-				events, err := c.GetSpaceMessages(&SpaceMessagesParams{
-					RoomID: roomID,
-					After:  strconv.Itoa(sm.Last),
-				})
+	for _, item := range items {
+		if len(item.EventID) < 11 {
+			continue
+		}
 
-				if err != nil {
-					log.Println("error getting event: ", err)
-				}
+		event, err := c.GetEvent(&GetEventParams{
+			Slug: item.EventID[len(item.EventID)-11:],
+		})
+		if err != nil {
+			continue
+		}
 
-				if events != nil {
-					serialized, err := json.Marshal(events)
-					if err != nil {
-						log.Println(err)
-					}
-					err = conn.WriteMessage(websocket.TextMessage, serialized)
-				}
-			}
+		serialized, err := json.Marshal(event)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 
-			last = sm.Last
+		msgs = append(msgs, &SyncMessage{
+			Type:  roomEnvelopeType(item.Type),
+			Token: StreamToken(item.StreamOrdering.Int64),
+			Data:  serialized,
+		})
+	}
 
-			if sm.Type == "typing" && sm.Value != "" {
-				c.sendMessageNotification(roomID, msg)
-			}
+	return msgs, nil
+}
 
+func (c *App) removeMessageClient(roomID string, client *SyncClient) {
+	messageClientsMutex.Lock()
+	defer messageClientsMutex.Unlock()
+
+	clients := messageClients[roomID]
+	for i, cl := range clients {
+		if cl == client {
+			// Remove the client from the slice
+			clients[i] = clients[len(clients)-1]
+			clients = clients[:len(clients)-1]
+			break
 		}
+	}
 
-		messageClientsMutex.Lock()
-		clients := messageClients[roomID]
-		for i, c := range clients {
-			if c == client {
-				// Remove the client from the slice
-				clients[i] = clients[len(clients)-1]
-				clients = clients[:len(clients)-1]
-				break
-			}
-		}
+	if len(clients) > 0 {
 		messageClients[roomID] = clients
-		messageClientsMutex.Unlock()
-
+	} else {
+		delete(messageClients, roomID)
+		c.Fanout.Disconnected(c.Fanout.roomsKey(), roomID)
 	}
 }
 
-func (c *App) sendMessageNotification(mid string, json []byte) {
+// sendMessageNotification queues msg for every client connected to room
+// mid on this instance. Use PublishRoomMessage to reach clients on every
+// instance.
+func (c *App) sendMessageNotification(mid string, msg *SyncMessage) {
 
 	messageClientsMutex.Lock()
-	clients := messageClients[mid]
-	for _, client := range clients {
-		err := client.Conn.WriteMessage(websocket.TextMessage, json)
-		if err != nil {
-			log.Println("Failed to send notification to client:", err)
-			client.Conn.Close()
+	defer messageClientsMutex.Unlock()
+
+	for _, client := range messageClients[mid] {
+		if !client.Send(msg) {
+			log.Println("room client is full, dropping message for", mid)
 		}
 	}
-	messageClientsMutex.Unlock()
-
 }
 
 type GetEventThreadParams struct {
@@ -427,3 +479,44 @@ func (c *App) EventThread() http.HandlerFunc {
 
 	}
 }
+
+// room socket clients only get events they can render
+var roomEventTypes = map[string]bool{
+	"m.room.message":   true,
+	"m.room.member":    true,
+	"m.room.name":      true,
+	"m.room.topic":     true,
+	"m.reaction":       true,
+	"space.board.post": true,
+	"m.room.redaction": true,
+}
+
+// DispatchRoomEvents forwards new events to the websockets open on their room.
+func (c *App) DispatchRoomEvents(sub *Subscription) {
+	for msg := range sub.C {
+		en, ok := msg.(*EventNotification)
+		if !ok || en.Event == nil {
+			continue
+		}
+
+		if t, ok := en.Event.Type.(string); !ok || !roomEventTypes[t] {
+			continue
+		}
+
+		if !c.Fanout.Claim("rooms", en.EventID) {
+			continue
+		}
+
+		serialized, err := json.Marshal(en.Event)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		c.PublishRoomMessage(en.Event.RoomID, &SyncMessage{
+			Type:  roomEnvelopeType(en.Type),
+			Token: StreamToken(en.StreamOrdering),
+			Data:  serialized,
+		})
+	}
+}
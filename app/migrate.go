@@ -0,0 +1,370 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MigrationsDir = "db/matrix/views"
+
+// arbitrary key so that only one instance migrates at a time
+const migrationLockKey = 7246931
+
+// Migration is a single versioned file in MigrationsDir. Files are named
+// <version>_<name>.sql and split into sections with `-- +goose Up` and
+// `-- +goose Down` markers, the same way as db/matrix/migrations.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type MigrationStatus struct {
+	Migration *Migration
+	AppliedAt *time.Time
+	Checksum  string
+}
+
+func (m *MigrationStatus) Applied() bool {
+	return m.AppliedAt != nil
+}
+
+func (m *MigrationStatus) Modified() bool {
+	return m.Applied() && m.Checksum != m.Migration.Checksum
+}
+
+func ParseMigration(name string, content string) (*Migration, error) {
+
+	base := strings.TrimSuffix(name, ".sql")
+
+	parts := strings.SplitN(base, "_", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", name)
+	}
+
+	version, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("migration %s has an invalid version: %v", name, err)
+	}
+
+	m := &Migration{
+		Version: version,
+		Name:    parts[1],
+	}
+
+	var up, down strings.Builder
+	var section *strings.Builder
+
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "-- +goose Up"):
+			section = &up
+			continue
+		case strings.HasPrefix(trimmed, "-- +goose Down"):
+			section = &down
+			continue
+		case strings.HasPrefix(trimmed, "-- +goose"):
+			// StatementBegin/End aren't needed, each section runs as a whole
+			continue
+		}
+		if section != nil {
+			section.WriteString(line)
+		}
+	}
+
+	m.Up = strings.TrimSpace(up.String())
+	m.Down = strings.TrimSpace(down.String())
+
+	if m.Up == "" {
+		return nil, fmt.Errorf("migration %s has no -- +goose Up section", name)
+	}
+
+	sum := sha256.Sum256([]byte(m.Up))
+	m.Checksum = hex.EncodeToString(sum[:])
+
+	return m, nil
+}
+
+func ReadMigrations(dir string) ([]*Migration, error) {
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []*Migration{}
+	seen := map[int64]string{}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := ParseMigration(file.Name(), string(content))
+		if err != nil {
+			return nil, err
+		}
+
+		if other, ok := seen[m.Version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, file.Name(), m.Version)
+		}
+		seen[m.Version] = file.Name()
+
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func (db *MatrixDB) EnsureMigrationsTable() error {
+	_, err := db.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS commune_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		checksum text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	return err
+}
+
+func (db *MatrixDB) MigrationStatus() ([]*MigrationStatus, error) {
+
+	migrations, err := ReadMigrations(MigrationsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.EnsureMigrationsTable()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(context.Background(), `SELECT version, checksum, applied_at FROM commune_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type applied struct {
+		Checksum  string
+		AppliedAt time.Time
+	}
+
+	done := map[int64]applied{}
+
+	for rows.Next() {
+		var version int64
+		var a applied
+		if err := rows.Scan(&version, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		done[version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := []*MigrationStatus{}
+
+	for _, m := range migrations {
+		s := &MigrationStatus{
+			Migration: m,
+		}
+		if a, ok := done[m.Version]; ok {
+			at := a.AppliedAt
+			s.AppliedAt = &at
+			s.Checksum = a.Checksum
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// withMigrationLock runs fn while holding an advisory lock, so that two
+// instances starting at the same time don't apply the same migration.
+func (db *MatrixDB) withMigrationLock(fn func() error) error {
+	ctx := context.Background()
+
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	return fn()
+}
+
+// MigrateUp applies every pending migration in order, each in its own
+// transaction. It refuses to run if an applied migration has been edited.
+func (db *MatrixDB) MigrateUp() (int, error) {
+
+	count := 0
+
+	err := db.withMigrationLock(func() error {
+
+		status, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status {
+			if s.Modified() {
+				return fmt.Errorf("migration %d_%s was modified after it was applied", s.Migration.Version, s.Migration.Name)
+			}
+		}
+
+		for _, s := range status {
+			if s.Applied() {
+				continue
+			}
+
+			log.Printf("applying migration %d_%s", s.Migration.Version, s.Migration.Name)
+
+			err := db.applyMigration(s.Migration, s.Migration.Up, true)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %v", s.Migration.Version, s.Migration.Name, err)
+			}
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// MigrateDown rolls back the last n applied migrations, newest first.
+func (db *MatrixDB) MigrateDown(n int) (int, error) {
+
+	count := 0
+
+	err := db.withMigrationLock(func() error {
+
+		status, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		for i := len(status) - 1; i >= 0 && count < n; i-- {
+			s := status[i]
+			if !s.Applied() {
+				continue
+			}
+
+			if s.Migration.Down == "" {
+				return fmt.Errorf("migration %d_%s has no -- +goose Down section", s.Migration.Version, s.Migration.Name)
+			}
+
+			log.Printf("rolling back migration %d_%s", s.Migration.Version, s.Migration.Name)
+
+			err := db.applyMigration(s.Migration, s.Migration.Down, false)
+			if err != nil {
+				return fmt.Errorf("rollback of %d_%s failed: %v", s.Migration.Version, s.Migration.Name, err)
+			}
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+func (db *MatrixDB) applyMigration(m *Migration, sql string, up bool) error {
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.Exec(ctx, `INSERT INTO commune_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+			m.Version, m.Name, m.Checksum)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM commune_migrations WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RunMigrateCommand handles `shpong migrate up|down [n]|status`
+func RunMigrateCommand(db *MatrixDB, args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: shpong migrate up|down [n]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := db.MigrateUp()
+		log.Printf("applied %d migrations", count)
+		return err
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			i, err := strconv.Atoi(args[1])
+			if err != nil || i < 1 {
+				return fmt.Errorf("invalid number of migrations: %s", args[1])
+			}
+			n = i
+		}
+		count, err := db.MigrateDown(n)
+		log.Printf("rolled back %d migrations", count)
+		return err
+	case "status":
+		status, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Modified() {
+				state = "modified"
+			} else if s.Applied() {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%-24s\t%s\n", s.Migration.Version, s.Migration.Name, state)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown migrate command: %s", args[0])
+}
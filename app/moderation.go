@@ -0,0 +1,337 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"shpong/gomatrix"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	ModerationKick   = "kick"
+	ModerationBan    = "ban"
+	ModerationUnban  = "unban"
+	ModerationMute   = "mute"
+	ModerationUnmute = "unmute"
+)
+
+// PowerLevels is the content of a room's m.room.power_levels event. It's
+// kept as a map so changing it doesn't lose fields Commune doesn't know.
+type PowerLevels map[string]any
+
+func (pl PowerLevels) level(key string, def int64) int64 {
+	if n, ok := pl[key].(float64); ok {
+		return int64(n)
+	}
+	return def
+}
+
+func (pl PowerLevels) users() map[string]any {
+	users, ok := pl["users"].(map[string]any)
+	if !ok {
+		users = map[string]any{}
+		pl["users"] = users
+	}
+	return users
+}
+
+func (pl PowerLevels) UserLevel(matrixUserID string) int64 {
+	if n, ok := pl.users()[matrixUserID].(float64); ok {
+		return int64(n)
+	}
+	return pl.level("users_default", 0)
+}
+
+func (pl PowerLevels) EventLevel(eventType string, state bool) int64 {
+	if events, ok := pl["events"].(map[string]any); ok {
+		if n, ok := events[eventType].(float64); ok {
+			return int64(n)
+		}
+	}
+	if state {
+		return pl.level("state_default", 50)
+	}
+	return pl.level("events_default", 0)
+}
+
+func (c *App) RoomPowerLevels(roomID string) (PowerLevels, error) {
+
+	content, err := c.MatrixDB.Queries.GetRoomPowerLevels(context.Background(), roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var pl PowerLevels
+	err = json.Unmarshal(content, &pl)
+	if err != nil {
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+// canModerate checks the power levels the homeserver would, so a moderator
+// gets a clear error instead of a failed request halfway through the rooms.
+func canModerate(pl PowerLevels, action, moderator, target string) error {
+
+	level := pl.UserLevel(moderator)
+
+	var required int64
+	switch action {
+	case ModerationKick:
+		required = pl.level("kick", 50)
+	case ModerationBan, ModerationUnban:
+		required = pl.level("ban", 50)
+	case ModerationMute, ModerationUnmute:
+		required = pl.EventLevel("m.room.power_levels", true)
+	default:
+		return errors.New("unknown action")
+	}
+
+	if level < required {
+		return fmt.Errorf("%s needs power level %d", action, required)
+	}
+
+	if action != ModerationUnban && level <= pl.UserLevel(target) {
+		return errors.New("you can't moderate someone with the same or higher power level")
+	}
+
+	return nil
+}
+
+type ModerationParams struct {
+	Action string
+	UserID string
+	Reason string
+	Rooms  []string
+}
+
+type ModerationResult struct {
+	Applied []string          `json:"applied"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// Moderate applies the action in every room, the first of which is the
+// space. If it can't be applied to the space nothing else is tried.
+func (c *App) Moderate(user *User, p *ModerationParams) (*ModerationResult, error) {
+
+	if p.UserID == user.MatrixUserID {
+		return nil, errors.New("you can't moderate yourself")
+	}
+
+	if len(p.Rooms) == 0 {
+		return nil, errors.New("no rooms to moderate")
+	}
+
+	matrix, err := c.matrixClient(user)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ModerationResult{
+		Applied: []string{},
+		Failed:  map[string]string{},
+	}
+
+	for i, room := range p.Rooms {
+		err := c.moderateRoom(matrix, user, room, p)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			log.Println("error moderating ", room, ": ", err)
+			result.Failed[room] = err.Error()
+			continue
+		}
+		result.Applied = append(result.Applied, room)
+	}
+
+	c.Audit(&AuditEntry{
+		Actor:        user.MatrixUserID,
+		Action:       p.Action,
+		TargetUserID: p.UserID,
+		Target:       p.Rooms[0],
+		SpaceRoomID:  p.Rooms[0],
+		Reason:       p.Reason,
+		Details: map[string]any{
+			"applied": result.Applied,
+			"failed":  result.Failed,
+		},
+	})
+
+	return result, nil
+}
+
+func (c *App) moderateRoom(matrix *gomatrix.Client, user *User, room string, p *ModerationParams) error {
+
+	pl, err := c.RoomPowerLevels(room)
+	if err != nil {
+		return err
+	}
+
+	err = canModerate(pl, p.Action, user.MatrixUserID, p.UserID)
+	if err != nil {
+		return err
+	}
+
+	switch p.Action {
+	case ModerationKick:
+		_, err = matrix.KickUser(room, &gomatrix.ReqKickUser{
+			Reason: p.Reason,
+			UserID: p.UserID,
+		})
+	case ModerationBan:
+		_, err = matrix.BanUser(room, &gomatrix.ReqBanUser{
+			Reason: p.Reason,
+			UserID: p.UserID,
+		})
+	case ModerationUnban:
+		_, err = matrix.UnbanUser(room, &gomatrix.ReqUnbanUser{
+			Reason: p.Reason,
+			UserID: p.UserID,
+		})
+	case ModerationMute:
+		// a level below events_default can't post or react
+		pl.users()[p.UserID] = pl.level("events_default", 0) - 1
+		_, err = matrix.SendStateEvent(room, "m.room.power_levels", "", pl)
+	case ModerationUnmute:
+		// only a mute's level is removed, never someone's elevated one
+		if pl.UserLevel(p.UserID) >= pl.level("events_default", 0) {
+			return nil
+		}
+		delete(pl.users(), p.UserID)
+		_, err = matrix.SendStateEvent(room, "m.room.power_levels", "", pl)
+	}
+
+	return err
+}
+
+// moderationRooms is the space room and, when children is set, its rooms.
+func (c *App) moderationRooms(space, spaceRoomID string, children bool) []string {
+
+	rooms := []string{spaceRoomID}
+
+	if !children {
+		return rooms
+	}
+
+	rows, err := c.MatrixDB.Queries.GetSpaceChildren(context.Background(), c.ConstructMatrixRoomID(strings.ToLower(space)))
+	if err != nil {
+		log.Println(err)
+		return rooms
+	}
+
+	for _, row := range rows {
+		rooms = append(rooms, row.ChildRoomID)
+	}
+
+	return rooms
+}
+
+// ModerateSpace handles kick, ban, unban, mute and unmute. The action is the
+// last part of the route.
+func (c *App) ModerateSpace(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			UserID   string `json:"user_id"`
+			Reason   string `json:"reason"`
+			Children bool   `json:"children"`
+		}{})
+		if err != nil || p.UserID == "" {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		reason := strings.TrimSpace(p.Reason)
+		if reason == "" && action != ModerationUnban && action != ModerationUnmute {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "a reason is required",
+				},
+			})
+			return
+		}
+
+		space := chi.URLParam(r, "space")
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := c.SpaceModerator(space, user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		result, err := c.Moderate(user, &ModerationParams{
+			Action: action,
+			UserID: p.UserID,
+			Reason: reason,
+			Rooms:  c.moderationRooms(space, roomID, p.Children),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   err.Error(),
+					"success": false,
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success": true,
+				"applied": result.Applied,
+				"failed":  result.Failed,
+			},
+		})
+	}
+}
+
+func (c *App) SpaceBans() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := c.SpaceModerator(chi.URLParam(r, "space"), user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		bans, err := c.MatrixDB.Queries.GetSpaceBans(context.Background(), pgtype.Text{
+			String: roomID,
+			Valid:  true,
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get bans",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"bans": bans,
+			},
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shpong/gomatrix"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+)
+
+// account data type the settings are stored under
+const NotificationSettingsType = "space.notifications.settings"
+
+// mute rule kinds
+const (
+	MuteSpace  = "space"
+	MuteRoom   = "room"
+	MuteThread = "thread"
+	MuteType   = "type"
+)
+
+// notification type groups that can be muted with a single type rule
+var notificationTypeGroups = map[string][]string{
+	"reactions": {"reaction", "reply.reaction"},
+	"replies":   {"post.reply", "reply.reply"},
+	"follows":   {"space.follow"},
+}
+
+// MuteRule mutes notifications matching Kind and Value. Spaces and rooms
+// match by ID or alias, threads by the event ID of the thread root, and
+// types by notification type or type group. Until is an optional expiry
+// in milliseconds.
+type MuteRule struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+	Until int64  `json:"until,omitempty"`
+}
+
+type NotificationSettings struct {
+	Rules []MuteRule `json:"rules"`
+}
+
+func (s *NotificationSettings) Validate() error {
+	for _, rule := range s.Rules {
+		switch rule.Kind {
+		case MuteSpace, MuteRoom, MuteThread, MuteType:
+		default:
+			return fmt.Errorf("unknown rule kind: %s", rule.Kind)
+		}
+		if rule.Value == "" {
+			return fmt.Errorf("%s rule has no value", rule.Kind)
+		}
+	}
+	return nil
+}
+
+// notificationScope is what mute rules are matched against. Notification
+// rows from any of the notification queries decode into it.
+type notificationScope struct {
+	Type             string `json:"type"`
+	RoomID           string `json:"room_id"`
+	SpaceID          string `json:"space_id"`
+	RoomAlias        string `json:"room_alias"`
+	ThreadEventID    string `json:"thread_event_id"`
+	RelatesToEventID string `json:"relates_to_event_id"`
+}
+
+func scopeOf(notification any) (*notificationScope, error) {
+	serialized, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+
+	var ns notificationScope
+	err = json.Unmarshal(serialized, &ns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ns, nil
+}
+
+func (r *MuteRule) Matches(ns *notificationScope) bool {
+
+	if r.Until > 0 && time.Now().UnixMilli() > r.Until {
+		return false
+	}
+
+	// room aliases are either space or space/room
+	spaceAlias := strings.SplitN(ns.RoomAlias, "/", 2)[0]
+
+	switch r.Kind {
+	case MuteSpace:
+		return r.Value == ns.SpaceID || (spaceAlias != "" && r.Value == spaceAlias)
+	case MuteRoom:
+		return r.Value == ns.RoomID || (ns.RoomAlias != "" && r.Value == ns.RoomAlias)
+	case MuteThread:
+		return r.Value == ns.ThreadEventID || r.Value == ns.RelatesToEventID
+	case MuteType:
+		if r.Value == ns.Type {
+			return true
+		}
+		for _, t := range notificationTypeGroups[r.Value] {
+			if t == ns.Type {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Mutes reports whether any rule mutes the notification.
+func (s *NotificationSettings) Mutes(notification any) bool {
+	if s == nil || len(s.Rules) == 0 {
+		return false
+	}
+
+	ns, err := scopeOf(notification)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	for _, rule := range s.Rules {
+		if rule.Matches(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNotificationSettings reads the settings straight from account_data,
+// so filtering doesn't need a round trip to the homeserver.
+func (c *App) GetNotificationSettings(mid string) (*NotificationSettings, error) {
+
+	settings := &NotificationSettings{
+		Rules: []MuteRule{},
+	}
+
+	content, err := c.MatrixDB.Queries.GetAccountData(context.Background(), matrix_db.GetAccountDataParams{
+		UserID:          mid,
+		AccountDataType: NotificationSettingsType,
+	})
+	if err != nil {
+		// no settings saved yet
+		return settings, nil
+	}
+
+	err = json.Unmarshal([]byte(content), settings)
+	if err != nil {
+		log.Println("error parsing notification settings: ", err)
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (c *App) NotificationSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		settings, err := c.GetNotificationSettings(user.MatrixUserID)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "Could not get notification settings",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"settings": settings,
+			},
+		})
+	}
+}
+
+func (c *App) UpdateNotificationSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &NotificationSettings{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		if p.Rules == nil {
+			p.Rules = []MuteRule{}
+		}
+
+		err = p.Validate()
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   err.Error(),
+					"success": false,
+				},
+			})
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		serverName := c.URLScheme(c.Config.Matrix.Homeserver) + fmt.Sprintf(`:%d`, c.Config.Matrix.Port)
+
+		matrix, err := gomatrix.NewClient(serverName, user.MatrixUserID, user.MatrixAccessToken)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error":   "Could not update notification settings",
+					"success": false,
+				},
+			})
+			return
+		}
+
+		err = matrix.SetAccountData(NotificationSettingsType, p)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error":   "Could not update notification settings",
+					"success": false,
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success":  true,
+				"settings": p,
+			},
+		})
+	}
+}
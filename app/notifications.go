@@ -2,12 +2,15 @@ package app
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	matrix_db "shpong/db/matrix/gen"
+	"shpong/gomatrix"
 	"strconv"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgtype"
@@ -38,7 +41,7 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-var connectedClients = make(map[string][]*websocket.Conn)
+var connectedClients = make(map[string][]*SyncClient)
 var clientsMutex sync.Mutex
 
 func (c *App) SyncNotifications() http.HandlerFunc {
@@ -47,8 +50,6 @@ func (c *App) SyncNotifications() http.HandlerFunc {
 		query := r.URL.Query()
 		token := query.Get("token")
 
-		log.Println("token is ", token)
-
 		user, err := c.GetTokenUser(token)
 		if err != nil || user == nil {
 			log.Println(err)
@@ -62,62 +63,104 @@ func (c *App) SyncNotifications() http.HandlerFunc {
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Println("Failed to upgrade connection to WebSocket:", err)
-			return
+		mid := user.MatrixUserID
+
+		c.ServeSync(w, r, &syncStream{
+			Register: func(client *SyncClient) {
+				clientsMutex.Lock()
+				if len(connectedClients[mid]) == 0 {
+					c.Fanout.Connected(c.Fanout.usersKey(), mid)
+				}
+				connectedClients[mid] = append(connectedClients[mid], client)
+				clientsMutex.Unlock()
+			},
+			Unregister: func(client *SyncClient) {
+				c.removeNotificationClient(mid, client)
+			},
+			Replay: func(since int64) ([]*SyncMessage, error) {
+				return c.replayNotifications(mid, since)
+			},
+		})
+	}
+}
+
+func (c *App) replayNotifications(mid string, since int64) ([]*SyncMessage, error) {
+
+	items, err := c.MatrixDB.Queries.GetNotificationsSince(context.Background(), matrix_db.GetNotificationsSinceParams{
+		Sender: pgtype.Text{
+			String: mid,
+			Valid:  true,
+		},
+		StreamOrdering: pgtype.Int8{
+			Int64: since,
+			Valid: true,
+		},
+	})
+	if err != nil {
+		log.Println("error getting notifications: ", err)
+		return nil, err
+	}
+
+	settings, err := c.GetNotificationSettings(mid)
+	if err != nil {
+		log.Println(err)
+	}
+
+	msgs := []*SyncMessage{}
+
+	for _, item := range items {
+		if settings.Mutes(item) {
+			continue
 		}
-		defer conn.Close()
 
-		clientsMutex.Lock()
-		if _, ok := connectedClients[user.MatrixUserID]; ok {
-			log.Println("already exists in list, adding new client")
-			connectedClients[user.MatrixUserID] = append(connectedClients[user.MatrixUserID], conn)
-		} else {
-			log.Println("adding new client")
-			connectedClients[user.MatrixUserID] = []*websocket.Conn{conn}
+		serialized, err := json.Marshal(item)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
-		clientsMutex.Unlock()
 
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("Failed to read message:", err)
-				break
-			}
+		msgs = append(msgs, &SyncMessage{
+			Token: StreamToken(item.StreamOrdering.Int64),
+			Data:  serialized,
+		})
+	}
 
-			err = conn.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				log.Println("Failed to write message:", err)
-				break
-			}
-		}
+	return msgs, nil
+}
+
+// removeNotificationClient drops a single client, leaving any other
+// clients the user has connected to this instance.
+func (c *App) removeNotificationClient(mid string, client *SyncClient) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
 
-		clientsMutex.Lock()
-		delete(connectedClients, user.MatrixUserID)
-		clientsMutex.Unlock()
+	clients := connectedClients[mid]
+	for i, cl := range clients {
+		if cl == client {
+			clients = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
 
+	if len(clients) > 0 {
+		connectedClients[mid] = clients
+		return
 	}
+
+	delete(connectedClients, mid)
+	c.Fanout.Disconnected(c.Fanout.usersKey(), mid)
 }
 
-func (c *App) sendNotification(mid string, json []byte) {
+// sendNotification queues msg for every client mid has connected to this
+// instance. Use PublishNotification to reach clients on every instance.
+func (c *App) sendNotification(mid string, msg *SyncMessage) {
 	clientsMutex.Lock()
-	conns, found := connectedClients[mid]
-	clientsMutex.Unlock()
+	defer clientsMutex.Unlock()
 
-	if found {
-		for _, conn := range conns {
-			err := conn.WriteMessage(websocket.TextMessage, json)
-			if err != nil {
-				log.Println("Failed to send notification to client:", err)
-				conn.Close()
-				clientsMutex.Lock()
-				delete(connectedClients, mid)
-				clientsMutex.Unlock()
-			}
+	for _, client := range connectedClients[mid] {
+		if !client.Send(msg) {
+			log.Println("notification client is full, dropping message for", mid)
 		}
-	} else {
-		log.Println("No client with the provided token:", mid)
 	}
 }
 
@@ -126,11 +169,6 @@ func (c *App) GetNotifications() http.HandlerFunc {
 
 		user := c.LoggedInUser(r)
 
-		last, err := c.Cache.Notifications.Get(user.MatrixUserID).Result()
-		if err != nil {
-			log.Println(err)
-		}
-
 		gn := matrix_db.GetNotificationsParams{
 			Sender: pgtype.Text{
 				String: user.MatrixUserID,
@@ -140,16 +178,6 @@ func (c *App) GetNotifications() http.HandlerFunc {
 				String: user.UserSpaceID,
 				Valid:  true,
 			},
-			OriginServerTS: pgtype.Int8{
-				Int64: time.Now().UnixMilli(),
-				Valid: true,
-			},
-		}
-
-		if last != "" {
-			i, _ := strconv.ParseInt(last, 10, 64)
-			log.Println(i)
-			gn.OriginServerTS.Int64 = i
 		}
 
 		items, err := c.MatrixDB.Queries.GetNotifications(context.Background(), gn)
@@ -165,6 +193,19 @@ func (c *App) GetNotifications() http.HandlerFunc {
 			return
 		}
 
+		settings, err := c.GetNotificationSettings(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+		}
+
+		filtered := items[:0]
+		for _, item := range items {
+			if !settings.Mutes(item) {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusOK,
 			JSON: map[string]any{
@@ -175,19 +216,54 @@ func (c *App) GetNotifications() http.HandlerFunc {
 	}
 }
 
+// MarkRead marks a notification, and everything before it in the same
+// room, as read by sending a private read receipt for it. Older clients
+// send last, a timestamp everything up to which is read.
 func (c *App) MarkRead() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		query := r.URL.Query()
-		last := query.Get("last")
-
-		log.Println(last)
 
 		user := c.LoggedInUser(r)
 
-		err := c.Cache.Notifications.Set(user.MatrixUserID, last, 0).Err()
+		eventID := query.Get("event_id")
+		if eventID == "" {
+			last, err := strconv.ParseInt(query.Get("last"), 10, 64)
+			if err != nil {
+				RespondWithBadRequestError(w)
+				return
+			}
+
+			c.respondMarkedRead(w, c.markReadUntil(user, pgtype.Int8{
+				Int64: last,
+				Valid: true,
+			}))
+			return
+		}
+
+		roomID, err := c.MatrixDB.Queries.GetEventRoomID(context.Background(), eventID)
 		if err != nil {
 			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   "Notification not found",
+					"success": false,
+				},
+			})
+			return
+		}
+
+		err = c.sendReadReceipts(user, map[string]string{roomID: eventID})
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error":   "Could not mark notification as read",
+					"success": false,
+				},
+			})
+			return
 		}
 
 		RespondWithJSON(w, &JSONResponse{
@@ -199,3 +275,240 @@ func (c *App) MarkRead() http.HandlerFunc {
 
 	}
 }
+
+// MarkAllRead sends a read receipt for the latest unread notification in
+// every room that has one.
+func (c *App) MarkAllRead() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		c.respondMarkedRead(w, c.markReadUntil(user, pgtype.Int8{}))
+	}
+}
+
+// markReadUntil sends a read receipt for the latest unread notification,
+// up to until when it's set, in every room that has one.
+func (c *App) markReadUntil(user *User, until pgtype.Int8) error {
+
+	latest, err := c.MatrixDB.Queries.GetLatestUnreadNotificationEvents(context.Background(), matrix_db.GetLatestUnreadNotificationEventsParams{
+		Sender: user.MatrixUserID,
+		RoomID: user.UserSpaceID,
+		Until:  until,
+	})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	receipts := map[string]string{}
+	for _, item := range latest {
+		receipts[item.RoomID] = item.EventID
+	}
+
+	return c.sendReadReceipts(user, receipts)
+}
+
+func (c *App) respondMarkedRead(w http.ResponseWriter, err error) {
+	if err != nil {
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: map[string]any{
+				"error":   "Could not mark notifications as read",
+				"success": false,
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"success": true,
+		},
+	})
+}
+
+// sendReadReceipts sends a receipt for each room ID, event ID pair. Read
+// state is derived from these, so it's shared with Matrix clients.
+func (c *App) sendReadReceipts(user *User, receipts map[string]string) error {
+
+	serverName := c.URLScheme(c.Config.Matrix.Homeserver) + fmt.Sprintf(`:%d`, c.Config.Matrix.Port)
+
+	matrix, err := gomatrix.NewClient(serverName, user.MatrixUserID, user.MatrixAccessToken)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	for roomID, eventID := range receipts {
+		err := matrix.MarkReadPrivate(roomID, eventID)
+		if err != nil {
+			log.Println("error sending read receipt: ", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UnreadNotifications returns unread notification counts per room and per
+// space. Space and room mute rules apply, thread and type rules don't.
+func (c *App) UnreadNotifications() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		counts, err := c.MatrixDB.Queries.GetUnreadNotificationCounts(context.Background(), matrix_db.GetUnreadNotificationCountsParams{
+			Sender: pgtype.Text{
+				String: user.MatrixUserID,
+				Valid:  true,
+			},
+			RoomID: pgtype.Text{
+				String: user.UserSpaceID,
+				Valid:  true,
+			},
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "Could not get unread notifications",
+				},
+			})
+			return
+		}
+
+		settings, err := c.GetNotificationSettings(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+		}
+
+		var total int64
+		rooms := map[string]int64{}
+		spaces := map[string]int64{}
+
+		for _, item := range counts {
+			if settings.Mutes(&notificationScope{
+				RoomID:  item.RoomID,
+				SpaceID: item.SpaceID,
+			}) {
+				continue
+			}
+
+			total += item.Count
+			rooms[item.RoomID] += item.Count
+			spaces[item.SpaceID] += item.Count
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"total":  total,
+				"rooms":  rooms,
+				"spaces": spaces,
+			},
+		})
+
+	}
+}
+
+// DispatchNotifications sends follow and reply notifications to the
+// websockets of the users they are for.
+func (c *App) DispatchNotifications(sub *Subscription) {
+	for msg := range sub.C {
+		en, ok := msg.(*EventNotification)
+		if !ok {
+			continue
+		}
+
+		if !c.Fanout.Claim("notifications", en.EventID) {
+			continue
+		}
+
+		if en.Type == "m.room.member" {
+			c.notifySpaceFollow(en.EventID)
+		}
+
+		if en.Event == nil {
+			continue
+		}
+
+		n, err := c.MatrixDB.Queries.GetNotification(context.Background(), en.EventID)
+		if err != nil {
+			continue
+		}
+
+		if n.ForMatrixUserID.String == en.Event.Sender.ID {
+			continue
+		}
+
+		settings, err := c.GetNotificationSettings(n.ForMatrixUserID.String)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if settings.Mutes(n) {
+			continue
+		}
+
+		serialized, err := json.Marshal(n)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		c.PublishNotification(n.ForMatrixUserID.String, &SyncMessage{
+			Token: StreamToken(en.StreamOrdering),
+			Data:  serialized,
+		})
+	}
+}
+
+func (c *App) notifySpaceFollow(eventID string) {
+
+	ms, err := c.MatrixDB.Queries.GetMembershipState(context.Background(), pgtype.Text{String: eventID, Valid: true})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if ms.Membership.String != "join" ||
+		!strings.HasPrefix(ms.SpaceAlias.String, "@") ||
+		ms.UserID.String == ms.Creator.String {
+		return
+	}
+
+	settings, err := c.GetNotificationSettings(ms.Creator.String)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if settings.Mutes(&notificationScope{
+		Type:    "space.follow",
+		RoomID:  ms.RoomID.String,
+		SpaceID: ms.RoomID.String,
+	}) {
+		return
+	}
+
+	n := Notification{
+		FromMatrixUserID: ms.UserID.String,
+		DisplayName:      ms.DisplayName.String,
+		AvatarURL:        ms.AvatarUrl.String,
+		CreatedAt:        ms.OriginServerTS.Int64,
+		Type:             "space.follow",
+	}
+
+	serialized, err := json.Marshal(n)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// follows aren't replayed, so they don't carry a token
+	c.PublishNotification(ms.Creator.String, &SyncMessage{
+		Data: serialized,
+	})
+}
@@ -2,7 +2,6 @@ package app
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,15 +13,6 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
-type DiscordUser struct {
-	ID            string `json:"id"`
-	Username      string `json:"username"`
-	GlobalName    string `json:"global_name"`
-	Discriminator string `json:"discriminator"`
-	Avatar        string `json:"avatar"`
-	Banner        string `json:"banner"`
-}
-
 type AccessTokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	TokenType    string `json:"token_type"`
@@ -31,159 +21,12 @@ type AccessTokenResponse struct {
 	Scope        string `json:"scope"`
 }
 
-func (c *App) ValidateOauthDiscord() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query()
-		code := query.Get("code")
-
-		log.Println("recieved code ", code)
-
-		if code == "" {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": "missing provider or code",
-				},
-			})
-			return
-		}
-
-		// Retrieve the required parameters from the request body.
-		clientID := ""
-		clientSecret := ""
-
-		for _, item := range c.Config.Oauth {
-			if item.Provider == "discord" && item.Enabled {
-				clientID = item.ClientID
-				clientSecret = item.ClientSecret
-			}
-		}
-
-		if clientID == "" || clientSecret == "" {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": "this provider is not enabled",
-				},
-			})
-			return
-		}
-
-		discordAPIEndpoint := "https://discord.com/api/v10/oauth2/token"
-
-		redirectURI := fmt.Sprintf("%s/oauth/discord", c.Config.App.PublicDomain)
-
-		data := fmt.Sprintf("client_id=%s&client_secret=%s&grant_type=authorization_code&code=%s&redirect_uri=%s", clientID, clientSecret, code, redirectURI)
-
-		log.Println("url is ", data)
-
-		resp, err := http.Post(discordAPIEndpoint, "application/x-www-form-urlencoded", strings.NewReader(data))
-		if err != nil {
-			log.Println(err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Println(err, resp.StatusCode)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		log.Println("body is", resp.Body)
-
-		var token AccessTokenResponse
-		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		if token.AccessToken == "" {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": "missing access token",
-				},
-			})
-			return
-		}
-
-		identityEndpoint := "https://discord.com/api/v10/users/@me"
-		req, err := http.NewRequest("GET", identityEndpoint, nil)
-		if err != nil {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
-
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		var user DiscordUser
-		if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		c.OauthUserSession(w, r, &OauthUser{
-			ID:       user.ID,
-			Username: user.GlobalName,
-			Provider: "oidc-discord",
-		})
-
-	}
-}
-
 type OauthUser struct {
 	ID       string
 	Username string
 	Provider string
+	// only checked when the account doesn't exist yet
+	InviteCode string
 }
 
 func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthUser) {
@@ -218,11 +61,36 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 			mid = fmt.Sprintf(`@%s:%s`, username, c.Config.Matrix.PublicServer)
 		}
 
+		invite := strings.TrimSpace(u.InviteCode)
+
+		if c.Config.Features.RequireInviteCode {
+			err := c.ConsumeInviteCode(invite)
+			if err != nil {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"created":        false,
+						"invalid_invite": true,
+						"error":          "That invite code is invalid or has expired.",
+					},
+				})
+				return
+			}
+		}
+
+		// the code goes back if the account isn't made
+		releaseInvite := func() {
+			if c.Config.Features.RequireInviteCode {
+				c.ReleaseInviteCode(invite)
+			}
+		}
+
 		log.Println("we'll create user")
 
 		muser, err := c.MatrixDB.Queries.UNSAFECreateUser(context.Background(), pgtype.Text{String: mid, Valid: true})
 		if err != nil {
 			log.Println(err)
+			releaseInvite()
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -240,6 +108,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 		})
 		if err != nil {
 			log.Println(err)
+			releaseInvite()
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -259,6 +128,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 		})
 		if err != nil {
 			log.Println(err)
+			releaseInvite()
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -277,6 +147,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 		})
 		if err != nil {
 			log.Println(err)
+			releaseInvite()
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -294,6 +165,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 		})
 		if err != nil {
 			log.Println(err)
+			releaseInvite()
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -313,6 +185,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 		})
 		if err != nil {
 			log.Println(err)
+			releaseInvite()
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
@@ -323,6 +196,10 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 		}
 		log.Println("was token created?", access_token)
 
+		if c.Config.Features.RequireInviteCode {
+			c.RecordInviteCodeUse(invite, muser.String)
+		}
+
 		space_id, err := c.CreateUserSpace(muser.String, access_token, u.Username)
 		if err != nil {
 			log.Println(err)
@@ -361,7 +238,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 			suser.UserSpaceID = *space_id
 		}
 
-		err = c.StoreUserSession(suser)
+		err = c.CreateUserSession(r, suser)
 
 		// send success JSON
 		RespondWithJSON(w, &JSONResponse{
@@ -378,10 +255,9 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 
 		log.Println("user exists, we'll just log them in")
 
-		log.Println(userID)
-		log.Println(userID)
-		log.Println(userID)
-		log.Println(userID)
+		// the username at the provider may have changed, or been taken here
+		// when the account was created
+		u.Username = strings.SplitN(strings.TrimPrefix(userID, "@"), ":", 2)[0]
 
 		did := RandomString(12)
 
@@ -469,7 +345,7 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 			log.Println(err)
 		}
 
-		admin, err := c.MatrixDB.Queries.IsAdmin(context.Background(), pgtype.Text{String: u.ID, Valid: true})
+		admin, err := c.MatrixDB.Queries.IsAdmin(context.Background(), pgtype.Text{String: userID, Valid: true})
 		if err != nil {
 			log.Println(err)
 		}
@@ -490,216 +366,56 @@ func (c *App) OauthUserSession(w http.ResponseWriter, r *http.Request, u *OauthU
 			Admin:             admin,
 		}
 
-		err = c.StoreUserSession(user)
-
-		spaces, err := c.MatrixDB.Queries.GetUserSpaces(context.Background(), pgtype.Text{String: userID, Valid: true})
-		if err != nil {
-			log.Println(err)
-		}
-		rooms, err := c.MatrixDB.Queries.GetJoinedRooms(context.Background(), pgtype.Text{String: userID, Valid: true})
-		if err != nil {
-			log.Println(err)
-		}
-		dms, err := c.MatrixDB.Queries.GetDMs(context.Background(), user.MatrixUserID)
-		if err != nil {
-			log.Println(err)
-		}
-
-		RespondWithJSON(w, &JSONResponse{
-			Code: http.StatusOK,
-			JSON: map[string]any{
-				"authenticated": true,
-				"access_token":  token,
-				"credentials":   user,
-				"spaces":        spaces,
-				"rooms":         rooms,
-				"dms":           dms,
-			},
-		})
-
-	}
-}
-
-type GithubAccessTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	Scope       string `json:"scope"`
-}
-
-type GithubUser struct {
-	ID    int64  `json:"id"`
-	Login string `json:"login"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Bio   string `json:"bio"`
-}
-
-func (c *App) ValidateOauthGithub() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query()
-		code := query.Get("code")
-
-		log.Println("recieved code ", code)
-
-		if code == "" {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": "missing provider or code",
-				},
-			})
-			return
-		}
-
-		// Retrieve the required parameters from the request body.
-		clientID := ""
-		clientSecret := ""
-
-		for _, item := range c.Config.Oauth {
-			if item.Provider == "github" && item.Enabled {
-				clientID = item.ClientID
-				clientSecret = item.ClientSecret
+		if factors := c.SecondFactors(user.MatrixUserID); len(factors) > 0 {
+			challenge, err := c.NewTwoFactorChallenge(user)
+			if err != nil {
+				log.Println(err)
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"authenticated": false,
+						"error":         "internal server error",
+					},
+				})
+				return
 			}
-		}
 
-		if clientID == "" || clientSecret == "" {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": "this provider is not enabled",
-				},
-			})
-			return
-		}
-
-		githubAPIEndpoint := "https://github.com/login/oauth/access_token"
-
-		redirectURI := fmt.Sprintf("%s/oauth/github", c.Config.App.PublicDomain)
-
-		data := fmt.Sprintf("client_id=%s&client_secret=%s&code=%s&redirect_uri=%s", clientID, clientSecret, code, redirectURI)
-
-		log.Println("url is ", data)
-
-		req, err := http.NewRequest("POST", githubAPIEndpoint, strings.NewReader(data))
-		if err != nil {
-			log.Println(err)
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
 				JSON: map[string]any{
-					"error": err,
+					"authenticated": false,
+					"2fa":           true,
+					"challenge":     challenge,
+					"methods":       factors,
 				},
 			})
 			return
 		}
 
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		req.Header.Set("Accept", "application/json")
+		err = c.CreateUserSession(r, user)
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		spaces, err := c.MatrixDB.Queries.GetUserSpaces(context.Background(), pgtype.Text{String: userID, Valid: true})
 		if err != nil {
 			log.Println(err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Println(err, resp.StatusCode)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		var token GithubAccessTokenResponse
-		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
-			log.Println(err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
 		}
-
-		log.Println("token is", token)
-
-		if token.AccessToken == "" {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": "missing access token",
-				},
-			})
-			return
-		}
-
-		identityEndpoint := "https://api.github.com/user"
-		req, err = http.NewRequest("GET", identityEndpoint, nil)
+		rooms, err := c.MatrixDB.Queries.GetJoinedRooms(context.Background(), pgtype.Text{String: userID, Valid: true})
 		if err != nil {
 			log.Println(err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
 		}
-
-		req.Header.Set("Accept", "application/vnd.github+json")
-		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
-
-		resp, err = http.DefaultClient.Do(req)
+		dms, err := c.MatrixDB.Queries.GetDMs(context.Background(), user.MatrixUserID)
 		if err != nil {
 			log.Println(err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
-		}
-
-		var user GithubUser
-		if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-			log.Println(err)
-			RespondWithJSON(w, &JSONResponse{
-				Code: http.StatusOK,
-				JSON: map[string]any{
-					"error": err,
-				},
-			})
-			return
 		}
 
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusOK,
 			JSON: map[string]any{
-				"user": user,
+				"authenticated": true,
+				"access_token":  token,
+				"credentials":   user,
+				"spaces":        spaces,
+				"rooms":         rooms,
+				"dms":           dms,
 			},
 		})
 
@@ -0,0 +1,550 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"shpong/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// how long a user has to finish logging in at the provider
+const oauthStateTTL = time.Minute * 10
+
+// cookie that ties a login's state to the browser that started it
+const oauthStateCookie = "oauth_state"
+
+var oauthHTTPClient = &http.Client{Timeout: time.Second * 15}
+
+type oidcEndpoints struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// discovered endpoints by issuer, they don't change while we're running
+var oidcDiscovery = struct {
+	sync.Mutex
+	endpoints map[string]*oidcEndpoints
+}{endpoints: map[string]*oidcEndpoints{}}
+
+// oauthState is kept between sending the user to the provider and them
+// coming back with a code.
+type oauthState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"code_verifier"`
+	InviteCode   string `json:"invite_code"`
+}
+
+// endpoints and claims of providers that don't do OIDC discovery, so their
+// config only needs a client id and secret
+var builtinProviders = map[string]config.Provider{
+	"discord": {
+		AuthURL:       "https://discord.com/oauth2/authorize",
+		TokenURL:      "https://discord.com/api/v10/oauth2/token",
+		UserInfoURL:   "https://discord.com/api/v10/users/@me",
+		Scopes:        []string{"identify"},
+		IDClaim:       "id",
+		UsernameClaim: "global_name",
+	},
+	"github": {
+		AuthURL:       "https://github.com/login/oauth/authorize",
+		TokenURL:      "https://github.com/login/oauth/access_token",
+		UserInfoURL:   "https://api.github.com/user",
+		Scopes:        []string{"read:user"},
+		IDClaim:       "id",
+		UsernameClaim: "login",
+	},
+}
+
+func (c *App) oauthProvider(name string) (*config.Provider, error) {
+	for _, item := range c.Config.Oauth {
+		if item.Provider == name && item.Enabled {
+			p := item
+			if builtin, ok := builtinProviders[name]; ok && p.Issuer == "" {
+				if p.AuthURL == "" {
+					p.AuthURL = builtin.AuthURL
+				}
+				if p.TokenURL == "" {
+					p.TokenURL = builtin.TokenURL
+				}
+				if p.UserInfoURL == "" {
+					p.UserInfoURL = builtin.UserInfoURL
+				}
+				if len(p.Scopes) == 0 {
+					p.Scopes = builtin.Scopes
+				}
+				if p.IDClaim == "" {
+					p.IDClaim = builtin.IDClaim
+				}
+				if p.UsernameClaim == "" {
+					p.UsernameClaim = builtin.UsernameClaim
+				}
+			}
+			return &p, nil
+		}
+	}
+	return nil, errors.New("this provider is not enabled")
+}
+
+func (c *App) oauthRedirectURI(provider string) string {
+	return fmt.Sprintf("%s/oauth/%s", c.Config.App.PublicDomain, provider)
+}
+
+// providerEndpoints fills in whatever endpoints the provider config leaves
+// out from the issuer's discovery document.
+func providerEndpoints(p *config.Provider) (*oidcEndpoints, error) {
+
+	endpoints := &oidcEndpoints{
+		AuthorizationEndpoint: p.AuthURL,
+		TokenEndpoint:         p.TokenURL,
+		UserinfoEndpoint:      p.UserInfoURL,
+	}
+
+	if p.Issuer != "" && (endpoints.AuthorizationEndpoint == "" ||
+		endpoints.TokenEndpoint == "" || endpoints.UserinfoEndpoint == "") {
+
+		discovered, err := discoverOIDC(p.Issuer)
+		if err != nil {
+			return nil, err
+		}
+
+		if endpoints.AuthorizationEndpoint == "" {
+			endpoints.AuthorizationEndpoint = discovered.AuthorizationEndpoint
+		}
+		if endpoints.TokenEndpoint == "" {
+			endpoints.TokenEndpoint = discovered.TokenEndpoint
+		}
+		if endpoints.UserinfoEndpoint == "" {
+			endpoints.UserinfoEndpoint = discovered.UserinfoEndpoint
+		}
+	}
+
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" ||
+		endpoints.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("provider %s is missing endpoints", p.Provider)
+	}
+
+	return endpoints, nil
+}
+
+func discoverOIDC(issuer string) (*oidcEndpoints, error) {
+
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+
+	if endpoints, ok := oidcDiscovery.endpoints[issuer]; ok {
+		return endpoints, nil
+	}
+
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+
+	resp, err := oauthHTTPClient.Get(wellKnown)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery for %s returned %d", issuer, resp.StatusCode)
+	}
+
+	var endpoints oidcEndpoints
+	err = json.NewDecoder(resp.Body).Decode(&endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcDiscovery.endpoints[issuer] = &endpoints
+
+	return &endpoints, nil
+}
+
+// pkceChallenge is the S256 challenge for verifier, RFC 7636.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// StartOauth returns the provider URL to send the user to. The state and
+// PKCE verifier stay here until ValidateOauth gets them back.
+func (c *App) StartOauth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		name := chi.URLParam(r, "provider")
+
+		provider, err := c.oauthProvider(name)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": err.Error(),
+				},
+			})
+			return
+		}
+
+		endpoints, err := providerEndpoints(provider)
+		if err != nil {
+			log.Println("error getting provider endpoints: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not reach provider",
+				},
+			})
+			return
+		}
+
+		state, verifier, err := c.newOauthState(provider.Provider, r.URL.Query().Get("invite_code"))
+		if err != nil {
+			log.Println("error starting oauth login: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start login",
+				},
+			})
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthStateCookie,
+			Value:    state,
+			Path:     "/",
+			MaxAge:   int(oauthStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(c.Config.App.PublicDomain, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		scopes := provider.Scopes
+		if len(scopes) == 0 && provider.Issuer != "" {
+			scopes = []string{"openid", "profile", "email"}
+		}
+
+		v := url.Values{}
+		v.Set("response_type", "code")
+		v.Set("client_id", provider.ClientID)
+		v.Set("redirect_uri", c.oauthRedirectURI(provider.Provider))
+		v.Set("state", state)
+		v.Set("code_challenge", pkceChallenge(verifier))
+		v.Set("code_challenge_method", "S256")
+		if len(scopes) > 0 {
+			v.Set("scope", strings.Join(scopes, " "))
+		}
+
+		sep := "?"
+		if strings.Contains(endpoints.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"url": endpoints.AuthorizationEndpoint + sep + v.Encode(),
+			},
+		})
+	}
+}
+
+// newOauthState stores a fresh state and PKCE verifier for a login.
+func (c *App) newOauthState(provider string, invite string) (string, string, error) {
+
+	state, err := randomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier, err := randomToken(48)
+	if err != nil {
+		return "", "", err
+	}
+
+	serialized, err := json.Marshal(oauthState{
+		Provider:     provider,
+		CodeVerifier: verifier,
+		InviteCode:   invite,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	err = c.SessionsStore.Set("oauth:"+state, serialized, oauthStateTTL).Err()
+	if err != nil {
+		return "", "", err
+	}
+
+	return state, verifier, nil
+}
+
+// exchangeOauthCode trades the authorization code for an access token.
+func (c *App) exchangeOauthCode(provider *config.Provider, endpoints *oidcEndpoints, code string, verifier string) (string, error) {
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", c.oauthRedirectURI(provider.Provider))
+	v.Set("client_id", provider.ClientID)
+	v.Set("client_secret", provider.ClientSecret)
+	v.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", endpoints.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var token AccessTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New("missing access token")
+	}
+
+	return token.AccessToken, nil
+}
+
+func fetchOauthClaims(endpoints *oidcEndpoints, accessToken string) (map[string]any, error) {
+
+	req, err := http.NewRequest("GET", endpoints.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint returned %d", resp.StatusCode)
+	}
+
+	claims := map[string]any{}
+
+	decoder := json.NewDecoder(resp.Body)
+	// ids can be numbers bigger than a float64 holds exactly
+	decoder.UseNumber()
+
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func claimString(claims map[string]any, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+var invalidUsernameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// oauthUsername picks a username from the configured claim, falling back
+// to the claims providers commonly send.
+func oauthUsername(provider *config.Provider, claims map[string]any) string {
+
+	names := []string{"preferred_username", "nickname", "login", "username", "name"}
+	if provider.UsernameClaim != "" {
+		names = append([]string{provider.UsernameClaim}, names...)
+	}
+
+	username := ""
+	for _, name := range names {
+		if username = claimString(claims, name); username != "" {
+			break
+		}
+	}
+
+	if username == "" {
+		username = strings.SplitN(claimString(claims, "email"), "@", 2)[0]
+	}
+
+	username = strings.ToLower(username)
+	username = invalidUsernameChars.ReplaceAllString(username, "-")
+	username = strings.Trim(username, "-")
+
+	if username == "" {
+		username = "user-" + RandomString(6)
+	}
+
+	return username
+}
+
+// ValidateOauth finishes a login started by StartOauth and hands the user
+// to OauthUserSession.
+func (c *App) ValidateOauth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		name := chi.URLParam(r, "provider")
+
+		query := r.URL.Query()
+		code := query.Get("code")
+		state := query.Get("state")
+
+		if code == "" || state == "" {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "missing code or state",
+				},
+			})
+			return
+		}
+
+		// the state has to come back to the browser that asked for it,
+		// otherwise someone could log a victim in as themselves
+		cookie, err := r.Cookie(oauthStateCookie)
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthStateCookie,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+		})
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "login expired or is invalid, try again",
+				},
+			})
+			return
+		}
+
+		// state can only be used once
+		key := "oauth:" + state
+		serialized, err := c.SessionsStore.Get(key).Result()
+		c.SessionsStore.Del(key)
+
+		var saved oauthState
+		if err == nil {
+			err = json.Unmarshal([]byte(serialized), &saved)
+		}
+
+		if err != nil || saved.Provider != name {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "login expired or is invalid, try again",
+				},
+			})
+			return
+		}
+
+		provider, err := c.oauthProvider(name)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": err.Error(),
+				},
+			})
+			return
+		}
+
+		endpoints, err := providerEndpoints(provider)
+		if err != nil {
+			log.Println("error getting provider endpoints: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not reach provider",
+				},
+			})
+			return
+		}
+
+		accessToken, err := c.exchangeOauthCode(provider, endpoints, code, saved.CodeVerifier)
+		if err != nil {
+			log.Println("error exchanging oauth code: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not log in with provider",
+				},
+			})
+			return
+		}
+
+		claims, err := fetchOauthClaims(endpoints, accessToken)
+		if err != nil {
+			log.Println("error getting oauth user: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get user from provider",
+				},
+			})
+			return
+		}
+
+		idClaim := provider.IDClaim
+		if idClaim == "" {
+			idClaim = "sub"
+		}
+
+		id := claimString(claims, idClaim)
+		if id == "" {
+			log.Printf("provider %s sent no %s claim", provider.Provider, idClaim)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get user from provider",
+				},
+			})
+			return
+		}
+
+		c.OauthUserSession(w, r, &OauthUser{
+			ID:         id,
+			Username:   oauthUsername(provider, claims),
+			Provider:   "oidc-" + provider.Provider,
+			InviteCode: saved.InviteCode,
+		})
+	}
+}
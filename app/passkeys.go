@@ -0,0 +1,816 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const passkeyCeremonyTTL = time.Minute * 5
+
+// passkeyUser is a Matrix user as the webauthn library sees them. The user
+// handle is a hash of the Matrix ID, which can be longer than the 64 bytes
+// authenticators allow.
+type passkeyUser struct {
+	MatrixUserID string
+	Username     string
+	DisplayName  string
+	Credentials  []webauthn.Credential
+}
+
+func passkeyUserHandle(matrixUserID string) []byte {
+	sum := sha256.Sum256([]byte(matrixUserID))
+	return sum[:]
+}
+
+func passkeyID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return passkeyUserHandle(u.MatrixUserID)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+func (u *passkeyUser) descriptors() []protocol.CredentialDescriptor {
+	descriptors := []protocol.CredentialDescriptor{}
+	for _, credential := range u.Credentials {
+		descriptors = append(descriptors, credential.Descriptor())
+	}
+	return descriptors
+}
+
+// NewWebAuthn sets up the relying party. Passkeys are made for the public
+// domain the client is served from.
+func (c *App) NewWebAuthn() (*webauthn.WebAuthn, error) {
+
+	origin := strings.TrimSuffix(c.Config.App.PublicDomain, "/")
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	rpid := c.Config.Authentication.PasskeyRPID
+	if rpid == "" {
+		rpid = u.Hostname()
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpid,
+		RPDisplayName: c.Config.Name,
+		RPOrigins:     []string{origin},
+	})
+}
+
+func (c *App) getPasskeyUser(matrixUserID string) (*passkeyUser, error) {
+
+	rows, err := c.MatrixDB.Queries.GetPasskeys(context.Background(), matrixUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &passkeyUser{
+		MatrixUserID: matrixUserID,
+		Username:     strings.SplitN(strings.TrimPrefix(matrixUserID, "@"), ":", 2)[0],
+		Credentials:  []webauthn.Credential{},
+	}
+
+	for _, row := range rows {
+		var credential webauthn.Credential
+		err := json.Unmarshal([]byte(row.Credential), &credential)
+		if err != nil {
+			log.Println("error parsing passkey: ", err)
+			continue
+		}
+		user.Credentials = append(user.Credentials, credential)
+	}
+
+	return user, nil
+}
+
+func (c *App) HasPasskeys(matrixUserID string) bool {
+	has, err := c.MatrixDB.Queries.HasPasskeys(context.Background(), matrixUserID)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return has
+}
+
+// SecondFactors lists what a user can finish a password login with. Having
+// a passkey is enough to turn on the second step.
+func (c *App) SecondFactors(matrixUserID string) []string {
+	factors := []string{}
+	if c.TwoFactorEnabled(matrixUserID) {
+		factors = append(factors, "totp")
+	}
+	if c.Config.Authentication.Passkeys && c.HasPasskeys(matrixUserID) {
+		factors = append(factors, "passkey")
+	}
+	return factors
+}
+
+// ceremonies are single use, taking one deletes it
+func (c *App) storePasskeyCeremony(key string, session *webauthn.SessionData) error {
+	serialized, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return c.SessionsStore.Set("passkey:"+key, serialized, passkeyCeremonyTTL).Err()
+}
+
+func (c *App) takePasskeyCeremony(key string) (*webauthn.SessionData, error) {
+	if key == "" {
+		return nil, errors.New("no passkey session")
+	}
+
+	serialized, err := c.SessionsStore.Get("passkey:" + key).Result()
+	if err != nil {
+		return nil, err
+	}
+	c.SessionsStore.Del("passkey:" + key)
+
+	var session webauthn.SessionData
+	err = json.Unmarshal([]byte(serialized), &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// savePasskeyUse keeps the sign count and flags the library updated.
+func (c *App) savePasskeyUse(credential *webauthn.Credential) {
+	serialized, err := json.Marshal(credential)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = c.MatrixDB.Queries.UpdatePasskeyCredential(context.Background(), matrix_db.UpdatePasskeyCredentialParams{
+		ID:         passkeyID(credential.ID),
+		Credential: string(serialized),
+		LastUsedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// LoginUser logs a user in without a password, giving them a new Matrix
+// device the same way returning OAuth users get one.
+func (c *App) LoginUser(matrixUserID string) (*User, error) {
+
+	username := strings.SplitN(strings.TrimPrefix(matrixUserID, "@"), ":", 2)[0]
+
+	did := RandomString(12)
+
+	_, err := c.MatrixDB.Queries.UNSAFECreateDevice(context.Background(), matrix_db.UNSAFECreateDeviceParams{
+		UserID:   matrixUserID,
+		DeviceID: did,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := c.MatrixDB.Queries.UNSAFECreateAccessToken(context.Background(), matrix_db.UNSAFECreateAccessTokenParams{
+		UserID: matrixUserID,
+		DeviceID: pgtype.Text{
+			String: did,
+			Valid:  true,
+		},
+		Token: RandomString(32),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := c.MatrixDB.Queries.GetCredentials(context.Background(), pgtype.Text{
+		String: username,
+		Valid:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := c.MatrixDB.Queries.GetProfile(context.Background(), username)
+	if err != nil {
+		return nil, err
+	}
+
+	userspace, err := c.MatrixDB.Queries.GetUserSpaceID(context.Background(), matrix_db.GetUserSpaceIDParams{
+		RoomAlias: fmt.Sprintf("#@%s:%s", username, c.Config.Matrix.PublicServer),
+		Creator: pgtype.Text{
+			String: matrixUserID,
+			Valid:  true,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	admin, err := c.MatrixDB.Queries.IsAdmin(context.Background(), pgtype.Text{String: matrixUserID, Valid: true})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return &User{
+		Username:          username,
+		Email:             creds.Email.String,
+		DisplayName:       profile.Displayname.String,
+		AvatarURL:         profile.AvatarUrl.String,
+		AccessToken:       RandomString(32),
+		MatrixAccessToken: accessToken,
+		MatrixUserID:      matrixUserID,
+		MatrixDeviceID:    did,
+		UserSpaceID:       userspace,
+		Age:               creds.CreatedAt.Int64,
+		Verified:          creds.Verified,
+		Admin:             admin,
+	}, nil
+}
+
+func (c *App) respondPasskeysDisabled(w http.ResponseWriter) bool {
+	if c.Config.Authentication.Passkeys && c.WebAuthn != nil {
+		return false
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"error": "passkeys are not enabled",
+		},
+	})
+	return true
+}
+
+func (c *App) Passkeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		rows, err := c.MatrixDB.Queries.GetPasskeys(context.Background(), user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get passkeys",
+				},
+			})
+			return
+		}
+
+		passkeys := []map[string]any{}
+		for _, row := range rows {
+			passkeys = append(passkeys, map[string]any{
+				"id":           row.ID,
+				"name":         row.Name,
+				"created_at":   row.CreatedAt,
+				"last_used_at": row.LastUsedAt,
+			})
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"passkeys": passkeys,
+			},
+		})
+	}
+}
+
+// confirmIdentity asks for the password, or a code when two-factor is on,
+// before something a stolen session shouldn't be able to do. Accounts with
+// neither, like OAuth ones, have nothing to confirm with. Failures count
+// toward the login lockout. Handlers return when it returns false.
+func (c *App) confirmIdentity(w http.ResponseWriter, r *http.Request, user *User, password, code string) bool {
+
+	account := accountSubject(user)
+
+	if c.RespondIfLockedOut(w, account) {
+		return false
+	}
+
+	hash, err := c.MatrixDB.Queries.GetPasswordHash(context.Background(), pgtype.Text{
+		String: user.MatrixUserID,
+		Valid:  true,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	twoFactor := c.TwoFactorEnabled(user.MatrixUserID)
+
+	switch {
+	case twoFactor && code != "" && c.VerifyTwoFactorCode(user.MatrixUserID, code):
+		return true
+	case hash.String != "" && password != "" && CheckPasswordHash(password, hash.String):
+		return true
+	case hash.String == "" && !twoFactor:
+		return true
+	}
+
+	c.RecordAuthFailure(r, account)
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"error":   "password or code is incorrect",
+			"confirm": true,
+			"2fa":     twoFactor,
+		},
+	})
+
+	return false
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials
+// .create(). Passkeys are made discoverable so they can log in on their own.
+// Since a passkey outlives the session, the password or a code is needed.
+func (c *App) BeginPasskeyRegistration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.respondPasskeysDisabled(w) {
+			return
+		}
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if !c.confirmIdentity(w, r, user, p.Password, p.Code) {
+			return
+		}
+
+		pu, err := c.getPasskeyUser(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey registration",
+				},
+			})
+			return
+		}
+		pu.DisplayName = user.DisplayName
+
+		options, session, err := c.WebAuthn.BeginRegistration(pu,
+			webauthn.WithExclusions(pu.descriptors()),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey registration",
+				},
+			})
+			return
+		}
+
+		key := RandomString(32)
+
+		err = c.storePasskeyCeremony(key, session)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey registration",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"options": options,
+				"session": key,
+			},
+		})
+	}
+}
+
+// FinishPasskeyRegistration takes the authenticator's response as the body,
+// with the session and a name for the passkey in the query.
+func (c *App) FinishPasskeyRegistration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.respondPasskeysDisabled(w) {
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		query := r.URL.Query()
+
+		session, err := c.takePasskeyCeremony(query.Get("session"))
+		if err != nil || string(session.UserID) != string(passkeyUserHandle(user.MatrixUserID)) {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":   "passkey registration expired, try again",
+					"expired": true,
+				},
+			})
+			return
+		}
+
+		pu, err := c.getPasskeyUser(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		credential, err := c.WebAuthn.FinishRegistration(pu, *session, r)
+		if err != nil {
+			log.Println("error registering passkey: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "passkey could not be verified",
+				},
+			})
+			return
+		}
+
+		serialized, err := json.Marshal(credential)
+		if err != nil {
+			log.Println(err)
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		name := strings.TrimSpace(query.Get("name"))
+		if name == "" {
+			name = "Passkey"
+		}
+
+		id := passkeyID(credential.ID)
+
+		err = c.MatrixDB.Queries.CreatePasskey(context.Background(), matrix_db.CreatePasskeyParams{
+			ID:         id,
+			UserID:     user.MatrixUserID,
+			Name:       name,
+			Credential: string(serialized),
+			CreatedAt:  time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not save passkey",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success": true,
+				"id":      id,
+				"name":    name,
+			},
+		})
+	}
+}
+
+func (c *App) DeletePasskey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		deleted, err := c.MatrixDB.Queries.DeletePasskey(context.Background(), matrix_db.DeletePasskeyParams{
+			ID:     chi.URLParam(r, "id"),
+			UserID: user.MatrixUserID,
+		})
+		if err != nil || deleted == 0 {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "passkey not found",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"success": true,
+			},
+		})
+	}
+}
+
+// BeginPasskeyLogin starts a passwordless login. The browser offers
+// whichever passkeys it has for the site.
+func (c *App) BeginPasskeyLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.respondPasskeysDisabled(w) {
+			return
+		}
+
+		options, session, err := c.WebAuthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired),
+		)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey login",
+				},
+			})
+			return
+		}
+
+		key := RandomString(32)
+
+		err = c.storePasskeyCeremony(key, session)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey login",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"options": options,
+				"session": key,
+			},
+		})
+	}
+}
+
+// FinishPasskeyLogin checks the assertion in the body and logs the owner of
+// the passkey in. A verified passkey is already two factors, so there's no
+// second step.
+func (c *App) FinishPasskeyLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.respondPasskeysDisabled(w) {
+			return
+		}
+
+		session, err := c.takePasskeyCeremony(r.URL.Query().Get("session"))
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"expired":       true,
+					"error":         "login expired, try again",
+				},
+			})
+			return
+		}
+
+		parsed, err := protocol.ParseCredentialRequestResponse(r)
+		if err != nil {
+			log.Println(err)
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		var owner string
+
+		credential, err := c.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			passkey, err := c.MatrixDB.Queries.GetPasskey(context.Background(), passkeyID(rawID))
+			if err != nil {
+				return nil, err
+			}
+
+			if string(userHandle) != string(passkeyUserHandle(passkey.UserID)) {
+				return nil, errors.New("passkey belongs to someone else")
+			}
+
+			owner = passkey.UserID
+
+			return c.getPasskeyUser(passkey.UserID)
+		}, *session, parsed)
+		if err != nil || owner == "" {
+			log.Println("error validating passkey login: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"error":         "passkey could not be verified",
+				},
+			})
+			return
+		}
+
+		if c.RespondIfLockedOut(w, "account:"+strings.SplitN(strings.TrimPrefix(owner, "@"), ":", 2)[0]) {
+			return
+		}
+
+		c.savePasskeyUse(credential)
+
+		user, err := c.LoginUser(owner)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"error":         "internal server error",
+				},
+			})
+			return
+		}
+
+		err = c.CreateUserSession(r, user)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"error":         "internal server error",
+				},
+			})
+			return
+		}
+
+		c.RespondWithLogin(w, user)
+	}
+}
+
+// BeginPasskeyTwoFactor is the passkey alternative to a code for the second
+// step of a password login.
+func (c *App) BeginPasskeyTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.respondPasskeysDisabled(w) {
+			return
+		}
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Challenge string `json:"challenge"`
+		}{})
+		if err != nil || p.Challenge == "" {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user, err := c.getTwoFactorChallenge(p.Challenge)
+		if err != nil {
+			respondTwoFactorExpired(w)
+			return
+		}
+
+		pu, err := c.getPasskeyUser(user.MatrixUserID)
+		if err != nil || len(pu.Credentials) == 0 {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "no passkeys on this account",
+				},
+			})
+			return
+		}
+
+		options, session, err := c.WebAuthn.BeginLogin(pu)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey login",
+				},
+			})
+			return
+		}
+
+		err = c.storePasskeyCeremony("2fa:"+p.Challenge, session)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not start passkey login",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"options": options,
+			},
+		})
+	}
+}
+
+// FinishPasskeyTwoFactor takes the assertion as the body and the login
+// challenge in the query.
+func (c *App) FinishPasskeyTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if c.respondPasskeysDisabled(w) {
+			return
+		}
+
+		challenge := r.URL.Query().Get("challenge")
+
+		user, err := c.getTwoFactorChallenge(challenge)
+		if err != nil {
+			respondTwoFactorExpired(w)
+			return
+		}
+
+		session, err := c.takePasskeyCeremony("2fa:" + challenge)
+		if err != nil {
+			respondTwoFactorExpired(w)
+			return
+		}
+
+		account := "account:" + strings.ToLower(user.Username)
+
+		if c.RespondIfLockedOut(w, account) {
+			return
+		}
+
+		pu, err := c.getPasskeyUser(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		credential, err := c.WebAuthn.FinishLogin(pu, *session, r)
+		if err != nil {
+			log.Println("error validating passkey: ", err)
+			c.RecordAuthFailure(r, account)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"error":         "passkey could not be verified",
+				},
+			})
+			return
+		}
+
+		c.savePasskeyUse(credential)
+
+		c.completeTwoFactorLogin(w, r, challenge, user)
+	}
+}
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+)
+
+// state event rooms and spaces keep their posting policy in
+const PostingPolicyType = "m.restrict_events_to"
+
+// actions a posting policy can restrict
+const (
+	ActionPost  = "post"
+	ActionReply = "reply"
+	ActionReact = "react"
+	ActionVote  = "vote"
+	ActionState = "state"
+)
+
+// PostingPolicy is the content of a room's or space's m.restrict_events_to
+// state event. Age and MemberFor are in days. Actions limits the policy to
+// some actions, it applies to all of them when empty.
+type PostingPolicy struct {
+	Age       int32            `json:"age"`
+	Verified  bool             `json:"verified"`
+	MemberFor int32            `json:"member_for,omitempty"`
+	RateLimit *PolicyRateLimit `json:"rate_limit,omitempty"`
+	Actions   []string         `json:"actions,omitempty"`
+
+	// room the policy was set in, either the room or its space
+	RoomID string `json:"-"`
+}
+
+// PolicyRateLimit allows Count actions every Period seconds.
+type PolicyRateLimit struct {
+	Count  int   `json:"count"`
+	Period int64 `json:"period"`
+}
+
+func (p *PostingPolicy) AppliesTo(action string) bool {
+	if len(p.Actions) == 0 {
+		return true
+	}
+	for _, a := range p.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+type PolicyRequest struct {
+	User   *User
+	RoomID string
+	Action string
+}
+
+// PostAction works out which action a new post is.
+func PostAction(p *NewPostBody) string {
+	switch {
+	case p.Type == "m.reaction" || p.ReactingTo != "":
+		return ActionReact
+	case p.IsReply:
+		return ActionReply
+	}
+	return ActionPost
+}
+
+// PolicyRejection tells the client which rule stopped the action and
+// enough to explain it.
+type PolicyRejection struct {
+	Rule       string `json:"rule"`
+	Message    string `json:"message"`
+	RoomID     string `json:"room_id"`
+	Required   int64  `json:"required,omitempty"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+}
+
+// PolicyRule checks one part of a policy, returning nil when the request
+// passes.
+type PolicyRule struct {
+	Name  string
+	Check func(c *App, req *PolicyRequest, policy *PostingPolicy) *PolicyRejection
+}
+
+// rules run in order, rate limits go last so rejected requests don't count
+// against them
+var policyRules = []PolicyRule{
+	{Name: "age", Check: checkAccountAge},
+	{Name: "verified", Check: checkVerified},
+	{Name: "member_for", Check: checkMembershipDuration},
+	{Name: "rate_limit", Check: checkRateLimit},
+}
+
+// RegisterPolicyRule adds a rule that runs before the rate limit.
+func RegisterPolicyRule(rule PolicyRule) {
+	last := len(policyRules) - 1
+	rules := append([]PolicyRule{}, policyRules[:last]...)
+	policyRules = append(rules, rule, policyRules[last])
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+func checkAccountAge(c *App, req *PolicyRequest, policy *PostingPolicy) *PolicyRejection {
+	if policy.Age <= 0 || c.IsSenderAgeValid(req.User, policy.Age) {
+		return nil
+	}
+	return &PolicyRejection{
+		Message:  fmt.Sprintf("Your account needs to be at least %s old to do this here.", plural(int64(policy.Age), "day")),
+		Required: int64(policy.Age),
+	}
+}
+
+func checkVerified(c *App, req *PolicyRequest, policy *PostingPolicy) *PolicyRejection {
+	// spaces are created with verified on, which nobody could satisfy on an
+	// instance that can't send verification emails
+	if !policy.Verified || req.User.Verified || c.Config.SMTP.Server == "" {
+		return nil
+	}
+	return &PolicyRejection{
+		Message: "You need to verify your email to do this here.",
+	}
+}
+
+func checkMembershipDuration(c *App, req *PolicyRequest, policy *PostingPolicy) *PolicyRejection {
+	if policy.MemberFor <= 0 {
+		return nil
+	}
+
+	since, err := c.MatrixDB.Queries.GetMemberSince(context.Background(), matrix_db.GetMemberSinceParams{
+		RoomID: policy.RoomID,
+		UserID: req.User.MatrixUserID,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	required := time.Duration(policy.MemberFor) * time.Hour * 24
+
+	if since > 0 && time.Since(time.UnixMilli(since)) >= required {
+		return nil
+	}
+
+	return &PolicyRejection{
+		Message:  fmt.Sprintf("You need to have been a member for %s to do this here.", plural(int64(policy.MemberFor), "day")),
+		Required: int64(policy.MemberFor),
+	}
+}
+
+func checkRateLimit(c *App, req *PolicyRequest, policy *PostingPolicy) *PolicyRejection {
+	if policy.RateLimit == nil || policy.RateLimit.Count <= 0 || policy.RateLimit.Period <= 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("commune:policy:%s:%s", policy.RoomID, req.User.MatrixUserID)
+	period := time.Duration(policy.RateLimit.Period) * time.Second
+
+	count, err := c.Cache.System.Incr(key).Result()
+	if err != nil {
+		// don't stop people posting because redis is down
+		log.Println(err)
+		return nil
+	}
+
+	if count == 1 {
+		c.Cache.System.Expire(key, period)
+	}
+
+	if count <= int64(policy.RateLimit.Count) {
+		return nil
+	}
+
+	retry := int64(period.Seconds())
+	ttl, err := c.Cache.System.TTL(key).Result()
+	if err == nil && ttl > 0 {
+		retry = int64(ttl.Seconds()) + 1
+	}
+
+	return &PolicyRejection{
+		Message:    fmt.Sprintf("You're doing that too often here. Try again in %s.", plural(retry, "second")),
+		Required:   int64(policy.RateLimit.Count),
+		RetryAfter: retry,
+	}
+}
+
+// GetPostingPolicies returns the policies of roomID and of the space it
+// belongs to.
+func (c *App) GetPostingPolicies(roomID string) ([]*PostingPolicy, error) {
+
+	rows, err := c.MatrixDB.Queries.GetPostingPolicies(context.Background(), roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []*PostingPolicy{}
+
+	for _, row := range rows {
+		var policy PostingPolicy
+		err := json.Unmarshal([]byte(row.Content), &policy)
+		if err != nil {
+			log.Println("error parsing posting policy: ", err)
+			continue
+		}
+		policy.RoomID = row.RoomID
+		policies = append(policies, &policy)
+	}
+
+	return policies, nil
+}
+
+// CheckPostingPolicy runs every rule of every policy that applies to the
+// request. It returns nothing when the action is allowed.
+func (c *App) CheckPostingPolicy(req *PolicyRequest) []*PolicyRejection {
+
+	if req.User == nil || req.RoomID == "" || req.User.Admin {
+		return nil
+	}
+
+	if rejection := checkPolicyLists(c, req); rejection != nil {
+		return []*PolicyRejection{rejection}
+	}
+
+	policies, err := c.GetPostingPolicies(req.RoomID)
+	if err != nil {
+		log.Println("error getting posting policies: ", err)
+		return nil
+	}
+
+	rejections := []*PolicyRejection{}
+
+	for _, rule := range policyRules {
+		// a request that's already rejected shouldn't use up its rate limit
+		if rule.Name == "rate_limit" && len(rejections) > 0 {
+			break
+		}
+
+		for _, policy := range policies {
+			if !policy.AppliesTo(req.Action) {
+				continue
+			}
+
+			rejection := rule.Check(c, req, policy)
+			if rejection != nil {
+				rejection.Rule = rule.Name
+				rejection.RoomID = policy.RoomID
+				rejections = append(rejections, rejection)
+			}
+		}
+	}
+
+	if len(rejections) == 0 {
+		return nil
+	}
+
+	return rejections
+}
+
+// RespondWithPolicyRejection checks the policy and writes the rejection
+// if there is one. Handlers return when it returns true.
+func (c *App) RespondWithPolicyRejection(w http.ResponseWriter, req *PolicyRequest) bool {
+
+	rejections := c.CheckPostingPolicy(req)
+	if rejections == nil {
+		return false
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"success":   false,
+			"forbidden": true,
+			"error":     rejections[0].Message,
+			"reasons":   rejections,
+		},
+	})
+
+	return true
+}
@@ -0,0 +1,717 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+	"shpong/gomatrix"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	PolicyRuleUser   = "m.policy.rule.user"
+	PolicyRuleServer = "m.policy.rule.server"
+	PolicyRuleRoom   = "m.policy.rule.room"
+)
+
+// recommendations that mean a ban, the second is what older Mjolnir lists
+// use
+var banRecommendations = map[string]bool{
+	"m.ban":                  true,
+	"org.matrix.mjolnir.ban": true,
+}
+
+// PolicyMatch is the rule a user, server or room matched.
+type PolicyMatch struct {
+	PolicyRoomID string `json:"policy_room_id"`
+	Type         string `json:"type"`
+	Entity       string `json:"entity"`
+	Reason       string `json:"reason"`
+}
+
+type policyRule struct {
+	PolicyMatch
+	pattern *regexp.Regexp
+}
+
+type policySubscription struct {
+	AutoBan      bool
+	SubscribedBy string
+}
+
+// PolicyLists is every rule of the subscribed policy rooms, kept in memory
+// since it's checked for every post and every event in a feed. Rules are
+// scoped to the spaces following them, the empty scope is the instance.
+type PolicyLists struct {
+	mu sync.RWMutex
+	// scope -> policy room -> subscription
+	subscriptions map[string]map[string]*policySubscription
+	// policy room -> rules
+	rules map[string][]*policyRule
+	// room -> the space it's in
+	spaces map[string]string
+	// bans waiting for the instance account, so they don't hold up events
+	enforcements chan *policyEnforcement
+}
+
+type policyEnforcement struct {
+	spaceRoomID string
+	members     []string
+}
+
+func NewPolicyLists() *PolicyLists {
+	return &PolicyLists{
+		subscriptions: map[string]map[string]*policySubscription{},
+		rules:         map[string][]*policyRule{},
+		spaces:        map[string]string{},
+		enforcements:  make(chan *policyEnforcement, 256),
+	}
+}
+
+// globs in policy rules only have * and ?
+func policyGlob(entity string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(entity)
+	pattern = strings.ReplaceAll(pattern, `\*`, `.*`)
+	pattern = strings.ReplaceAll(pattern, `\?`, `.`)
+	return regexp.Compile("^" + pattern + "$")
+}
+
+func userServer(matrixUserID string) string {
+	parts := strings.SplitN(matrixUserID, ":", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// LoadPolicyLists reads subscriptions and rules from the database and
+// swaps them in.
+func (c *App) LoadPolicyLists() error {
+
+	subs, err := c.MatrixDB.Queries.GetAllPolicySubscriptions(context.Background())
+	if err != nil {
+		return err
+	}
+
+	rows, err := c.MatrixDB.Queries.GetSubscribedPolicyRules(context.Background())
+	if err != nil {
+		return err
+	}
+
+	rooms, err := c.MatrixDB.Queries.GetPolicySpaceRooms(context.Background())
+	if err != nil {
+		return err
+	}
+
+	subscriptions := map[string]map[string]*policySubscription{}
+	for _, sub := range subs {
+		if subscriptions[sub.SpaceRoomID] == nil {
+			subscriptions[sub.SpaceRoomID] = map[string]*policySubscription{}
+		}
+		subscriptions[sub.SpaceRoomID][sub.PolicyRoomID] = &policySubscription{
+			AutoBan:      sub.AutoBan,
+			SubscribedBy: sub.SubscribedBy,
+		}
+	}
+
+	rules := map[string][]*policyRule{}
+	for _, row := range rows {
+		if row.Entity == "" || !banRecommendations[row.Recommendation] {
+			continue
+		}
+
+		pattern, err := policyGlob(row.Entity)
+		if err != nil {
+			log.Println("error parsing policy rule: ", err)
+			continue
+		}
+
+		rules[row.PolicyRoomID] = append(rules[row.PolicyRoomID], &policyRule{
+			PolicyMatch: PolicyMatch{
+				PolicyRoomID: row.PolicyRoomID,
+				Type:         row.Type,
+				Entity:       row.Entity,
+				Reason:       row.Reason,
+			},
+			pattern: pattern,
+		})
+	}
+
+	spaces := map[string]string{}
+	for _, room := range rooms {
+		spaces[room.RoomID] = room.SpaceRoomID
+	}
+
+	c.PolicyLists.mu.Lock()
+	c.PolicyLists.subscriptions = subscriptions
+	c.PolicyLists.rules = rules
+	c.PolicyLists.spaces = spaces
+	c.PolicyLists.mu.Unlock()
+
+	return nil
+}
+
+func (p *PolicyLists) scope(roomID string) string {
+	if space, ok := p.spaces[roomID]; ok {
+		return space
+	}
+	return roomID
+}
+
+func (p *PolicyLists) IsPolicyRoom(roomID string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, subs := range p.subscriptions {
+		if _, ok := subs[roomID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PolicyLists) match(scope, matrixUserID, roomID string) (*PolicyMatch, *policySubscription) {
+
+	server := userServer(matrixUserID)
+
+	for _, s := range []string{"", scope} {
+		for policyRoomID, sub := range p.subscriptions[s] {
+			for _, rule := range p.rules[policyRoomID] {
+				var entity string
+				switch rule.Type {
+				case PolicyRuleUser:
+					entity = matrixUserID
+				case PolicyRuleServer:
+					entity = server
+				case PolicyRuleRoom:
+					entity = roomID
+				}
+
+				if entity != "" && rule.pattern.MatchString(entity) {
+					return &rule.PolicyMatch, sub
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Match returns the rule that bans the user, their server or the room, for
+// a room and the space it's in. It's nil when nothing matches.
+func (p *PolicyLists) Match(roomID, matrixUserID string) *PolicyMatch {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.subscriptions) == 0 {
+		return nil
+	}
+
+	match, _ := p.match(p.scope(roomID), matrixUserID, roomID)
+	return match
+}
+
+// FilterPolicyEvents drops events from banned users, servers and rooms.
+func (c *App) FilterPolicyEvents(events *[]Event) *[]Event {
+
+	if events == nil {
+		return events
+	}
+
+	filtered := []Event{}
+	for _, event := range *events {
+		if c.PolicyLists.Match(event.RoomID, event.Sender.ID) != nil {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+
+	return &filtered
+}
+
+func checkPolicyLists(c *App, req *PolicyRequest) *PolicyRejection {
+	match := c.PolicyLists.Match(req.RoomID, req.User.MatrixUserID)
+	if match == nil {
+		return nil
+	}
+	return &PolicyRejection{
+		Rule:    "policy_list",
+		Message: "You're on a ban list this space follows.",
+		RoomID:  match.PolicyRoomID,
+	}
+}
+
+// autoBans is who to ban in scope: members of the space who match a rule
+// of a policy room the space follows with auto ban on. Rules followed by
+// the whole instance only block and filter, they never ban.
+func (c *App) autoBans(scope string, members []string) []string {
+
+	c.PolicyLists.mu.RLock()
+	defer c.PolicyLists.mu.RUnlock()
+
+	bans := []string{}
+
+	subs := c.PolicyLists.subscriptions[scope]
+	if len(subs) == 0 {
+		return bans
+	}
+
+	for _, member := range members {
+		server := userServer(member)
+
+	subscriptions:
+		for policyRoomID, sub := range subs {
+			if !sub.AutoBan {
+				continue
+			}
+
+			for _, rule := range c.PolicyLists.rules[policyRoomID] {
+				if (rule.Type == PolicyRuleUser && rule.pattern.MatchString(member)) ||
+					(rule.Type == PolicyRuleServer && rule.pattern.MatchString(server)) {
+					bans = append(bans, member)
+					break subscriptions
+				}
+			}
+		}
+	}
+
+	return bans
+}
+
+// instanceModerator logs in as the instance account, which spaces with
+// auto ban on give ban power to.
+func (c *App) instanceModerator() (*User, error) {
+
+	_, resp, err := c.DefaultMatrixClient()
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("could not log in as the instance account")
+	}
+
+	return &User{
+		MatrixUserID:      resp.UserID,
+		MatrixAccessToken: resp.AccessToken,
+	}, nil
+}
+
+// grantPolicyBans lets the instance account ban in the space, joining it
+// and giving it the ban power level. The owner's client does the granting.
+func (c *App) grantPolicyBans(owner *gomatrix.Client, spaceRoomID string) error {
+
+	pl, err := c.RoomPowerLevels(spaceRoomID)
+	if err != nil {
+		return err
+	}
+
+	level := pl.level("ban", 50)
+	if pl.UserLevel(c.DefaultMatrixAccount) < level {
+		pl.users()[c.DefaultMatrixAccount] = level
+		_, err = owner.SendStateEvent(spaceRoomID, "m.room.power_levels", "", pl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// private spaces need an invite, public ones fail harmlessly
+	_, err = owner.InviteUser(spaceRoomID, &gomatrix.ReqInviteUser{
+		UserID: c.DefaultMatrixAccount,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	bot, err := c.instanceModerator()
+	if err != nil {
+		return err
+	}
+	defer c.logoutMatrixDevice(bot)
+
+	matrix, err := c.matrixClient(bot)
+	if err != nil {
+		return err
+	}
+
+	_, err = matrix.JoinRoom(spaceRoomID, "", nil)
+	return err
+}
+
+// queuePolicyBans hands bans to the enforcement worker. Members is nil to
+// check everyone in the space.
+func (c *App) queuePolicyBans(spaceRoomID string, members []string) {
+	select {
+	case c.PolicyLists.enforcements <- &policyEnforcement{
+		spaceRoomID: spaceRoomID,
+		members:     members,
+	}:
+	default:
+		log.Println("policy ban queue is full, dropping bans for ", spaceRoomID)
+	}
+}
+
+func (c *App) runPolicyEnforcements() {
+	for e := range c.PolicyLists.enforcements {
+		c.EnforcePolicyBans(e.spaceRoomID, e.members)
+	}
+}
+
+// EnforcePolicyBans bans members of the space that match its auto ban
+// lists. Bans are made by the instance account and land in the audit log
+// like any other ban.
+func (c *App) EnforcePolicyBans(spaceRoomID string, members []string) {
+
+	if members == nil {
+		joined, err := c.MatrixDB.Queries.GetJoinedMembers(context.Background(), pgtype.Text{
+			String: spaceRoomID,
+			Valid:  true,
+		})
+		if err != nil {
+			log.Println("error getting members: ", err)
+			return
+		}
+		members = joined
+	}
+
+	targets := c.autoBans(spaceRoomID, members)
+	if len(targets) == 0 {
+		return
+	}
+
+	moderator, err := c.instanceModerator()
+	if err != nil {
+		log.Println("error enforcing policy bans: ", err)
+		return
+	}
+	defer c.logoutMatrixDevice(moderator)
+
+	for _, target := range targets {
+		match := c.PolicyLists.Match(spaceRoomID, target)
+		if match == nil {
+			continue
+		}
+
+		reason := match.Reason
+		if reason == "" {
+			reason = "on a ban list"
+		}
+
+		_, err := c.Moderate(moderator, &ModerationParams{
+			Action: ModerationBan,
+			UserID: target,
+			Reason: reason,
+			Rooms:  []string{spaceRoomID},
+		})
+		if err != nil {
+			log.Println("error banning ", target, ": ", err)
+		}
+	}
+}
+
+// WatchPolicyLists reloads the rules when a policy room changes and bans
+// people who join a space they're banned from.
+func (c *App) WatchPolicyLists(sub *Subscription) {
+
+	err := c.LoadPolicyLists()
+	if err != nil {
+		log.Println("error loading policy lists: ", err)
+	}
+
+	go c.runPolicyEnforcements()
+
+	for msg := range sub.C {
+		en, ok := msg.(*EventNotification)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(en.Type, "m.policy.rule."), en.Type == "m.room.redaction", en.Type == "m.space.child":
+			if en.Type != "m.space.child" && !c.PolicyLists.IsPolicyRoom(en.RoomID) {
+				continue
+			}
+
+			err := c.LoadPolicyLists()
+			if err != nil {
+				log.Println("error loading policy lists: ", err)
+				continue
+			}
+
+			if en.Type != PolicyRuleUser && en.Type != PolicyRuleServer {
+				continue
+			}
+
+			if !c.Fanout.Claim("policy", en.EventID) {
+				continue
+			}
+
+			for _, scope := range c.policyScopes(en.RoomID) {
+				c.queuePolicyBans(scope, nil)
+			}
+
+		case en.Type == "m.room.member":
+			c.PolicyLists.mu.RLock()
+			scope := c.PolicyLists.scope(en.RoomID)
+			_, followed := c.PolicyLists.subscriptions[scope]
+			c.PolicyLists.mu.RUnlock()
+
+			if !followed || scope != en.RoomID || en.Sender == "" {
+				continue
+			}
+
+			if c.PolicyLists.Match(en.RoomID, en.Sender) == nil || !c.Fanout.Claim("policy", en.EventID) {
+				continue
+			}
+
+			c.queuePolicyBans(scope, []string{en.Sender})
+		}
+	}
+}
+
+// policyScopes are the spaces that follow a policy room.
+func (c *App) policyScopes(policyRoomID string) []string {
+	c.PolicyLists.mu.RLock()
+	defer c.PolicyLists.mu.RUnlock()
+
+	scopes := []string{}
+	for scope, subs := range c.PolicyLists.subscriptions {
+		if _, ok := subs[policyRoomID]; ok && scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// a policy scope resolver returns the scope a request manages and whether
+// the user may manage it
+type policyScope func(r *http.Request, user *User) (string, bool)
+
+// InstancePolicyScope is the instance's own lists, for admins.
+func (c *App) InstancePolicyScope(r *http.Request, user *User) (string, bool) {
+	return "", user.Admin
+}
+
+// SpacePolicyScope is a space's lists, for its owner.
+func (c *App) SpacePolicyScope(r *http.Request, user *User) (string, bool) {
+
+	state, err := c.GetSpaceState(&SpaceStateParams{
+		Slug:         strings.ToLower(chi.URLParam(r, "space")),
+		MatrixUserID: user.MatrixUserID,
+	})
+	if err != nil {
+		return "", false
+	}
+
+	return state.RoomID, state.IsOwner || user.Admin
+}
+
+func (c *App) PolicySubscriptions(scope policyScope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := scope(r, user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		subs, err := c.MatrixDB.Queries.GetPolicySubscriptions(context.Background(), roomID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get policy lists",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"policy_lists": subs,
+			},
+		})
+	}
+}
+
+// SubscribePolicyList joins the policy room, so the homeserver gets its
+// rules, and follows it. Only spaces can auto ban.
+func (c *App) SubscribePolicyList(scope policyScope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Room    string `json:"room"`
+			AutoBan bool   `json:"auto_ban"`
+		}{})
+		if err != nil || p.Room == "" {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := scope(r, user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		autoBan := p.AutoBan && roomID != ""
+
+		matrix, err := c.matrixClient(user)
+		if err != nil {
+			log.Println(err)
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		joined, err := matrix.JoinRoom(p.Room, "", nil)
+		if err != nil {
+			log.Println("error joining policy room: ", err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not join the policy room",
+				},
+			})
+			return
+		}
+
+		if autoBan {
+			err = c.grantPolicyBans(matrix, roomID)
+			if err != nil {
+				log.Println("error granting policy bans: ", err)
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"error": "could not let the instance account ban in this space",
+					},
+				})
+				return
+			}
+		}
+
+		err = c.MatrixDB.Queries.SubscribePolicyRoom(context.Background(), matrix_db.SubscribePolicyRoomParams{
+			SpaceRoomID:  roomID,
+			PolicyRoomID: joined.RoomID,
+			AutoBan:      autoBan,
+			SubscribedBy: user.MatrixUserID,
+			CreatedAt:    time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not subscribe to the policy list",
+				},
+			})
+			return
+		}
+
+		err = c.LoadPolicyLists()
+		if err != nil {
+			log.Println(err)
+		}
+		c.PublishPolicyListsChanged()
+
+		if autoBan {
+			c.queuePolicyBans(roomID, nil)
+		}
+
+		c.Audit(&AuditEntry{
+			Actor:       user.MatrixUserID,
+			Action:      AuditSubscribePolicyList,
+			Target:      joined.RoomID,
+			SpaceRoomID: roomID,
+			Details: map[string]any{
+				"auto_ban": autoBan,
+			},
+		})
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"subscribed":     true,
+				"policy_room_id": joined.RoomID,
+			},
+		})
+	}
+}
+
+func (c *App) UnsubscribePolicyList(scope policyScope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := scope(r, user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		room := r.URL.Query().Get("room")
+
+		// subscribing takes an alias too
+		if strings.HasPrefix(room, "#") {
+			matrix, err := c.matrixClient(user)
+			if err == nil {
+				var resolved *gomatrix.RespAliasResolve
+				resolved, err = matrix.ResolveAlias(room)
+				if err == nil {
+					room = resolved.RoomID
+				}
+			}
+			if err != nil {
+				log.Println("error resolving policy room alias: ", err)
+			}
+		}
+
+		removed, err := c.MatrixDB.Queries.UnsubscribePolicyRoom(context.Background(), matrix_db.UnsubscribePolicyRoomParams{
+			SpaceRoomID:  roomID,
+			PolicyRoomID: room,
+		})
+		if err != nil || removed == 0 {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "not subscribed to that policy list",
+				},
+			})
+			return
+		}
+
+		err = c.LoadPolicyLists()
+		if err != nil {
+			log.Println(err)
+		}
+		c.PublishPolicyListsChanged()
+
+		c.Audit(&AuditEntry{
+			Actor:       user.MatrixUserID,
+			Action:      AuditUnsubscribePolicyList,
+			Target:      room,
+			SpaceRoomID: roomID,
+		})
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"unsubscribed": true,
+			},
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"reflect"
 	"shpong/gomatrix"
 	"strings"
 	"time"
@@ -107,14 +106,18 @@ func (c *App) CreatePost() http.HandlerFunc {
 
 		user := c.LoggedInUser(r)
 
-		if p.RoomID != "" {
-			age, err := c.MatrixDB.Queries.GetRoomSenderAgeLimit(context.Background(), p.RoomID)
-			if err != nil {
-				log.Println(err)
-			}
-			log.Println("room age limit is ", age)
-			valid := c.IsSenderAgeValid(user, age)
-			log.Println("is sender's age valid?", valid)
+		if c.RespondWithPolicyRejection(w, &PolicyRequest{
+			User:   user,
+			RoomID: p.RoomID,
+			Action: PostAction(p),
+		}) {
+			return
+		}
+
+		// filters run before anything is sent to the homeserver
+		filtered := c.CheckContentFilters(user, p)
+		if c.RespondWithContentFilter(w, user, p, filtered) {
+			return
 		}
 
 		if !strings.Contains(p.RoomID, c.Config.Matrix.PublicServer) &&
@@ -152,27 +155,8 @@ func (c *App) CreatePost() http.HandlerFunc {
 			return
 		}
 
-		if c.Config.Search.Enabled {
-			go func() {
-
-				if co, ok := p.Content.(map[string]interface{}); ok {
-
-					event := map[string]interface{}{
-						"id":         RandomString(32),
-						"event":      event.EventID,
-						"room":       event.RoomID,
-						"room_alias": event.RoomAlias,
-						"title":      co["title"],
-						"body":       co["body"],
-					}
-
-					c.AddSearchEvent(event)
-				} else {
-					log.Println("couln't")
-					reflect.TypeOf(p.Content)
-				}
-
-			}()
+		if filtered != nil {
+			go c.FlagPost(user, event, p, filtered)
 		}
 
 		RespondWithJSON(w, &JSONResponse{
@@ -362,3 +346,32 @@ func (c *App) UpdateEventRepliesCache(event string, roomID string) error {
 
 	return nil
 }
+
+// RefreshEventCaches rebuilds the cached boards whenever a post, reaction
+// or redaction lands in a space.
+func (c *App) RefreshEventCaches(sub *Subscription) {
+	for msg := range sub.C {
+		en, ok := msg.(*EventNotification)
+		if !ok {
+			continue
+		}
+
+		switch en.Type {
+		case "space.board.post", "m.reaction", "m.room.redaction":
+		default:
+			continue
+		}
+
+		// the caches live in redis, so one instance refreshing is enough
+		if !c.Fanout.Claim("caches", en.EventID) {
+			continue
+		}
+
+		if c.Config.Cache.SpaceEvents {
+			// also refreshes the index cache
+			c.UpdateSpaceEventsCache(en.RoomID)
+		} else {
+			c.UpdateIndexEventsCache()
+		}
+	}
+}
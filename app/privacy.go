@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+)
+
+// paths anyone can reach on a private instance, enough to sign up, log in
+// and recover an account
+var publicPaths = []string{
+	"/robots.txt",
+	"/health_check",
+	"/account",
+}
+
+func isPublicPath(path string) bool {
+	for _, p := range publicPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestUser returns the user making the request. Websockets and event
+// streams can't set headers, so the token can also come from the query.
+func (c *App) RequestUser(r *http.Request) *User {
+	if user := c.LoggedInUser(r); user != nil {
+		return user
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return nil
+	}
+
+	user, err := c.GetTokenUser(token)
+	if err != nil {
+		return nil
+	}
+
+	return user
+}
+
+// RequireMembership is the only place private-instance mode is enforced.
+// With privacy.disable_public on, everything apart from the account routes
+// needs a logged in user. Pages redirect to the app, API requests get an
+// error.
+func (c *App) RequireMembership(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !c.Config.Privacy.DisablePublic {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+		if isPublicPath(r.URL.Path) || c.RequestUser(r) != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, c.Config.App.PublicDomain, http.StatusFound)
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: map[string]any{
+				"authenticated": false,
+				"private":       true,
+				"error":         "this instance is private, log in to continue",
+			},
+		})
+	})
+}
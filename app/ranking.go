@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	matrix_db "shpong/db/matrix/gen"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// board sorting modes supported by GetRankedSpaceEvents
+const (
+	SortHot           = "hot"
+	SortTop           = "top"
+	SortControversial = "controversial"
+	SortNew           = "new"
+)
+
+func IsValidSort(sort string) bool {
+	switch sort {
+	case SortHot, SortTop, SortControversial, SortNew:
+		return true
+	}
+	return false
+}
+
+// time windows for top and controversial, keyed by the `t` query param
+var sortWindows = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   time.Hour * 24,
+	"week":  time.Hour * 24 * 7,
+	"month": time.Hour * 24 * 30,
+	"year":  time.Hour * 24 * 365,
+}
+
+// RankCursor is the position of the last event on a ranked page. Ranked
+// pages are ordered by (score, event_id) so ties never skip or repeat events.
+type RankCursor struct {
+	Score   float64
+	EventID string
+}
+
+func (r *RankCursor) Encode() string {
+	s := strconv.FormatFloat(r.Score, 'g', -1, 64) + "|" + r.EventID
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func DecodeRankCursor(s string) (*RankCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("invalid cursor")
+	}
+
+	score, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RankCursor{
+		Score:   score,
+		EventID: parts[1],
+	}, nil
+}
+
+// GetRankedSpaceEvents returns board posts ordered by p.Sort along with the
+// cursor for the next page. The cursor is empty on the last page.
+func (c *App) GetRankedSpaceEvents(p *SpaceEventsParams) (*[]Event, string, error) {
+
+	sreq := matrix_db.GetSpaceEventsRankedParams{
+		RoomID: p.RoomID,
+		Sort:   p.Sort,
+	}
+
+	if len(p.Topic) > 0 {
+		sreq.Topic = pgtype.Text{
+			String: p.Topic,
+			Valid:  true,
+		}
+	}
+
+	if p.Sort == SortTop || p.Sort == SortControversial {
+		if window, ok := sortWindows[p.Time]; ok {
+			sreq.Since = pgtype.Int8{
+				Int64: time.Now().Add(-window).UnixMilli(),
+				Valid: true,
+			}
+		}
+	}
+
+	if p.Cursor != "" {
+		cursor, err := DecodeRankCursor(p.Cursor)
+		if err != nil {
+			log.Println("error decoding cursor: ", err)
+			return nil, "", err
+		}
+		sreq.CursorScore = pgtype.Float8{
+			Float64: cursor.Score,
+			Valid:   true,
+		}
+		sreq.CursorEventID = pgtype.Text{
+			String: cursor.EventID,
+			Valid:  true,
+		}
+	}
+
+	items := []Event{}
+
+	if p.Cursor == "" && len(p.Topic) == 0 {
+		pinned, err := c.GetPinnedEvents(p.RoomID)
+		if err != nil {
+			log.Println("error getting pinned events: ", err)
+		}
+		items = append(items, pinned...)
+	}
+
+	events, err := c.MatrixDB.Queries.GetSpaceEventsRanked(context.Background(), sreq)
+
+	if err != nil {
+		log.Println("error getting event: ", err)
+		return nil, "", err
+	}
+
+	for _, item := range events {
+
+		json, err := gabs.ParseJSON([]byte(item.JSON.String))
+		if err != nil {
+			log.Println("error parsing json: ", err)
+		}
+
+		s := ProcessComplexEvent(&EventProcessor{
+			EventID:     item.EventID,
+			Slug:        item.Slug,
+			JSON:        json,
+			RoomAlias:   item.RoomAlias.String,
+			DisplayName: item.DisplayName.String,
+			AvatarURL:   item.AvatarUrl.String,
+			ReplyCount:  item.Replies,
+			Reactions:   item.Reactions,
+			Edited:      item.Edited,
+			EditedOn:    item.EditedOn,
+		})
+
+		s.Upvotes = item.Upvotes
+		s.Downvotes = item.Downvotes
+
+		exists := false
+
+		for _, event := range items {
+			if s.EventID == event.EventID {
+				exists = true
+				break
+			}
+		}
+
+		if !exists {
+			items = append(items, s)
+		}
+	}
+
+	next := ""
+
+	// the query pages 30 events at a time
+	if len(events) == 30 {
+		last := events[len(events)-1]
+		cursor := &RankCursor{
+			Score:   last.Score,
+			EventID: last.EventID,
+		}
+		next = cursor.Encode()
+	}
+
+	return &items, next, nil
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"encoding/base64"
+	"math"
+	"testing"
+)
+
+func TestRankCursorRoundTrip(t *testing.T) {
+	tests := []RankCursor{
+		{Score: 0, EventID: "$abc"},
+		{Score: 1.5, EventID: "$abc:example.org"},
+		{Score: -42.125, EventID: "$negative"},
+		{Score: 1e-300, EventID: "$tiny"},
+		{Score: math.MaxFloat64, EventID: "$huge"},
+		{Score: 0.1 + 0.2, EventID: "$not_quite_0.3"},
+		// only the first separator splits, event IDs can have their own
+		{Score: 3, EventID: "$a|b|c"},
+	}
+
+	for _, tt := range tests {
+		encoded := tt.Encode()
+
+		got, err := DecodeRankCursor(encoded)
+		if err != nil {
+			t.Errorf("DecodeRankCursor(%s) for %+v error: %s", encoded, tt, err)
+			continue
+		}
+		// the score has to come back exactly or pages skip or repeat ties
+		if got.Score != tt.Score || got.EventID != tt.EventID {
+			t.Errorf("DecodeRankCursor(%s) = %+v, want %+v", encoded, *got, tt)
+		}
+	}
+}
+
+func TestDecodeRankCursorInvalid(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1.5|$abc"))},
+		{"no separator", encode("1.5")},
+		{"no event id", encode("1.5|")},
+		{"no score", encode("|$abc")},
+		{"score isn't a number", encode("hot|$abc")},
+	}
+
+	for _, tt := range tests {
+		if got, err := DecodeRankCursor(tt.cursor); err == nil {
+			t.Errorf("%s: DecodeRankCursor(%q) = %+v, want an error", tt.name, tt.cursor, *got)
+		}
+	}
+}
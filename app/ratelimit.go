@@ -0,0 +1,324 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	config "shpong/config"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// routes that aren't in the config use these
+var defaultRateLimits = map[string]config.RateLimitRoute{
+	"login":           {Period: 300, PerIP: 30, PerAccount: 10},
+	"login_2fa":       {Period: 300, PerIP: 30},
+	"password":        {Period: 3600, PerIP: 10, PerEmail: 3},
+	"password_verify": {Period: 3600, PerIP: 20, PerEmail: 10},
+	"verify_code":     {Period: 3600, PerIP: 10, PerEmail: 3},
+	"username":        {Period: 60, PerIP: 60},
+	"invites":         {Period: 60, PerIP: 30},
+	"email":           {Period: 3600, PerIP: 10, PerEmail: 3},
+	"email_verify":    {Period: 3600, PerIP: 30, PerEmail: 10},
+	"passkey":         {Period: 300, PerIP: 30},
+	"report":          {Period: 3600, PerIP: 30},
+}
+
+const (
+	defaultLockoutAttempts = 5
+	defaultLockoutBase     = time.Minute
+	defaultLockoutMax      = time.Hour
+	// failures older than this don't count towards a lockout
+	lockoutWindow = 24 * time.Hour
+)
+
+// the most of a body read to find who a request is for
+const rateLimitBodyLimit = 1 << 16
+
+type rateLimitKey struct{}
+
+// rateLimitRequest is what the limiter worked out about a request, kept so
+// handlers can record failures against the same subjects.
+type rateLimitRequest struct {
+	Route    string
+	Subjects []string
+}
+
+func (c *App) rateLimitRoute(route string) config.RateLimitRoute {
+	if limit, ok := c.Config.RateLimit.Routes[route]; ok {
+		return limit
+	}
+	return defaultRateLimits[route]
+}
+
+// rateLimitSubjects finds the account and email a request is for, from the
+// route's username param or the JSON body, which is put back for the handler.
+func rateLimitSubjects(r *http.Request) (account, email string) {
+
+	if username := chi.URLParam(r, "username"); username != "" {
+		return strings.ToLower(username), ""
+	}
+
+	if r.Body == nil {
+		return "", ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, rateLimitBodyLimit))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", ""
+	}
+
+	var p struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	json.Unmarshal(body, &p)
+
+	account = strings.ToLower(strings.TrimSpace(p.Username))
+	email = strings.ToLower(strings.TrimSpace(p.Email))
+
+	// people log in with their email too
+	if strings.Contains(account, "@") && email == "" {
+		email = account
+	}
+
+	return account, email
+}
+
+// hit counts a request against one limit and returns how long to wait when
+// it's over.
+func (c *App) hit(route, subject string, limit int, period time.Duration) int64 {
+	if limit <= 0 || period <= 0 {
+		return 0
+	}
+
+	key := fmt.Sprintf("commune:ratelimit:%s:%s", route, subject)
+
+	count, err := c.Cache.System.Incr(key).Result()
+	if err != nil {
+		// don't lock everyone out because redis is down
+		log.Println(err)
+		return 0
+	}
+
+	if count == 1 {
+		c.Cache.System.Expire(key, period)
+	}
+
+	if count <= int64(limit) {
+		return 0
+	}
+
+	retry := int64(period.Seconds())
+	ttl, err := c.Cache.System.TTL(key).Result()
+	if err == nil && ttl > 0 {
+		retry = int64(ttl.Seconds()) + 1
+	}
+
+	return retry
+}
+
+func lockoutKey(subject string) string {
+	return "commune:ratelimit:lockout:" + subject
+}
+
+func failuresKey(subject string) string {
+	return "commune:ratelimit:failures:" + subject
+}
+
+// lockedOut returns how long until the first of subjects that's locked out
+// can try again.
+func (c *App) lockedOut(subjects []string) int64 {
+	for _, subject := range subjects {
+		if strings.HasPrefix(subject, "ip:") {
+			continue
+		}
+
+		ttl, err := c.Cache.System.TTL(lockoutKey(subject)).Result()
+		if err == nil && ttl > 0 {
+			return int64(ttl.Seconds()) + 1
+		}
+	}
+	return 0
+}
+
+func (c *App) lockoutDuration(failures int64) time.Duration {
+
+	attempts := int64(c.Config.RateLimit.LockoutAttempts)
+	if attempts <= 0 {
+		attempts = defaultLockoutAttempts
+	}
+
+	if failures < attempts {
+		return 0
+	}
+
+	base := defaultLockoutBase
+	if c.Config.RateLimit.LockoutBase > 0 {
+		base = time.Duration(c.Config.RateLimit.LockoutBase) * time.Second
+	}
+
+	max := defaultLockoutMax
+	if c.Config.RateLimit.LockoutMax > 0 {
+		max = time.Duration(c.Config.RateLimit.LockoutMax) * time.Second
+	}
+
+	lockout := base
+	for i := attempts; i < failures && lockout < max; i++ {
+		lockout *= 2
+	}
+
+	if lockout > max {
+		lockout = max
+	}
+
+	return lockout
+}
+
+func requestRateLimit(r *http.Request) *rateLimitRequest {
+	req, ok := r.Context().Value(rateLimitKey{}).(*rateLimitRequest)
+	if !ok {
+		return &rateLimitRequest{}
+	}
+	return req
+}
+
+// lockable subjects of a request, IPs are shared too widely to lock out
+func lockoutSubjects(r *http.Request, extra []string) []string {
+	subjects := []string{}
+	for _, list := range [][]string{requestRateLimit(r).Subjects, extra} {
+		for _, subject := range list {
+			if !strings.HasPrefix(subject, "ip:") {
+				subjects = append(subjects, subject)
+			}
+		}
+	}
+	return subjects
+}
+
+// RecordAuthFailure counts a failed login or recovery code against the
+// request's account and email, locking them out for longer with every
+// failure past the allowed attempts.
+func (c *App) RecordAuthFailure(r *http.Request, extra ...string) {
+
+	if !c.Config.RateLimit.Enabled {
+		return
+	}
+
+	for _, subject := range lockoutSubjects(r, extra) {
+		failures, err := c.Cache.System.Incr(failuresKey(subject)).Result()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		c.Cache.System.Expire(failuresKey(subject), lockoutWindow)
+
+		if lockout := c.lockoutDuration(failures); lockout > 0 {
+			log.Println("locking out ", subject, " for ", lockout)
+			c.Cache.System.Set(lockoutKey(subject), failures, lockout)
+		}
+	}
+}
+
+// ClearAuthFailures forgets failures once someone gets it right.
+func (c *App) ClearAuthFailures(r *http.Request, extra ...string) {
+
+	if !c.Config.RateLimit.Enabled {
+		return
+	}
+
+	for _, subject := range lockoutSubjects(r, extra) {
+		c.Cache.System.Del(failuresKey(subject), lockoutKey(subject))
+	}
+}
+
+func RespondWithRateLimit(w http.ResponseWriter, retry int64, locked bool) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", retry))
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: map[string]any{
+			"error":       fmt.Sprintf("Too many attempts. Try again in %s.", plural(retry, "second")),
+			"retry_after": retry,
+			"locked":      locked,
+		},
+	})
+}
+
+// RespondIfLockedOut is for handlers that only learn who a request is for
+// after reading it. Handlers return when it returns true.
+func (c *App) RespondIfLockedOut(w http.ResponseWriter, subjects ...string) bool {
+
+	if !c.Config.RateLimit.Enabled {
+		return false
+	}
+
+	retry := c.lockedOut(subjects)
+	if retry == 0 {
+		return false
+	}
+
+	RespondWithRateLimit(w, retry, true)
+	return true
+}
+
+// RateLimit limits a route per IP, account and email, with the limits set
+// for the route in the config. Counts are kept in redis so every instance
+// shares them.
+func (c *App) RateLimit(route string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			if !c.Config.RateLimit.Enabled {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			limit := c.rateLimitRoute(route)
+			period := time.Duration(limit.Period) * time.Second
+
+			account, email := rateLimitSubjects(r)
+
+			req := &rateLimitRequest{
+				Route:    route,
+				Subjects: []string{"ip:" + requestIP(r)},
+			}
+			if account != "" {
+				req.Subjects = append(req.Subjects, "account:"+account)
+			}
+			if email != "" {
+				req.Subjects = append(req.Subjects, "email:"+email)
+			}
+
+			if retry := c.lockedOut(req.Subjects); retry > 0 {
+				RespondWithRateLimit(w, retry, true)
+				return
+			}
+
+			retry := c.hit(route, req.Subjects[0], limit.PerIP, period)
+			if retry == 0 && account != "" {
+				retry = c.hit(route, "account:"+account, limit.PerAccount, period)
+			}
+			if retry == 0 && email != "" {
+				retry = c.hit(route, "email:"+email, limit.PerEmail, period)
+			}
+
+			if retry > 0 {
+				RespondWithRateLimit(w, retry, false)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), rateLimitKey{}, req)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	config "shpong/config"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    config.RateLimit
+		failures int64
+		want     time.Duration
+	}{
+		{"no failures", config.RateLimit{}, 0, 0},
+		{"under the default attempts", config.RateLimit{}, 4, 0},
+		{"at the default attempts", config.RateLimit{}, 5, time.Minute},
+		{"doubles past the attempts", config.RateLimit{}, 6, 2 * time.Minute},
+		{"keeps doubling", config.RateLimit{}, 8, 8 * time.Minute},
+		{"capped at the default max", config.RateLimit{}, 11, time.Hour},
+		{"stays at the max", config.RateLimit{}, 100, time.Hour},
+
+		{"under configured attempts", config.RateLimit{LockoutAttempts: 3}, 2, 0},
+		{"at configured attempts", config.RateLimit{LockoutAttempts: 3, LockoutBase: 10}, 3, 10 * time.Second},
+		{"configured doubling", config.RateLimit{LockoutAttempts: 3, LockoutBase: 10}, 5, 40 * time.Second},
+		{"capped at configured max", config.RateLimit{LockoutAttempts: 3, LockoutBase: 10, LockoutMax: 60}, 6, time.Minute},
+		{"max below base", config.RateLimit{LockoutBase: 120, LockoutMax: 60}, 5, time.Minute},
+	}
+
+	for _, tt := range tests {
+		c := &App{Config: &config.Config{RateLimit: tt.limit}}
+
+		got := c.lockoutDuration(tt.failures)
+		if got != tt.want {
+			t.Errorf("%s: lockoutDuration(%d) = %s, want %s", tt.name, tt.failures, got, tt.want)
+		}
+	}
+}
@@ -65,6 +65,13 @@ func (c *App) RedactPost() http.HandlerFunc {
 
 		user := c.LoggedInUser(r)
 
+		// redacting someone else's post is moderation
+		target, err := c.MatrixDB.Queries.GetReportTarget(context.Background(), p.EventID)
+		if err != nil {
+			log.Println(err)
+		}
+		moderated := target.Sender.Valid && target.Sender.String != user.MatrixUserID
+
 		resp, err := c.RedactEvent(&RedactEventParams{
 			RoomID:            p.RoomID,
 			EventID:           p.EventID,
@@ -84,13 +91,18 @@ func (c *App) RedactPost() http.HandlerFunc {
 			return
 		}
 
-		if p.IsReply {
-			go func() {
-				_, err = c.MatrixDB.Exec(context.Background(), `REFRESH MATERIALIZED VIEW CONCURRENTLY reply_count`)
-				if err != nil {
-					log.Panicln(err)
-				}
-			}()
+		if moderated {
+			c.Audit(&AuditEntry{
+				Actor:        user.MatrixUserID,
+				Action:       AuditRedact,
+				TargetUserID: target.Sender.String,
+				Target:       p.EventID,
+				SpaceRoomID:  target.SpaceRoomID,
+				Reason:       p.Reason,
+				Details: map[string]any{
+					"room_id": p.RoomID,
+				},
+			})
 		}
 
 		RespondWithJSON(w, &JSONResponse{
@@ -0,0 +1,529 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+	"shpong/gomatrix"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// what people can report something for
+var reportCategories = map[string]bool{
+	"spam":       true,
+	"harassment": true,
+	"hate":       true,
+	"violence":   true,
+	"sexual":     true,
+	"illegal":    true,
+	"self_harm":  true,
+	"other":      true,
+}
+
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportRedacted  = "redacted"
+	ReportKicked    = "kicked"
+	ReportBanned    = "banned"
+	ReportSuspended = "suspended"
+)
+
+// the status a report gets for each way of resolving it
+var reportActions = map[string]string{
+	"dismiss": ReportDismissed,
+	"redact":  ReportRedacted,
+	"kick":    ReportKicked,
+	"ban":     ReportBanned,
+	"suspend": ReportSuspended,
+}
+
+const defaultModeratorPowerLevel = 50
+
+func reportTargetType(eventType string) string {
+	switch eventType {
+	case "space.board.post":
+		return "post"
+	case "space.board.post.reply":
+		return "reply"
+	case "m.room.message":
+		return "message"
+	}
+	return "event"
+}
+
+func (c *App) matrixClient(user *User) (*gomatrix.Client, error) {
+	serverName := c.URLScheme(c.Config.Matrix.Homeserver) + fmt.Sprintf(`:%d`, c.Config.Matrix.Port)
+	return gomatrix.NewClient(serverName, user.MatrixUserID, user.MatrixAccessToken)
+}
+
+// SpacePowerLevel is the user's power level in the space room.
+func (c *App) SpacePowerLevel(space, matrixUserID string) int64 {
+
+	alias := strings.ToLower(c.ConstructMatrixRoomID(space))
+
+	pl, err := c.MatrixDB.Queries.GetSpacePowerLevels(context.Background(), alias)
+	if err != nil {
+		return 0
+	}
+
+	var levels struct {
+		Space map[string]int64 `json:"space"`
+	}
+	err = json.Unmarshal(pl, &levels)
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+
+	return levels.Space[matrixUserID]
+}
+
+// SpaceModerator returns the room ID of the space when the user can
+// moderate it.
+func (c *App) SpaceModerator(space string, user *User) (string, bool) {
+
+	space = strings.ToLower(space)
+
+	roomID, err := c.MatrixDB.Queries.DoesDefaultSpaceExist(context.Background(), c.ConstructMatrixRoomID(space))
+	if err != nil {
+		return "", false
+	}
+
+	if user.Admin {
+		return roomID, true
+	}
+
+	level := int64(c.Config.Moderation.ModeratorPowerLevel)
+	if level <= 0 {
+		level = defaultModeratorPowerLevel
+	}
+
+	return roomID, c.SpacePowerLevel(space, user.MatrixUserID) >= level
+}
+
+type NewReportParams struct {
+	Reporter     string
+	TargetType   string
+	TargetUserID string
+	EventID      string
+	RoomID       string
+	SpaceRoomID  string
+	Category     string
+	Reason       string
+}
+
+func (c *App) CreateReport(p *NewReportParams) error {
+
+	if p.Reporter == p.TargetUserID {
+		return errors.New("can't report yourself")
+	}
+
+	// reporting the same thing twice doesn't count twice
+	open, err := c.MatrixDB.Queries.HasOpenReport(context.Background(), matrix_db.HasOpenReportParams{
+		Reporter:     p.Reporter,
+		TargetUserID: p.TargetUserID,
+		EventID:      p.EventID,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	if open {
+		return nil
+	}
+
+	return c.MatrixDB.Queries.CreateReport(context.Background(), matrix_db.CreateReportParams{
+		ID:           RandomString(24),
+		Reporter:     p.Reporter,
+		TargetType:   p.TargetType,
+		TargetUserID: p.TargetUserID,
+		EventID:      p.EventID,
+		RoomID:       p.RoomID,
+		SpaceRoomID:  p.SpaceRoomID,
+		Category:     p.Category,
+		Reason:       p.Reason,
+		CreatedAt:    time.Now().UnixMilli(),
+	})
+}
+
+func readReport(r *http.Request, w http.ResponseWriter) (category, reason string, ok bool) {
+
+	p, err := ReadRequestJSON(r, w, &struct {
+		Category string `json:"category"`
+		Reason   string `json:"reason"`
+	}{})
+	if err != nil || !reportCategories[p.Category] {
+		return "", "", false
+	}
+
+	// cut on a character, half of one isn't valid UTF-8
+	reason = strings.TrimSpace(p.Reason)
+	if runes := []rune(reason); len(runes) > 1000 {
+		reason = string(runes[:1000])
+	}
+
+	return p.Category, reason, true
+}
+
+func respondReported(w http.ResponseWriter, err error) {
+	if err != nil {
+		log.Println(err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error":    "could not report",
+				"reported": false,
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"reported": true,
+		},
+	})
+}
+
+// ReportEvent reports a post, reply or chat message to the moderators of
+// the space it's in.
+func (c *App) ReportEvent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		category, reason, ok := readReport(r, w)
+		if !ok {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		eventID := chi.URLParam(r, "event")
+
+		target, err := c.MatrixDB.Queries.GetReportTarget(context.Background(), eventID)
+		if err != nil || !target.Sender.Valid {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":    "event not found",
+					"reported": false,
+				},
+			})
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		err = c.CreateReport(&NewReportParams{
+			Reporter:     user.MatrixUserID,
+			TargetType:   reportTargetType(target.Type),
+			TargetUserID: target.Sender.String,
+			EventID:      eventID,
+			RoomID:       target.RoomID,
+			SpaceRoomID:  target.SpaceRoomID,
+			Category:     category,
+			Reason:       reason,
+		})
+
+		respondReported(w, err)
+	}
+}
+
+// ReportProfile reports a user. Profiles aren't part of a space, so only
+// admins see these.
+func (c *App) ReportProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		category, reason, ok := readReport(r, w)
+		if !ok {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		username := strings.ToLower(strings.TrimPrefix(chi.URLParam(r, "alias"), "@"))
+
+		_, err := c.MatrixDB.Queries.GetProfile(context.Background(), username)
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":    "user not found",
+					"reported": false,
+				},
+			})
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		err = c.CreateReport(&NewReportParams{
+			Reporter:     user.MatrixUserID,
+			TargetType:   "profile",
+			TargetUserID: fmt.Sprintf("@%s:%s", username, c.Config.Matrix.PublicServer),
+			Category:     category,
+			Reason:       reason,
+		})
+
+		respondReported(w, err)
+	}
+}
+
+// ResolveReport does what the moderator chose and closes every open report
+// of the same target.
+func (c *App) ResolveReport(user *User, report *matrix_db.CommuneReport, action, note string) error {
+
+	status, ok := reportActions[action]
+	if !ok {
+		return errors.New("unknown action")
+	}
+
+	// kicks and bans apply to the space and the room the event was in
+	rooms := []string{}
+	for _, room := range []string{report.SpaceRoomID, report.RoomID} {
+		if room != "" && (len(rooms) == 0 || rooms[0] != room) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	switch status {
+	case ReportRedacted:
+		if report.EventID == "" {
+			return errors.New("there's nothing to redact")
+		}
+
+		_, err := c.RedactEvent(&RedactEventParams{
+			RoomID:            report.RoomID,
+			EventID:           report.EventID,
+			Reason:            note,
+			MatrixUserID:      user.MatrixUserID,
+			MatrixAccessToken: user.MatrixAccessToken,
+		})
+		if err != nil {
+			return err
+		}
+
+	case ReportKicked, ReportBanned:
+		if len(rooms) == 0 {
+			return errors.New("the user isn't in a space")
+		}
+
+		_, err := c.Moderate(user, &ModerationParams{
+			Action: action,
+			UserID: report.TargetUserID,
+			Reason: note,
+			Rooms:  rooms,
+		})
+		if err != nil {
+			return err
+		}
+
+	case ReportSuspended:
+		if !user.Admin {
+			return errors.New("only admins can suspend users")
+		}
+
+		err := c.SuspendMatrixUser(report.TargetUserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Audit(&AuditEntry{
+		Actor:        user.MatrixUserID,
+		Action:       AuditResolveReport,
+		TargetUserID: report.TargetUserID,
+		Target:       report.EventID,
+		SpaceRoomID:  report.SpaceRoomID,
+		Reason:       note,
+		Details: map[string]any{
+			"report": report.ID,
+			"status": status,
+		},
+	})
+
+	_, err := c.MatrixDB.Queries.ResolveReports(context.Background(), matrix_db.ResolveReportsParams{
+		TargetUserID: report.TargetUserID,
+		EventID:      report.EventID,
+		Status:       status,
+		ResolvedBy:   user.MatrixUserID,
+		ResolvedAt:   time.Now().UnixMilli(),
+		Note:         note,
+	})
+
+	return err
+}
+
+func (c *App) resolveReportRequest(w http.ResponseWriter, r *http.Request, user *User, report *matrix_db.CommuneReport) {
+
+	p, err := ReadRequestJSON(r, w, &struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}{})
+	if err != nil {
+		RespondWithBadRequestError(w)
+		return
+	}
+
+	if report.Status != ReportOpen {
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error":  "report is already resolved",
+				"status": report.Status,
+			},
+		})
+		return
+	}
+
+	err = c.ResolveReport(user, report, p.Action, p.Note)
+	if err != nil {
+		log.Println("error resolving report: ", err)
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error":    err.Error(),
+				"resolved": false,
+			},
+		})
+		return
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"resolved": true,
+			"status":   reportActions[p.Action],
+		},
+	})
+}
+
+func respondNotModerator(w http.ResponseWriter) {
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"error": "Not authorized.",
+		},
+	})
+}
+
+func (c *App) SpaceReports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := c.SpaceModerator(chi.URLParam(r, "space"), user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		reports, err := c.MatrixDB.Queries.GetSpaceReports(context.Background(), roomID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get reports",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"reports": reports,
+			},
+		})
+	}
+}
+
+func (c *App) ResolveSpaceReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		roomID, ok := c.SpaceModerator(chi.URLParam(r, "space"), user)
+		if !ok {
+			respondNotModerator(w)
+			return
+		}
+
+		report, err := c.MatrixDB.Queries.GetReport(context.Background(), chi.URLParam(r, "id"))
+		if err != nil || report.SpaceRoomID != roomID {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "report not found",
+				},
+			})
+			return
+		}
+
+		c.resolveReportRequest(w, r, user, &report)
+	}
+}
+
+// InstanceReports is every open report, for admins.
+func (c *App) InstanceReports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			respondNotModerator(w)
+			return
+		}
+
+		reports, err := c.MatrixDB.Queries.GetInstanceReports(context.Background())
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get reports",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"reports": reports,
+			},
+		})
+	}
+}
+
+func (c *App) ResolveInstanceReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if !user.Admin {
+			respondNotModerator(w)
+			return
+		}
+
+		report, err := c.MatrixDB.Queries.GetReport(context.Background(), chi.URLParam(r, "id"))
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "report not found",
+				},
+			})
+			return
+		}
+
+		c.resolveReportRequest(w, r, user, &report)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
@@ -23,7 +24,9 @@ func (c *App) Routes() {
 		return w
 	})
 
-	// c.Router.Use(middleware.ThrottleBacklog(10, 50, time.Second*10))
+	if c.Config.RateLimit.Throttle > 0 {
+		c.Router.Use(middleware.ThrottleBacklog(c.Config.RateLimit.Throttle, c.Config.RateLimit.ThrottleBacklog, time.Second*10))
+	}
 	c.Router.Use(middleware.RequestID)
 	c.Router.Use(middleware.RealIP)
 	c.Router.Use(middleware.Logger)
@@ -54,7 +57,9 @@ func ShortlinkDomain(c *App) chi.Router {
 
 	r.Use(compressor.Handler)
 	r.Use(c.GetAuthSession)
+	r.Use(c.RequireMembership)
 
+	r.Get("/robots.txt", c.RobotsTXT())
 	r.Get("/{event}", c.ResolveShortlink())
 	r.Get("/", c.RedirectHome())
 
@@ -73,7 +78,9 @@ func SSRDomain(c *App) chi.Router {
 
 	r.Use(compressor.Handler)
 	r.Use(c.GetAuthSession)
+	r.Use(c.RequireMembership)
 
+	r.Get("/robots.txt", c.RobotsTXT())
 	r.Get("/", c.Index())
 
 	r.NotFound(c.NotFound)
@@ -93,6 +100,7 @@ func routes(c *App) chi.Router {
 
 	r := chi.NewRouter()
 	r.Use(c.GetAuthorizationToken)
+	r.Use(c.RequireMembership)
 
 	r.Route("/robots.txt", func(r chi.Router) {
 		r.Get("/", c.RobotsTXT())
@@ -112,53 +120,126 @@ func routes(c *App) chi.Router {
 
 	r.Route("/admin", func(r chi.Router) {
 		r.Use(c.RequireAuthentication)
+		r.Use(c.RequireTwoFactor)
 		r.Put("/user/suspend", c.SuspendUser())
 		r.Put("/event/pin", c.PinEventToIndex())
 		r.Put("/event/unpin", c.UnpinIndexEvent())
+		r.Get("/invites", c.AllInviteCodes())
+		r.Post("/invites", c.CreateInviteCode())
+		r.Put("/invites/revoke", c.RevokeInviteCode())
+		r.Get("/reports", c.InstanceReports())
+		r.Put("/reports/{id}", c.ResolveInstanceReport())
+		r.Get("/audit", c.AuditLog())
+		r.Get("/policy_lists", c.PolicySubscriptions(c.InstancePolicyScope))
+		r.Post("/policy_lists", c.SubscribePolicyList(c.InstancePolicyScope))
+		r.Delete("/policy_lists", c.UnsubscribePolicyList(c.InstancePolicyScope))
+		r.Get("/filters", c.ContentFilters(c.InstanceFilterScope))
+		r.Put("/filters", c.UpdateContentFilters(c.InstanceFilterScope))
+		r.Get("/held", c.InstanceHeldPosts())
+		r.Put("/held/{id}", c.ReviewInstanceHeldPost())
 	})
 
-	r.HandleFunc("/admin/*", c.MatrixAdminProxy())
+	r.With(c.RequireTwoFactor).HandleFunc("/admin/*", c.MatrixAdminProxy())
 
 	r.Route("/account", func(r chi.Router) {
 		r.Use(secureMiddleware.Handler)
-		r.Post("/login", c.ValidateLogin())
+		r.With(c.RateLimit("login")).Post("/login", c.ValidateLogin())
+		r.With(c.RateLimit("login_2fa")).Post("/login/2fa", c.ValidateTwoFactorLogin())
+		r.With(c.RateLimit("login_2fa")).Post("/login/2fa/passkey", c.BeginPasskeyTwoFactor())
+		r.With(c.RateLimit("login_2fa")).Post("/login/2fa/passkey/finish", c.FinishPasskeyTwoFactor())
+		r.Route("/passkeys", func(r chi.Router) {
+			r.With(c.RateLimit("passkey")).Post("/login", c.BeginPasskeyLogin())
+			r.With(c.RateLimit("passkey")).Post("/login/finish", c.FinishPasskeyLogin())
+			r.Group(func(r chi.Router) {
+				r.Use(c.RequireAuthentication)
+				r.Get("/", c.Passkeys())
+				r.Post("/register", c.BeginPasskeyRegistration())
+				r.Post("/register/finish", c.FinishPasskeyRegistration())
+				r.Delete("/{id}", c.DeletePasskey())
+			})
+		})
 		r.Get("/logout", c.Logout())
 		r.Get("/session", c.ValidateSession())
 		r.Post("/token", c.ValidateToken())
 		r.Route("/password", func(r chi.Router) {
-			r.Post("/", c.SendRecoveryCode())
-			r.Post("/verify", c.VerifyRecoveryCode())
-			r.Post("/reset", c.ResetPassword())
+			r.With(c.RateLimit("password")).Post("/", c.SendRecoveryCode())
+			r.With(c.RateLimit("password_verify")).Post("/verify", c.VerifyRecoveryCode())
+			r.With(c.RateLimit("password_verify")).Post("/reset", c.ResetPassword())
 			r.Post("/update", c.UpdatePassword())
 		})
 		r.Route("/", func(r chi.Router) {
-			r.Post("/verify/code", c.SendCode())
+			r.With(c.RateLimit("verify_code")).Post("/verify/code", c.SendCode())
 			r.Post("/verify", c.VerifyCode())
 			r.Post("/verify/email", c.VerifyEmail())
 			r.Route("/", func(r chi.Router) {
 				r.Use(c.RequireAuthentication)
 				r.Post("/display_name", c.UpdateDisplayName())
 				r.Post("/avatar", c.UpdateAvatar())
+				r.Route("/2fa", func(r chi.Router) {
+					r.Get("/", c.TwoFactorStatus())
+					r.Post("/setup", c.SetupTwoFactor())
+					r.Post("/enable", c.EnableTwoFactor())
+					r.Post("/disable", c.DisableTwoFactor())
+					r.Post("/recovery_codes", c.RegenerateRecoveryCodes())
+				})
+				r.Route("/sessions", func(r chi.Router) {
+					r.Get("/", c.UserSessions())
+					r.Delete("/{id}", c.RevokeUserSession())
+				})
+				r.Route("/emails", func(r chi.Router) {
+					r.Get("/", c.UserEmails())
+					r.With(c.RateLimit("email")).Post("/", c.AddEmail())
+					r.With(c.RateLimit("email_verify")).Post("/verify", c.VerifyNewEmail())
+					r.Put("/primary", c.SetPrimaryEmail())
+					r.Delete("/", c.RemoveEmail())
+				})
+				r.Route("/export", func(r chi.Router) {
+					r.Get("/", c.DataExports())
+					r.Post("/", c.CreateDataExport())
+					r.Get("/{id}", c.DownloadDataExport())
+				})
+				r.Route("/delete", func(r chi.Router) {
+					r.Get("/", c.AccountDeletion())
+					r.Post("/", c.DeleteAccount())
+					r.Delete("/", c.CancelAccountDeletion())
+				})
 			})
 		})
 		r.Route("/notifications", func(r chi.Router) {
 			r.Get("/sync", c.SyncNotifications())
+			r.Get("/unsubscribe", c.UnsubscribeDigest())
+			r.Post("/unsubscribe", c.UnsubscribeDigest())
 			r.Route("/", func(r chi.Router) {
 				r.Use(c.RequireAuthentication)
 				r.Get("/", c.GetNotifications())
 				r.Put("/read", c.MarkRead())
+				r.Put("/read/all", c.MarkAllRead())
+				r.Get("/unread", c.UnreadNotifications())
+				r.Get("/settings", c.NotificationSettings())
+				r.Put("/settings", c.UpdateNotificationSettings())
+				r.Get("/digest", c.DigestSettings())
+				r.Put("/digest", c.UpdateDigestSettings())
+			})
+		})
+
+		r.Route("/invites", func(r chi.Router) {
+			r.With(c.RateLimit("invites")).Get("/{code}", c.InviteCodeValid())
+			r.Route("/", func(r chi.Router) {
+				r.Use(c.RequireAuthentication)
+				r.Get("/", c.UserInviteCodes())
+				r.Post("/", c.CreateInviteCode())
 			})
 		})
 
 		r.Route("/username", func(r chi.Router) {
-			r.Get("/{username}", c.UsernameAvailable())
+			r.With(c.RateLimit("username")).Get("/{username}", c.UsernameAvailable())
 		})
 		r.Route("/email", func(r chi.Router) {
 			r.Get("/{email}", c.ValidateEmail())
 		})
 		r.Route("/oauth", func(r chi.Router) {
-			r.Post("/discord/validate", c.ValidateOauthDiscord())
-			r.Post("/github/validate", c.ValidateOauthGithub())
+			r.Get("/{provider}/start", c.StartOauth())
+			r.Post("/{provider}/validate", c.ValidateOauth())
 		})
 		r.Post("/", c.CreateAccount())
 	})
@@ -192,12 +273,6 @@ func routes(c *App) chi.Router {
 		//r.Get("/{room}", c.RoomEvents())
 	})
 
-	r.Route("/sync", func(r chi.Router) {
-		r.Route("/", func(r chi.Router) {
-			//r.Get("/", c.SyncEvents())
-		})
-	})
-
 	r.Route("/link", func(r chi.Router) {
 		r.Get("/metadata", c.FetchLinkMetadata())
 	})
@@ -214,11 +289,12 @@ func routes(c *App) chi.Router {
 		r.Route("/", func(r chi.Router) {
 			r.Use(c.RequireAuthentication)
 			r.Post("/", c.CreatePost())
-			r.Post("/state", c.CreateStateEvent())
+			r.With(c.RequireTwoFactor).Post("/state", c.CreateStateEvent())
 			r.Post("/redact", c.RedactPost())
 			r.Post("/redact/reaction", c.RedactReaction())
 			r.Put("/upvote", c.Upvote())
 			r.Put("/downvote", c.Downvote())
+			r.With(c.RateLimit("report")).Post("/{event}/report", c.ReportEvent())
 		})
 		r.Get("/{event}/thread", c.EventThread())
 		r.Get("/{event}/replies", c.EventReplies())
@@ -241,6 +317,7 @@ func routes(c *App) chi.Router {
 	})
 	r.Route("/profile", func(r chi.Router) {
 		r.Get("/{alias}", c.ProfileInfo())
+		r.With(c.RequireAuthentication, c.RateLimit("report")).Post("/{alias}/report", c.ReportProfile())
 	})
 
 	r.Route("/space", func(r chi.Router) {
@@ -248,8 +325,26 @@ func routes(c *App) chi.Router {
 		r.Post("/{space}/join", c.JoinSpace())
 		r.Post("/{space}/leave", c.LeaveSpace())
 		r.Post("/create", c.CreateSpace())
-		r.Post("/room/create", c.CreateSpaceRoom())
+		r.With(c.RequireTwoFactor).Post("/room/create", c.CreateSpaceRoom())
 		r.Get("/emoji", c.GetSpaceEmoji())
+		r.Get("/{space}/reports", c.SpaceReports())
+		r.Put("/{space}/reports/{id}", c.ResolveSpaceReport())
+		r.Get("/{space}/audit", c.SpaceAuditLog())
+		r.Get("/{space}/policy_lists", c.PolicySubscriptions(c.SpacePolicyScope))
+		r.Post("/{space}/policy_lists", c.SubscribePolicyList(c.SpacePolicyScope))
+		r.Delete("/{space}/policy_lists", c.UnsubscribePolicyList(c.SpacePolicyScope))
+		r.Get("/{space}/filters", c.ContentFilters(c.SpaceFilterScope))
+		r.Put("/{space}/filters", c.UpdateContentFilters(c.SpaceFilterScope))
+		r.Get("/{space}/held", c.SpaceHeldPosts())
+		r.Put("/{space}/held/{id}", c.ReviewSpaceHeldPost())
+		r.Route("/{space}/moderation", func(r chi.Router) {
+			r.Get("/bans", c.SpaceBans())
+			r.Post("/kick", c.ModerateSpace(ModerationKick))
+			r.Post("/ban", c.ModerateSpace(ModerationBan))
+			r.Post("/unban", c.ModerateSpace(ModerationUnban))
+			r.Post("/mute", c.ModerateSpace(ModerationMute))
+			r.Post("/unmute", c.ModerateSpace(ModerationUnmute))
+		})
 	})
 
 	r.Route("/{space}", func(r chi.Router) {
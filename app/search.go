@@ -113,3 +113,32 @@ func (c *App) SearchEvents() http.HandlerFunc {
 
 	}
 }
+
+// IndexEvents adds new board posts to the search index.
+func (c *App) IndexEvents(sub *Subscription) {
+	for msg := range sub.C {
+		en, ok := msg.(*EventNotification)
+		if !ok || en.Event == nil || en.Type != "space.board.post" {
+			continue
+		}
+
+		if !c.Fanout.Claim("search", en.EventID) {
+			continue
+		}
+
+		co, ok := en.Event.Content.(map[string]interface{})
+		if !ok {
+			log.Println("couldn't index event", en.EventID)
+			continue
+		}
+
+		c.AddSearchEvent(map[string]interface{}{
+			"id":         RandomString(32),
+			"event":      en.Event.EventID,
+			"room":       en.Event.RoomID,
+			"room_alias": en.Event.RoomAlias,
+			"title":      co["title"],
+			"body":       co["body"],
+		})
+	}
+}
@@ -1,10 +1,18 @@
 package app
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
 )
 
@@ -44,8 +52,139 @@ func GetSession(r *http.Request, c *App) (*sessions.Session, error) {
 	return s, nil
 }
 
+// SessionInfo is what a user sees about one of their sessions. The ID is
+// derived from the token so sessions can be named without exposing it.
+type SessionInfo struct {
+	ID        string `json:"id"`
+	DeviceID  string `json:"device_id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+	LastSeen  int64  `json:"last_seen"`
+	Current   bool   `json:"current"`
+}
+
+// sessionRecord is kept per token in the user's sessions hash. It keeps the
+// Matrix token so the device can be logged out after the session expires.
+type sessionRecord struct {
+	SessionInfo
+	MatrixAccessToken string `json:"matrix_access_token"`
+}
+
+// how often last seen is written back, so every request isn't a write
+const sessionTouchInterval = time.Minute
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func sessionsKey(matrixUserID string) string {
+	return "sessions:" + matrixUserID
+}
+
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (c *App) sessionExpired(rec *sessionRecord, now time.Time) bool {
+	if c.Config.Authentication.SessionLifetime > 0 {
+		lifetime := time.Duration(c.Config.Authentication.SessionLifetime) * time.Hour
+		if now.Sub(time.UnixMilli(rec.CreatedAt)) >= lifetime {
+			return true
+		}
+	}
+	if c.Config.Authentication.SessionIdleTimeout > 0 {
+		idle := time.Duration(c.Config.Authentication.SessionIdleTimeout) * time.Hour
+		if now.Sub(time.UnixMilli(rec.LastSeen)) >= idle {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionTTL is how long a session has left from now, whichever of the idle
+// timeout and the absolute lifetime comes first. Zero means it never expires.
+func (c *App) sessionTTL(rec *sessionRecord, now time.Time) time.Duration {
+	var ttl time.Duration
+
+	if c.Config.Authentication.SessionIdleTimeout > 0 {
+		ttl = time.Duration(c.Config.Authentication.SessionIdleTimeout) * time.Hour
+	}
+
+	if c.Config.Authentication.SessionLifetime > 0 {
+		lifetime := time.Duration(c.Config.Authentication.SessionLifetime) * time.Hour
+		remaining := time.UnixMilli(rec.CreatedAt).Add(lifetime).Sub(now)
+		if ttl == 0 || remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	// a negative ttl would keep the key forever
+	if ttl < 0 {
+		ttl = time.Second
+	}
+
+	return ttl
+}
+
+func (c *App) getSessionRecord(matrixUserID, token string) (*sessionRecord, error) {
+	serialized, err := c.SessionsStore.HGet(sessionsKey(matrixUserID), token).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var rec sessionRecord
+	err = json.Unmarshal([]byte(serialized), &rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func (c *App) setSessionRecord(matrixUserID, token string, rec *sessionRecord) error {
+	serialized, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return c.SessionsStore.HSet(sessionsKey(matrixUserID), token, serialized).Err()
+}
+
+// CreateUserSession stores a new session for a user who just logged in,
+// recording the device and where they logged in from.
+func (c *App) CreateUserSession(r *http.Request, u *User) error {
+
+	now := time.Now().UnixMilli()
+
+	err := c.setSessionRecord(u.MatrixUserID, u.AccessToken, &sessionRecord{
+		SessionInfo: SessionInfo{
+			ID:        sessionID(u.AccessToken),
+			DeviceID:  u.MatrixDeviceID,
+			IP:        requestIP(r),
+			UserAgent: r.UserAgent(),
+			CreatedAt: now,
+			LastSeen:  now,
+		},
+		MatrixAccessToken: u.MatrixAccessToken,
+	})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return c.StoreUserSession(u)
+}
+
+// StoreUserSession saves the user behind a session token. It's also used to
+// update the user after profile changes, so it keeps the session's expiry.
 func (c *App) StoreUserSession(u *User) error {
-	log.Println("creating session for user: ", u)
+	log.Println("storing session for user: ", u.MatrixUserID)
 
 	serialized, err := json.Marshal(u)
 	if err != nil {
@@ -53,76 +192,216 @@ func (c *App) StoreUserSession(u *User) error {
 		return err
 	}
 
-	err = c.SessionsStore.Set(u.AccessToken, serialized, 0).Err()
+	now := time.Now()
+
+	rec, err := c.getSessionRecord(u.MatrixUserID, u.AccessToken)
+	if err != nil {
+		// sessions from before sessions were tracked start their clock now
+		rec = &sessionRecord{
+			SessionInfo: SessionInfo{
+				ID:        sessionID(u.AccessToken),
+				DeviceID:  u.MatrixDeviceID,
+				CreatedAt: now.UnixMilli(),
+				LastSeen:  now.UnixMilli(),
+			},
+			MatrixAccessToken: u.MatrixAccessToken,
+		}
+		err = c.setSessionRecord(u.MatrixUserID, u.AccessToken, rec)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	err = c.SessionsStore.Set(u.AccessToken, serialized, c.sessionTTL(rec, now)).Err()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	list := []string{u.AccessToken}
+	return nil
+}
 
-	{
-		tokens, err := c.SessionsStore.Get(u.MatrixUserID).Result()
+// GetUserSessions lists a user's live sessions, newest first, dropping any
+// that have expired.
+func (c *App) GetUserSessions(matrixUserID string) ([]*SessionInfo, error) {
 
+	records, err := c.SessionsStore.HGetAll(sessionsKey(matrixUserID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sessions := []*SessionInfo{}
+
+	for token, serialized := range records {
+		var rec sessionRecord
+		err := json.Unmarshal([]byte(serialized), &rec)
 		if err != nil {
+			log.Println(err)
+			continue
+		}
 
-			serialized, err := json.Marshal(list)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
+		exists, err := c.SessionsStore.Exists(token).Result()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 
-			err = c.SessionsStore.Set(u.MatrixUserID, serialized, 0).Err()
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-		} else {
+		if exists == 0 || c.sessionExpired(&rec, now) {
+			c.expireSession(matrixUserID, token)
+			continue
+		}
 
-			var us []string
-			err = json.Unmarshal([]byte(tokens), &us)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
+		info := rec.SessionInfo
+		sessions = append(sessions, &info)
+	}
 
-			us = append(us, u.AccessToken)
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt > sessions[j].CreatedAt
+	})
 
-			serialized, err := json.Marshal(us)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
+	return sessions, nil
+}
 
-			err = c.SessionsStore.Set(u.MatrixUserID, serialized, 0).Err()
-			if err != nil {
-				log.Println(err)
-				return err
-			}
+// RevokeSession ends a session and logs out its Matrix device.
+func (c *App) RevokeSession(matrixUserID, token string) error {
 
-		}
+	rec, err := c.getSessionRecord(matrixUserID, token)
+	if err == nil && rec.MatrixAccessToken != "" {
+		c.logoutMatrixDevice(&User{
+			MatrixUserID:      matrixUserID,
+			MatrixAccessToken: rec.MatrixAccessToken,
+		})
+	}
 
+	err = c.SessionsStore.Del(token).Err()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	err = c.SessionsStore.HDel(sessionsKey(matrixUserID), token).Err()
+	if err != nil {
+		log.Println(err)
+		return err
 	}
 
 	return nil
 }
 
-func (c *App) PurgeUserSessions(u string) error {
+func (c *App) expireSession(matrixUserID, token string) {
+	log.Println("session expired for user: ", matrixUserID)
+	err := c.RevokeSession(matrixUserID, token)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// touchSession keeps an active session alive and ends it once it has
+// outlived its absolute lifetime.
+func (c *App) touchSession(u *User) error {
 
-	tokens, err := c.SessionsStore.Get(u).Result()
+	now := time.Now()
+
+	rec, err := c.getSessionRecord(u.MatrixUserID, u.AccessToken)
+	if err != nil {
+		// untracked session, storing it starts tracking it
+		return c.StoreUserSession(u)
+	}
+
+	if c.sessionExpired(rec, now) {
+		c.expireSession(u.MatrixUserID, u.AccessToken)
+		return errors.New("session expired")
+	}
+
+	if now.Sub(time.UnixMilli(rec.LastSeen)) < sessionTouchInterval {
+		return nil
+	}
+
+	rec.LastSeen = now.UnixMilli()
+
+	err = c.setSessionRecord(u.MatrixUserID, u.AccessToken, rec)
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil
+	}
+
+	if ttl := c.sessionTTL(rec, now); ttl > 0 {
+		c.SessionsStore.Expire(u.AccessToken, ttl)
+	}
+
+	return nil
+}
+
+// StartSessionSweeper logs out the Matrix devices of sessions that expired
+// without anyone using them again.
+func (c *App) StartSessionSweeper() {
+
+	if c.Config.Authentication.SessionIdleTimeout <= 0 &&
+		c.Config.Authentication.SessionLifetime <= 0 {
+		return
 	}
 
-	var us []string
-	err = json.Unmarshal([]byte(tokens), &us)
+	_, err := c.Cron.AddFunc("@hourly", c.SweepSessions)
+	if err != nil {
+		log.Println("error scheduling session sweeper: ", err)
+		return
+	}
+
+	c.Cron.Start()
+}
+
+func (c *App) SweepSessions() {
+
+	now := time.Now()
+
+	if !c.Fanout.Claim("sessions", now.Truncate(time.Minute).Format(time.RFC3339)) {
+		return
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := c.SessionsStore.Scan(cursor, sessionsKey("*"), 100).Result()
+		if err != nil {
+			log.Println("error sweeping sessions: ", err)
+			return
+		}
+
+		for _, key := range keys {
+			_, err := c.GetUserSessions(strings.TrimPrefix(key, sessionsKey("")))
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+func (c *App) PurgeUserSessions(u string) error {
+
+	tokens, err := c.SessionsStore.HKeys(sessionsKey(u)).Result()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	for _, token := range us {
+	// sessions stored before they were tracked are listed under the user ID
+	legacy, err := c.SessionsStore.Get(u).Result()
+	if err == nil {
+		var us []string
+		err = json.Unmarshal([]byte(legacy), &us)
+		if err != nil {
+			log.Println(err)
+		}
+		tokens = append(tokens, us...)
+	}
+
+	for _, token := range tokens {
 		err = c.SessionsStore.Del(token).Err()
 		if err != nil {
 			log.Println(err)
@@ -130,7 +409,7 @@ func (c *App) PurgeUserSessions(u string) error {
 		}
 	}
 
-	err = c.SessionsStore.Del(u).Err()
+	err = c.SessionsStore.Del(u, sessionsKey(u)).Err()
 	if err != nil {
 		log.Println(err)
 		return err
@@ -141,7 +420,12 @@ func (c *App) PurgeUserSessions(u string) error {
 
 func (c *App) PurgeSession(u string) error {
 
-	err := c.SessionsStore.Del(u).Err()
+	user, err := c.getTokenUser(u)
+	if err == nil {
+		return c.RevokeSession(user.MatrixUserID, u)
+	}
+
+	err = c.SessionsStore.Del(u).Err()
 	if err != nil {
 		log.Println(err)
 		return err
@@ -150,11 +434,10 @@ func (c *App) PurgeSession(u string) error {
 	return nil
 }
 
-func (c *App) GetTokenUser(token string) (*User, error) {
+func (c *App) getTokenUser(token string) (*User, error) {
 
 	user, err := c.SessionsStore.Get(token).Result()
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
@@ -166,5 +449,99 @@ func (c *App) GetTokenUser(token string) (*User, error) {
 	}
 
 	return &us, nil
+}
+
+func (c *App) GetTokenUser(token string) (*User, error) {
+
+	user, err := c.getTokenUser(token)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	err = c.touchSession(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+
+}
+
+func (c *App) UserSessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
+		user := c.LoggedInUser(r)
+
+		sessions, err := c.GetUserSessions(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "could not get sessions",
+				},
+			})
+			return
+		}
+
+		current := sessionID(user.AccessToken)
+		for _, session := range sessions {
+			session.Current = session.ID == current
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"sessions": sessions,
+			},
+		})
+	}
+}
+
+func (c *App) RevokeUserSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		id := chi.URLParam(r, "id")
+
+		tokens, err := c.SessionsStore.HKeys(sessionsKey(user.MatrixUserID)).Result()
+		if err != nil {
+			log.Println(err)
+		}
+
+		for _, token := range tokens {
+			if sessionID(token) != id {
+				continue
+			}
+
+			err = c.RevokeSession(user.MatrixUserID, token)
+			if err != nil {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"error": "could not revoke session",
+					},
+				})
+				return
+			}
+
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"success": true,
+					"current": token == user.AccessToken,
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"error": "session not found",
+			},
+		})
+	}
 }
@@ -4,9 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"path/filepath"
 	"shpong/gomatrix"
 	"shpong/static"
 	"strings"
@@ -58,48 +56,31 @@ func IsKeywordReserved(keyword string) bool {
 	return false
 }
 
+// InitViews applies any view migrations that haven't been applied yet, so a
+// fresh install or an upgraded binary gets the views it expects.
 func InitViews(db *MatrixDB) {
-	var exists bool
-	err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_matviews WHERE matviewname = $1)", "aliases").Scan(&exists)
+	status, err := db.MigrationStatus()
 	if err != nil {
-		log.Fatal("Error checking for materialized view existence:", err)
+		log.Fatal("Error reading migration status:", err)
 	}
-	if !exists {
-		log.Println("initiating views")
-		MakeViews(db)
-	}
-}
-
-func MakeViews(db *MatrixDB) {
-	log.Println("making views")
 
-	dir := "db/matrix/views"
-
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		panic(err)
+	pending := 0
+	for _, s := range status {
+		if !s.Applied() {
+			pending++
+		}
 	}
 
-	for _, file := range files {
-
-		if strings.HasSuffix(file.Name(), ".sql") {
-			log.Println("Processing SQL file:", file.Name())
-
-			filePath := filepath.Join(dir, file.Name())
-			sqlContent, err := ioutil.ReadFile(filePath)
-			if err != nil {
-				fmt.Printf("Error reading SQL file %s: %v\n", file.Name(), err)
-				continue
-			}
+	if pending == 0 {
+		return
+	}
 
-			sqlString := string(sqlContent)
+	log.Printf("applying %d pending view migrations", pending)
 
-			tx, err := db.Exec(context.Background(), sqlString)
-			if err != nil {
-				log.Println(err)
-			}
-			log.Println(tx)
-		}
+	// starting on a half migrated schema would serve broken views
+	_, err = db.MigrateUp()
+	if err != nil {
+		log.Fatal("Error applying view migrations:", err)
 	}
 }
 
@@ -346,7 +346,7 @@ func (c *App) NewSpace(p *NewSpaceParams) (string, error) {
 				"topic": p.Space.Topic,
 			},
 		}, gomatrix.Event{
-			Type: "m.restrict_events_to",
+			Type: PostingPolicyType,
 			Content: map[string]interface{}{
 				"age":      0,
 				"verified": true,
@@ -570,7 +570,7 @@ func (c *App) NewSpaceRoom(p *NewSpaceRoomParams) (string, error) {
 				"canonical": true,
 			},
 		}, gomatrix.Event{
-			Type: "m.restrict_events_to",
+			Type: PostingPolicyType,
 			Content: map[string]interface{}{
 				"age":      0,
 				"verified": true,
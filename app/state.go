@@ -135,6 +135,14 @@ func (c *App) CreateStateEvent() http.HandlerFunc {
 
 		user := c.LoggedInUser(r)
 
+		if c.RespondWithPolicyRejection(w, &PolicyRequest{
+			User:   user,
+			RoomID: p.RoomID,
+			Action: ActionState,
+		}) {
+			return
+		}
+
 		sse, err := c.NewStateEvent(&NewStateEventParams{
 			RoomID:            p.RoomID,
 			EventType:         p.EventType,
@@ -1,155 +1,534 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"shpong/gomatrix"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-func (c *App) SyncEvents() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// sync transports, picked with the `mode` query param
+const (
+	SyncModeWebSocket = "ws"
+	SyncModeSSE       = "sse"
+	SyncModePoll      = "poll"
+)
 
-		query := r.URL.Query()
-		token := query.Get("token")
+// envelope types on framed streams
+const (
+	EnvelopeEvent     = "event"
+	EnvelopeTyping    = "typing"
+	EnvelopeReceipt   = "receipt"
+	EnvelopeRedaction = "redaction"
+	EnvelopeState     = "state"
+	// control envelopes, they carry a token but no content
+	EnvelopePosition = "position"
+	EnvelopeResync   = "resync"
+)
 
-		user, err := c.GetTokenUser(token)
-		if err != nil || token == "" {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+const (
+	syncReplayLimit     = 100
+	syncDefaultTimeout  = time.Second * 30
+	syncMaxTimeout      = time.Second * 60
+	syncKeepAlive       = time.Second * 25
+	syncClientQueueSize = 256
+)
+
+// SyncMessage is a single item on a sync stream. Token is the stream
+// position it was produced at, and is empty for ephemeral messages, like
+// typing notifications, that are never replayed.
+type SyncMessage struct {
+	Type  string
+	Token string
+	Data  []byte
+}
+
+// SyncEnvelope frames every message on a framed stream, so clients can
+// tell events from typing and receipts, and know where to resume from.
+type SyncEnvelope struct {
+	Type    string          `json:"type"`
+	Token   string          `json:"token,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+}
+
+// SyncClient is one consumer of a sync stream, whichever transport it is
+// connected with. Messages are queued on C and written by a single writer.
+type SyncClient struct {
+	C      chan *SyncMessage
+	gap    chan struct{}
+	resync chan int64
+}
+
+func NewSyncClient() *SyncClient {
+	return &SyncClient{
+		C:      make(chan *SyncMessage, syncClientQueueSize),
+		gap:    make(chan struct{}, 1),
+		resync: make(chan int64, 1),
+	}
+}
+
+// Send queues msg without blocking. When the queue is full the message is
+// dropped and the writer is told there is a gap, so it resyncs from the
+// last token it delivered.
+func (s *SyncClient) Send(msg *SyncMessage) bool {
+	select {
+	case s.C <- msg:
+		return true
+	default:
+		select {
+		case s.gap <- struct{}{}:
+		default:
 		}
+		return false
+	}
+}
 
-		log.Println("starting to sync for", user.Username)
+// RequestResync asks the writer to replay everything after since.
+func (s *SyncClient) RequestResync(since int64) {
+	select {
+	case <-s.resync:
+	default:
+	}
+	s.resync <- since
+}
 
-		serverName := c.URLScheme(c.Config.Matrix.Homeserver) + fmt.Sprintf(`:%d`, c.Config.Matrix.Port)
+func StreamToken(streamOrdering int64) string {
+	return "s" + strconv.FormatInt(streamOrdering, 10)
+}
 
-		matrix, err := gomatrix.NewClient(serverName, user.MatrixUserID, user.MatrixAccessToken)
-		if err != nil {
-			log.Println(err)
+func ParseStreamToken(token string) (int64, error) {
+	if !strings.HasPrefix(token, "s") {
+		return 0, errors.New("invalid since token")
+	}
+	return strconv.ParseInt(token[1:], 10, 64)
+}
+
+// syncStream describes one stream that can be served over any transport.
+type syncStream struct {
+	// Framed streams wrap every message in a SyncEnvelope
+	Framed     bool
+	Register   func(*SyncClient)
+	Unregister func(*SyncClient)
+	// Replay returns at most syncReplayLimit messages after since
+	Replay func(since int64) ([]*SyncMessage, error)
+	// OnMessage handles messages sent by websocket clients
+	OnMessage func(client *SyncClient, msg []byte)
+}
+
+// Encode returns what goes on the wire for msg, or nil for control
+// messages on streams that aren't framed.
+func (s *syncStream) Encode(msg *SyncMessage) []byte {
+	if !s.Framed {
+		if msg.Type == EnvelopePosition || msg.Type == EnvelopeResync {
+			return nil
 		}
+		return msg.Data
+	}
+
+	serialized, err := json.Marshal(SyncEnvelope{
+		Type:    msg.Type,
+		Token:   msg.Token,
+		Content: msg.Data,
+	})
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return serialized
+}
+
+func syncMode(r *http.Request) string {
+	mode := r.URL.Query().Get("mode")
+	switch {
+	case mode != "":
+		return mode
+	case websocket.IsWebSocketUpgrade(r):
+		return SyncModeWebSocket
+	case strings.Contains(r.Header.Get("Accept"), "text/event-stream"):
+		return SyncModeSSE
+	}
+	return SyncModePoll
+}
 
-		//events := []any{}
+// syncSince reads the resume token, from Last-Event-ID when an EventSource
+// reconnects on its own, or from the since param.
+func syncSince(r *http.Request) (int64, bool, error) {
+	token := r.Header.Get("Last-Event-ID")
+	if token == "" {
+		token = r.URL.Query().Get("since")
+	}
+	if token == "" {
+		return 0, false, nil
+	}
+
+	since, err := ParseStreamToken(token)
+	if err != nil {
+		return 0, false, err
+	}
+	return since, true, nil
+}
 
-		// Create a new channel to send events to the client
-		eventCh := make(chan any)
+// ServeSync serves s over the transport the request asks for.
+func (c *App) ServeSync(w http.ResponseWriter, r *http.Request, s *syncStream) {
 
-		syncer := matrix.Syncer.(*gomatrix.DefaultSyncer)
-		syncer.OnEventType("m.room.message", func(ev *gomatrix.Event) {
-			//fmt.Println("Message: ", ev)
-			//events = append(events, ev)
-			eventCh <- ev
+	since, resume, err := syncSince(r)
+	if err != nil {
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: map[string]any{
+				"error": err.Error(),
+			},
 		})
+		return
+	}
 
-		go func() {
-			for {
-				if err := matrix.Sync(); err != nil {
-					fmt.Println("Sync() returned ", err)
-				}
-				// Optional: Wait a period of time before trying to sync again.
-			}
-		}()
+	client := NewSyncClient()
 
-		log.Println("sending SSE to ", user.Username)
+	// register before reading the position or replaying, so nothing lands
+	// between the two
+	s.Register(client)
+	defer s.Unregister(client)
 
-		// Set the content type to text/event-stream
-		w.Header().Set("Content-Type", "text/event-stream")
-		// Set cache-control header to prevent caching of the response
-		w.Header().Set("Cache-Control", "no-cache")
-		// Set connection header to keep the connection open
-		w.Header().Set("Connection", "keep-alive")
+	if !resume {
+		current, err := c.MatrixDB.Queries.GetMaxStreamOrdering(context.Background())
+		if err != nil {
+			log.Println("error getting stream ordering: ", err)
+		}
+		since = current
+	}
 
-		disconnect := make(chan bool)
-		defer close(disconnect)
+	switch syncMode(r) {
+	case SyncModeWebSocket:
+		c.serveSyncWebSocket(w, r, s, client, since, resume)
+	case SyncModeSSE:
+		c.serveSyncSSE(w, r, s, client, since, resume)
+	case SyncModePoll:
+		c.serveSyncPoll(w, r, s, client, since)
+	default:
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: map[string]any{
+				"error": "unknown sync mode",
+			},
+		})
+	}
+}
 
-		// Continuously listen for events and write them to the response
+// replayAll pages through everything after since, calling fn for each
+// message, and returns the position it reached.
+func replayAll(s *syncStream, since int64, fn func(*SyncMessage) error) (int64, error) {
+	for {
+		msgs, err := s.Replay(since)
+		if err != nil {
+			return since, err
+		}
 
-		for {
-			event := <-eventCh
-			data, err := json.Marshal(event)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+		for _, msg := range msgs {
+			if pos, err := ParseStreamToken(msg.Token); err == nil && pos > since {
+				since = pos
 			}
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher, ok := w.(http.Flusher)
-			if ok {
-				flusher.Flush()
+			if err := fn(msg); err != nil {
+				return since, err
 			}
-			if disconnect != nil {
-				eventCh = nil
+		}
+
+		if len(msgs) < syncReplayLimit {
+			return since, nil
+		}
+	}
+}
+
+// syncWriter is the only thing that writes to a streaming connection. It
+// delivers messages in token order, never repeats a token, and replays
+// from the last delivered token whenever the client's queue overflowed.
+type syncWriter struct {
+	stream    *syncStream
+	client    *SyncClient
+	write     func(msg *SyncMessage, data []byte) error
+	keepAlive func() error
+	last      int64
+}
+
+func (sw *syncWriter) send(msg *SyncMessage) error {
+	if msg.Token != "" && msg.Type != EnvelopePosition && msg.Type != EnvelopeResync {
+		pos, err := ParseStreamToken(msg.Token)
+		if err == nil {
+			if pos <= sw.last {
+				return nil
 			}
+			sw.last = pos
+		}
+	}
+
+	data := sw.stream.Encode(msg)
+	if data == nil {
+		return nil
+	}
+	return sw.write(msg, data)
+}
+
+// resync tells the client the stream restarts at since, then replays.
+func (sw *syncWriter) resync(since int64) error {
+	sw.last = since
+
+	err := sw.send(&SyncMessage{
+		Type:  EnvelopeResync,
+		Token: StreamToken(since),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = replayAll(sw.stream, since, sw.send)
+	return err
+}
+
+func (sw *syncWriter) Run(since int64, resume bool, done <-chan struct{}) error {
+
+	sw.last = since
+
+	err := sw.send(&SyncMessage{
+		Type:  EnvelopePosition,
+		Token: StreamToken(since),
+	})
+	if err != nil {
+		return err
+	}
+
+	if resume {
+		_, err := replayAll(sw.stream, since, sw.send)
+		if err != nil {
+			return err
 		}
+	}
+
+	keepAlive := time.NewTicker(syncKeepAlive)
+	defer keepAlive.Stop()
 
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-keepAlive.C:
+			if err := sw.keepAlive(); err != nil {
+				return err
+			}
+		case <-sw.client.gap:
+			// anything still queued is replayed with the rest
+			for len(sw.client.C) > 0 {
+				<-sw.client.C
+			}
+			log.Println("sync client fell behind, resyncing from", sw.last)
+			if err := sw.resync(sw.last); err != nil {
+				return err
+			}
+		case from := <-sw.client.resync:
+			if err := sw.resync(from); err != nil {
+				return err
+			}
+		case msg := <-sw.client.C:
+			if err := sw.send(msg); err != nil {
+				return err
+			}
+		}
 	}
 }
 
-/*
-func (c *App) SyncEvents() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+func (c *App) serveSyncWebSocket(w http.ResponseWriter, r *http.Request, s *syncStream, client *SyncClient, since int64, resume bool) {
 
-		user := c.LoggedInUser(r)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade connection to WebSocket:", err)
+		return
+	}
+	defer conn.Close()
+
+	sw := &syncWriter{
+		stream: s,
+		client: client,
+		write: func(msg *SyncMessage, data []byte) error {
+			return conn.WriteMessage(websocket.TextMessage, data)
+		},
+		keepAlive: func() error {
+			return conn.WriteMessage(websocket.PingMessage, nil)
+		},
+	}
 
-		log.Println("starting to sync for", user.Username)
+	done := make(chan struct{})
 
-		serverName := c.URLScheme(c.Config.Matrix.Homeserver) + fmt.Sprintf(`:%d`, c.Config.Matrix.Port)
+	go func() {
+		err := sw.Run(since, resume, done)
+		if err != nil {
+			log.Println("Failed to write message:", err)
+		}
+		// unblocks the read loop below
+		conn.Close()
+	}()
 
-		matrix, err := gomatrix.NewClient(serverName, user.MatrixUserID, user.MatrixAccessToken)
+	for {
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			log.Println("Failed to read message:", err)
+			break
 		}
 
-		events := []any{}
+		if s.OnMessage != nil {
+			s.OnMessage(client, msg)
+		}
+	}
 
-		syncer := matrix.Syncer.(*gomatrix.DefaultSyncer)
-		syncer.OnEventType("m.room.message", func(ev *gomatrix.Event) {
-			fmt.Println("Message: ", ev)
-			events = append(events, ev)
-		})
+	close(done)
+}
 
-		query := r.URL.Query()
-		timeout := query.Get("timeout")
+func (c *App) serveSyncSSE(w http.ResponseWriter, r *http.Request, s *syncStream, client *SyncClient, since int64, resume bool) {
 
-		go func() {
-			for {
-				if err := matrix.Sync(); err != nil {
-					fmt.Println("Sync() returned ", err)
-				}
-				// Optional: Wait a period of time before trying to sync again.
-			}
-		}()
-
-		if timeout != "" {
-			log.Println("got since", timeout)
-			duration, err := time.ParseDuration(timeout + "ms")
-			if err != nil {
-				fmt.Println("Error parsing duration:", err)
-				RespondWithJSON(w, &JSONResponse{
-					Code: http.StatusInternalServerError,
-					JSON: map[string]any{
-						"error": "bad since value",
-					},
-				})
-				return
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	sw := &syncWriter{
+		stream: s,
+		client: client,
+		write: func(msg *SyncMessage, data []byte) error {
+			// the id is what EventSource sends back as Last-Event-ID
+			if msg.Token != "" {
+				fmt.Fprintf(w, "id: %s\n", msg.Token)
 			}
+			_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			return err
+		},
+		keepAlive: func() error {
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			return err
+		},
+	}
+
+	// unframed streams don't send a position envelope, so set the id here
+	if !s.Framed {
+		fmt.Fprintf(w, "id: %s\n: position\n\n", StreamToken(since))
+		flusher.Flush()
+	}
+
+	err := sw.Run(since, resume, r.Context().Done())
+	if err != nil {
+		log.Println("error writing sync: ", err)
+	}
+}
+
+func (c *App) serveSyncPoll(w http.ResponseWriter, r *http.Request, s *syncStream, client *SyncClient, since int64) {
 
-			time.Sleep(duration)
+	timeout := syncDefaultTimeout
+
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		ms, err := strconv.Atoi(t)
+		if err != nil || ms < 0 {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"error": "bad timeout value",
+				},
+			})
+			return
 		}
-		matrix.StopSync()
+		timeout = time.Duration(ms) * time.Millisecond
+		if timeout > syncMaxTimeout {
+			timeout = syncMaxTimeout
+		}
+	}
 
-		// Set response headers for long-polling
-		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Transfer-Encoding", "chunked")
+	events := []json.RawMessage{}
+	next := since
 
+	add := func(msg *SyncMessage) {
+		if pos, err := ParseStreamToken(msg.Token); err == nil {
+			if pos <= next {
+				return
+			}
+			next = pos
+		}
+		if data := s.Encode(msg); data != nil {
+			events = append(events, data)
+		}
+	}
+
+	msgs, err := s.Replay(since)
+	if err != nil {
+		log.Println("error replaying sync: ", err)
 		RespondWithJSON(w, &JSONResponse{
-			Code: http.StatusOK,
+			Code: http.StatusInternalServerError,
 			JSON: map[string]any{
-				"syncing": true,
-				"events":  events,
+				"error": "could not sync",
 			},
 		})
+		return
+	}
+
+	for _, msg := range msgs {
+		add(msg)
+	}
+
+	// the rest of the page is picked up by the next poll
+	limited := len(msgs) == syncReplayLimit
+
+	replayedEvents, replayedNext := len(events), next
+
+	if len(events) == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
 
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+		case msg := <-client.C:
+			add(msg)
+		}
+	}
+
+	// pick up anything else that arrived with it
+	for {
+		select {
+		case msg := <-client.C:
+			add(msg)
+			continue
+		default:
+		}
+		break
+	}
+
+	select {
+	case <-client.gap:
+		// some live messages were dropped, so only return what was
+		// replayed and let the next poll replay the rest
+		limited = true
+		events = events[:replayedEvents]
+		next = replayedNext
+	default:
 	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"events":     events,
+			"next_batch": StreamToken(next),
+			"limited":    limited,
+		},
+	})
 }
-*/
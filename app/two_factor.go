@@ -0,0 +1,714 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"shpong/gomatrix"
+	"strings"
+	"time"
+
+	matrix_db "shpong/db/matrix/gen"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// RFC 6238 defaults, which is what authenticator apps expect
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+const (
+	recoveryCodeCount     = 10
+	twoFactorChallengeTTL = time.Minute * 5
+	twoFactorMaxAttempts  = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func NewTOTPSecret() (string, error) {
+	b, err := randomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// ValidateTOTP returns the time step code matched, allowing one step of
+// clock drift either way.
+func ValidateTOTP(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+
+	for _, step := range []int64{current - 1, current, current + 1} {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// provisioningURI is what the client turns into the enrollment QR code.
+func (c *App) provisioningURI(secret string, username string) string {
+	label := url.PathEscape(c.Config.Name + ":" + username)
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", c.Config.Name)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCode is ten base32 characters split in two, easy to copy out.
+func newRecoveryCode() (string, error) {
+	b, err := randomBytes(7)
+	if err != nil {
+		return "", err
+	}
+
+	raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return raw[:5] + "-" + raw[5:], nil
+}
+
+// NewRecoveryCodes replaces the user's recovery codes. Only hashes are
+// stored, so this is the only time the codes can be shown.
+func (c *App) NewRecoveryCodes(mid string) ([]string, error) {
+
+	err := c.MatrixDB.Queries.DeleteRecoveryCodes(context.Background(), mid)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := []string{}
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.MatrixDB.Queries.CreateRecoveryCode(context.Background(), matrix_db.CreateRecoveryCodeParams{
+			UserID:   mid,
+			CodeHash: hashRecoveryCode(code),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+func (c *App) TwoFactorEnabled(mid string) bool {
+	enabled, err := c.MatrixDB.Queries.IsTwoFactorEnabled(context.Background(), mid)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return enabled
+}
+
+// TwoFactorRequired reports whether the instance requires user to have
+// two-factor authentication on.
+func (c *App) TwoFactorRequired(user *User) bool {
+	auth := c.Config.Authentication
+
+	if auth.Require2FAForAdmins && user.Admin {
+		return true
+	}
+
+	if auth.Require2FAForSpaceOwners {
+		owner, err := c.MatrixDB.Queries.IsSpaceOwner(context.Background(), pgtype.Text{
+			String: user.MatrixUserID,
+			Valid:  true,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		return owner
+	}
+
+	return false
+}
+
+// VerifyTwoFactorCode accepts either a current TOTP code or an unused
+// recovery code. Each is only accepted once.
+func (c *App) VerifyTwoFactorCode(mid string, code string) bool {
+
+	tf, err := c.MatrixDB.Queries.GetTwoFactor(context.Background(), mid)
+	if err != nil {
+		return false
+	}
+
+	if step, ok := ValidateTOTP(tf.Secret, code, time.Now()); ok {
+		n, err := c.MatrixDB.Queries.UseTwoFactorStep(context.Background(), matrix_db.UseTwoFactorStepParams{
+			UserID: mid,
+			Step:   step,
+		})
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		return n > 0
+	}
+
+	if !tf.Enabled {
+		return false
+	}
+
+	n, err := c.MatrixDB.Queries.UseRecoveryCode(context.Background(), matrix_db.UseRecoveryCodeParams{
+		UserID:   mid,
+		CodeHash: hashRecoveryCode(code),
+		UsedAt:   time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return n > 0
+}
+
+// NewTwoFactorChallenge holds a login that passed the password check until
+// the second factor is given. The user has no session until then.
+func (c *App) NewTwoFactorChallenge(user *User) (string, error) {
+
+	serialized, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+
+	// the token stands in for the password, so it can't be guessable
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.SessionsStore.Set("2fa:"+token, serialized, twoFactorChallengeTTL).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// RequireTwoFactor blocks privileged routes for admins and space owners
+// who are required to have two-factor authentication but haven't set it up.
+func (c *App) RequireTwoFactor(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if user != nil && c.TwoFactorRequired(user) && len(c.SecondFactors(user.MatrixUserID)) == 0 {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error":        "Set up two-factor authentication to do this.",
+					"2fa_required": true,
+				},
+			})
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func respondTwoFactorExpired(w http.ResponseWriter) {
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"authenticated": false,
+			"expired":       true,
+			"error":         "login expired, log in again",
+		},
+	})
+}
+
+func (c *App) getTwoFactorChallenge(challenge string) (*User, error) {
+	if challenge == "" {
+		return nil, errors.New("no challenge")
+	}
+
+	serialized, err := c.SessionsStore.Get("2fa:" + challenge).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	err = json.Unmarshal([]byte(serialized), &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ValidateTwoFactorLogin finishes a login started by ValidateLogin.
+func (c *App) ValidateTwoFactorLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Challenge string `json:"challenge"`
+			Code      string `json:"code"`
+		}{})
+		if err != nil || p.Challenge == "" {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		key := "2fa:" + p.Challenge
+
+		user, err := c.getTwoFactorChallenge(p.Challenge)
+		if err != nil {
+			respondTwoFactorExpired(w)
+			return
+		}
+
+		account := accountSubject(user)
+
+		if c.RespondIfLockedOut(w, account) {
+			return
+		}
+
+		if !c.VerifyTwoFactorCode(user.MatrixUserID, p.Code) {
+
+			c.RecordAuthFailure(r, account)
+
+			attempts, err := c.SessionsStore.Incr(key + ":attempts").Result()
+			if err == nil && attempts == 1 {
+				c.SessionsStore.Expire(key+":attempts", twoFactorChallengeTTL)
+			}
+
+			if err != nil || attempts >= twoFactorMaxAttempts {
+				c.SessionsStore.Del(key, key+":attempts")
+				c.logoutMatrixDevice(user)
+
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusOK,
+					JSON: map[string]any{
+						"authenticated": false,
+						"expired":       true,
+						"error":         "too many attempts, log in again",
+					},
+				})
+				return
+			}
+
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"authenticated": false,
+					"error":         "code is incorrect",
+				},
+			})
+			return
+		}
+
+		c.completeTwoFactorLogin(w, r, p.Challenge, user)
+	}
+}
+
+// accountSubject is what failed codes and passwords lock out, shared by the
+// login and everything else that asks for a code.
+func accountSubject(user *User) string {
+	return "account:" + strings.ToLower(user.Username)
+}
+
+// completeTwoFactorLogin gives a user who passed the second step their
+// session, whichever factor they used.
+func (c *App) completeTwoFactorLogin(w http.ResponseWriter, r *http.Request, challenge string, user *User) {
+
+	key := "2fa:" + challenge
+
+	c.SessionsStore.Del(key, key+":attempts")
+	c.ClearAuthFailures(r, accountSubject(user))
+
+	err := c.CreateUserSession(r, user)
+	if err != nil {
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"authenticated": false,
+				"error":         "internal server error",
+			},
+		})
+		return
+	}
+
+	c.RespondWithLogin(w, user)
+}
+
+// RespondWithLogin sends a logged in user what the client needs to start.
+func (c *App) RespondWithLogin(w http.ResponseWriter, user *User) {
+
+	spaces, err := c.MatrixDB.Queries.GetUserSpaces(context.Background(), pgtype.Text{String: user.MatrixUserID, Valid: true})
+	if err != nil {
+		log.Println(err)
+	}
+	rooms, err := c.MatrixDB.Queries.GetJoinedRooms(context.Background(), pgtype.Text{String: user.MatrixUserID, Valid: true})
+	if err != nil {
+		log.Println(err)
+	}
+	dms, err := c.MatrixDB.Queries.GetDMs(context.Background(), user.MatrixUserID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	RespondWithJSON(w, &JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]any{
+			"authenticated": true,
+			"access_token":  user.AccessToken,
+			"credentials":   user,
+			"spaces":        spaces,
+			"rooms":         rooms,
+			"dms":           dms,
+		},
+	})
+}
+
+// logoutMatrixDevice drops the device a login abandoned at the second
+// step created.
+func (c *App) logoutMatrixDevice(user *User) {
+	serverName := c.URLScheme(c.Config.Matrix.Homeserver) + fmt.Sprintf(`:%d`, c.Config.Matrix.Port)
+
+	matrix, err := gomatrix.NewClient(serverName, user.MatrixUserID, user.MatrixAccessToken)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	_, err = matrix.Logout()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *App) TwoFactorStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		enabled := c.TwoFactorEnabled(user.MatrixUserID)
+
+		var remaining int64
+		if enabled {
+			count, err := c.MatrixDB.Queries.CountRecoveryCodes(context.Background(), user.MatrixUserID)
+			if err != nil {
+				log.Println(err)
+			}
+			remaining = count
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"enabled":        enabled,
+				"required":       c.TwoFactorRequired(user),
+				"recovery_codes": remaining,
+				"passkeys":       c.HasPasskeys(user.MatrixUserID),
+			},
+		})
+	}
+}
+
+// SetupTwoFactor starts enrollment. The secret isn't used for logins until
+// EnableTwoFactor confirms the user's app produces matching codes.
+func (c *App) SetupTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		user := c.LoggedInUser(r)
+
+		if c.TwoFactorEnabled(user.MatrixUserID) {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "two-factor authentication is already enabled",
+				},
+			})
+			return
+		}
+
+		secret, err := NewTOTPSecret()
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "could not set up two-factor authentication",
+				},
+			})
+			return
+		}
+
+		err = c.MatrixDB.Queries.CreateTwoFactorSecret(context.Background(), matrix_db.CreateTwoFactorSecretParams{
+			UserID:    user.MatrixUserID,
+			Secret:    secret,
+			CreatedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "could not set up two-factor authentication",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"secret": secret,
+				"uri":    c.provisioningURI(secret, user.Username),
+			},
+		})
+	}
+}
+
+func (c *App) EnableTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Code string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if c.TwoFactorEnabled(user.MatrixUserID) {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "two-factor authentication is already enabled",
+				},
+			})
+			return
+		}
+
+		if c.RespondIfLockedOut(w, accountSubject(user)) {
+			return
+		}
+
+		if !c.VerifyTwoFactorCode(user.MatrixUserID, p.Code) {
+			c.RecordAuthFailure(r, accountSubject(user))
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"enabled": false,
+					"error":   "code is incorrect",
+				},
+			})
+			return
+		}
+
+		err = c.MatrixDB.Queries.EnableTwoFactor(context.Background(), user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "could not enable two-factor authentication",
+				},
+			})
+			return
+		}
+
+		codes, err := c.NewRecoveryCodes(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"enabled":        true,
+				"recovery_codes": codes,
+			},
+		})
+	}
+}
+
+func (c *App) DisableTwoFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Code string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if c.TwoFactorRequired(user) {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"disabled": false,
+					"error":    "two-factor authentication is required for your account",
+				},
+			})
+			return
+		}
+
+		if c.RespondIfLockedOut(w, accountSubject(user)) {
+			return
+		}
+
+		if !c.VerifyTwoFactorCode(user.MatrixUserID, p.Code) {
+			c.RecordAuthFailure(r, accountSubject(user))
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"disabled": false,
+					"error":    "code is incorrect",
+				},
+			})
+			return
+		}
+
+		err = c.MatrixDB.Queries.DeleteTwoFactor(context.Background(), user.MatrixUserID)
+		if err == nil {
+			err = c.MatrixDB.Queries.DeleteRecoveryCodes(context.Background(), user.MatrixUserID)
+		}
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "could not disable two-factor authentication",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"disabled": true,
+			},
+		})
+	}
+}
+
+func (c *App) RegenerateRecoveryCodes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := ReadRequestJSON(r, w, &struct {
+			Code string `json:"code"`
+		}{})
+		if err != nil {
+			RespondWithBadRequestError(w)
+			return
+		}
+
+		user := c.LoggedInUser(r)
+
+		if c.RespondIfLockedOut(w, accountSubject(user)) {
+			return
+		}
+
+		if !c.TwoFactorEnabled(user.MatrixUserID) || !c.VerifyTwoFactorCode(user.MatrixUserID, p.Code) {
+			c.RecordAuthFailure(r, accountSubject(user))
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"error": "code is incorrect",
+				},
+			})
+			return
+		}
+
+		codes, err := c.NewRecoveryCodes(user.MatrixUserID)
+		if err != nil {
+			log.Println(err)
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"error": "could not create recovery codes",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"recovery_codes": codes,
+			},
+		})
+	}
+}
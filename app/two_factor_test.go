@@ -0,0 +1,135 @@
+package app
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, the SHA1 secret "12345678901234567890" in base32.
+// Its codes are the last six digits of the eight in the RFC.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfcSecret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode(%d) error: %s", tt.unix, err)
+		}
+		if got != tt.code {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	// 081804 is the code for step 37037036
+	const at = 1111111109
+	const step = at / totpPeriod
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		now    int64
+		ok     bool
+	}{
+		{"current step", rfcSecret, "081804", at, true},
+		{"one step late", rfcSecret, "081804", at + totpPeriod, true},
+		{"one step early", rfcSecret, "081804", at - totpPeriod, true},
+		{"two steps late", rfcSecret, "081804", at + 2*totpPeriod, false},
+		{"two steps early", rfcSecret, "081804", at - 2*totpPeriod, false},
+		{"surrounding space", rfcSecret, " 081804\n", at, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "081804", at, true},
+		{"wrong code", rfcSecret, "081805", at, false},
+		{"too short", rfcSecret, "81804", at, false},
+		{"too long", rfcSecret, "0818040", at, false},
+		{"empty", rfcSecret, "", at, false},
+		{"bad secret", "not base32!", "081804", at, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ValidateTOTP(tt.secret, tt.code, time.Unix(tt.now, 0))
+		if ok != tt.ok {
+			t.Errorf("%s: ValidateTOTP ok = %t, want %t", tt.name, ok, tt.ok)
+			continue
+		}
+		// the step matched is the one that gets used up, not the current one
+		if ok && got != step {
+			t.Errorf("%s: ValidateTOTP step = %d, want %d", tt.name, got, step)
+		}
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the secret has to work with codes made from it
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateTOTP(secret, code, time.Now()); !ok {
+		t.Errorf("code %s for new secret %s didn't validate", code, secret)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+
+	seen := map[string]bool{}
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(code) {
+			t.Errorf("newRecoveryCode() = %s, want xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("newRecoveryCode() repeated %s", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	stored := hashRecoveryCode("abcde-fgh23")
+
+	// codes are looked up by hash, so however it's typed has to hash the same
+	tests := []struct {
+		code  string
+		match bool
+	}{
+		{"abcde-fgh23", true},
+		{"ABCDE-FGH23", true},
+		{"abcdefgh23", true},
+		{"  abcde-fgh23 ", true},
+		{"abc-de-fgh-23", true},
+		{"abcde-fgh24", false},
+		{"abcde fgh23", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := hashRecoveryCode(tt.code) == stored; got != tt.match {
+			t.Errorf("hashRecoveryCode(%q) matches = %t, want %t", tt.code, got, tt.match)
+		}
+	}
+}
@@ -38,6 +38,14 @@ func (c *App) Upvote() http.HandlerFunc {
 
 		if !upvoted.Upvoted {
 
+			if c.RespondWithPolicyRejection(w, &PolicyRequest{
+				User:   user,
+				RoomID: upvoted.RoomID,
+				Action: ActionVote,
+			}) {
+				return
+			}
+
 			_, err := c.NewPost(&NewPostParams{
 				Body: &NewPostBody{
 					Type:   "m.reaction",
@@ -125,6 +133,14 @@ func (c *App) Downvote() http.HandlerFunc {
 
 		if !downvoted.Downvoted {
 
+			if c.RespondWithPolicyRejection(w, &PolicyRequest{
+				User:   user,
+				RoomID: downvoted.RoomID,
+				Action: ActionVote,
+			}) {
+				return
+			}
+
 			_, err := c.NewPost(&NewPostParams{
 				Body: &NewPostBody{
 					Type:   "m.reaction",
@@ -27,12 +27,23 @@ func main() {
 		Config: *config,
 	}
 
-	if len(os.Args) > 1 {
-		command := os.Args[1]
+	args := flag.Args()
+
+	if len(args) > 0 {
+		command := args[0]
 
 		switch command {
 		case "views":
-			req.MakeViews = true
+			if len(args) > 1 && args[1] == "verify" {
+				req.VerifyViews = true
+			} else {
+				req.Migrate = []string{"up"}
+			}
+		case "migrate":
+			req.Migrate = args[1:]
+			if len(req.Migrate) == 0 {
+				req.Migrate = []string{"status"}
+			}
 		}
 	}
 
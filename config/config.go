@@ -73,6 +73,40 @@ type Authentication struct {
 	SharedSecret               string `toml:"shared_secret"`
 	BlockPopularEmailProviders bool   `toml:"block_popular_email_providers"`
 	QueryMXRecords             bool   `toml:"query_mx_records"`
+	Require2FAForAdmins        bool   `toml:"require_2fa_for_admins"`
+	Require2FAForSpaceOwners   bool   `toml:"require_2fa_for_space_owners"`
+	SessionIdleTimeout         int    `toml:"session_idle_timeout"`
+	SessionLifetime            int    `toml:"session_lifetime"`
+	Passkeys                   bool   `toml:"passkeys"`
+	PasskeyRPID                string `toml:"passkey_rp_id"`
+}
+
+type Invites struct {
+	UsersCanInvite  bool `toml:"users_can_invite" json:"users_can_invite"`
+	MinAccountAge   int  `toml:"min_account_age" json:"min_account_age"`
+	RequireVerified bool `toml:"require_verified" json:"require_verified"`
+	CodesPerUser    int  `toml:"codes_per_user" json:"codes_per_user"`
+	MaxUses         int  `toml:"max_uses" json:"max_uses"`
+	Expiry          int  `toml:"expiry" json:"expiry"`
+}
+
+// RateLimit limits the auth routes. Routes are keyed by name, see the
+// sample config for the names, and fall back to built in defaults.
+type RateLimit struct {
+	Enabled         bool                      `toml:"enabled"`
+	LockoutAttempts int                       `toml:"lockout_attempts"`
+	LockoutBase     int                       `toml:"lockout_base"`
+	LockoutMax      int                       `toml:"lockout_max"`
+	Throttle        int                       `toml:"throttle"`
+	ThrottleBacklog int                       `toml:"throttle_backlog"`
+	Routes          map[string]RateLimitRoute `toml:"routes"`
+}
+
+type RateLimitRoute struct {
+	Period     int `toml:"period"`
+	PerIP      int `toml:"per_ip"`
+	PerAccount int `toml:"per_account"`
+	PerEmail   int `toml:"per_email"`
 }
 
 type Privacy struct {
@@ -88,6 +122,25 @@ type SMTP struct {
 	Password string `toml:"password"`
 }
 
+type Digest struct {
+	Enabled          bool   `toml:"enabled"`
+	Schedule         string `toml:"schedule"`
+	DefaultFrequency string `toml:"default_frequency"`
+}
+
+// Account deletion waits out a grace period in days, data exports are kept
+// for ExportExpiry days.
+type Account struct {
+	DeletionGracePeriod int `toml:"deletion_grace_period"`
+	ExportExpiry        int `toml:"export_expiry"`
+}
+
+// Moderation sets who works a space's report queue. Members with at least
+// ModeratorPowerLevel in the space see its reports.
+type Moderation struct {
+	ModeratorPowerLevel int `toml:"moderator_power_level"`
+}
+
 type Storage struct {
 	BucketName      string `toml:"bucket_name"`
 	Region          string `toml:"region"`
@@ -146,9 +199,19 @@ type Discord struct {
 
 type Provider struct {
 	Provider     string `toml:"provider" json:"provider"`
+	Name         string `toml:"name" json:"name"`
 	Enabled      bool   `toml:"enabled" json:"enabled"`
 	ClientID     string `toml:"client_id" json:"client_id"`
 	ClientSecret string `toml:"client_secret" json:"client_secret"`
+	// OIDC providers only need an issuer, endpoints are discovered from it.
+	// Plain OAuth2 providers set the endpoints instead.
+	Issuer        string   `toml:"issuer" json:"issuer"`
+	AuthURL       string   `toml:"auth_url" json:"auth_url"`
+	TokenURL      string   `toml:"token_url" json:"token_url"`
+	UserInfoURL   string   `toml:"userinfo_url" json:"userinfo_url"`
+	Scopes        []string `toml:"scopes" json:"scopes"`
+	IDClaim       string   `toml:"id_claim" json:"id_claim"`
+	UsernameClaim string   `toml:"username_claim" json:"username_claim"`
 }
 
 type Config struct {
@@ -162,8 +225,13 @@ type Config struct {
 	Cache          Cache          `toml:"cache"`
 	Authentication Authentication `toml:"authentication"`
 	Privacy        Privacy        `toml:"privacy"`
+	RateLimit      RateLimit      `toml:"rate_limit"`
 	SMTP           SMTP           `toml:"smtp"`
+	Digest         Digest         `toml:"digest"`
+	Account        Account        `toml:"account"`
+	Moderation     Moderation     `toml:"moderation"`
 	Features       Features       `toml:"features"`
+	Invites        Invites        `toml:"invites"`
 	Storage        Storage        `toml:"storage"`
 	Images         Images         `toml:"images"`
 	ThirdParty     ThirdParty     `toml:"third_party"`
@@ -3,7 +3,8 @@
 CREATE TABLE IF NOT EXISTS event_reactions (
     relates_to_id text,
     aggregation_key text,
-    senders text[]
+    url text,
+    senders jsonb
 );
 -- +goose StatementEnd
 
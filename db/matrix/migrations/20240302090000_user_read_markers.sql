@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS user_read_markers (
+    room_id text NOT NULL,
+    user_id text NOT NULL,
+    stream_ordering bigint
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_read_markers;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_digest_settings (
+    user_id text PRIMARY KEY,
+    frequency text NOT NULL,
+    last_sent_at bigint NOT NULL DEFAULT 0
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_digest_settings;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_invite_codes (
+    code text PRIMARY KEY,
+    created_by text NOT NULL,
+    max_uses integer NOT NULL DEFAULT 1,
+    uses integer NOT NULL DEFAULT 0,
+    expires_at bigint NOT NULL DEFAULT 0,
+    revoked boolean NOT NULL DEFAULT false,
+    created_at bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS commune_invite_code_uses (
+    code text NOT NULL REFERENCES commune_invite_codes (code) ON DELETE CASCADE,
+    user_id text NOT NULL,
+    used_at bigint NOT NULL,
+    PRIMARY KEY (code, user_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_invite_code_uses;
+DROP TABLE commune_invite_codes;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_two_factor (
+    user_id text PRIMARY KEY,
+    secret text NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_step bigint NOT NULL DEFAULT 0,
+    created_at bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS commune_recovery_codes (
+    user_id text NOT NULL,
+    code_hash text NOT NULL,
+    used_at bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, code_hash)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_recovery_codes;
+DROP TABLE commune_two_factor;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_data_exports (
+    id text PRIMARY KEY,
+    user_id text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    archive bytea,
+    created_at bigint NOT NULL,
+    completed_at bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS commune_account_deletions (
+    user_id text PRIMARY KEY,
+    requested_at bigint NOT NULL,
+    delete_at bigint NOT NULL,
+    completed_at bigint NOT NULL DEFAULT 0
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_account_deletions;
+DROP TABLE commune_data_exports;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_primary_emails (
+    user_id text PRIMARY KEY,
+    address text NOT NULL,
+    updated_at bigint NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_primary_emails;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_passkeys (
+    id text PRIMARY KEY,
+    user_id text NOT NULL,
+    name text NOT NULL DEFAULT '',
+    credential text NOT NULL,
+    created_at bigint NOT NULL,
+    last_used_at bigint NOT NULL DEFAULT 0
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_passkeys;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_reports (
+    id text PRIMARY KEY,
+    reporter text NOT NULL,
+    target_type text NOT NULL,
+    target_user_id text NOT NULL,
+    event_id text NOT NULL DEFAULT '',
+    room_id text NOT NULL DEFAULT '',
+    space_room_id text NOT NULL DEFAULT '',
+    category text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'open',
+    created_at bigint NOT NULL,
+    resolved_by text NOT NULL DEFAULT '',
+    resolved_at bigint NOT NULL DEFAULT 0,
+    note text NOT NULL DEFAULT ''
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_reports;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_audit_log (
+    id bigserial PRIMARY KEY,
+    actor text NOT NULL,
+    action text NOT NULL,
+    target_user_id text NOT NULL DEFAULT '',
+    target text NOT NULL DEFAULT '',
+    space_room_id text NOT NULL DEFAULT '',
+    reason text NOT NULL DEFAULT '',
+    details text NOT NULL DEFAULT '{}',
+    created_at bigint NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_audit_log;
+-- +goose StatementEnd
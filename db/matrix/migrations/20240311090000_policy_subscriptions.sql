@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_policy_subscriptions (
+    space_room_id text NOT NULL DEFAULT '',
+    policy_room_id text NOT NULL,
+    auto_ban boolean NOT NULL DEFAULT false,
+    subscribed_by text NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY (space_room_id, policy_room_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_policy_subscriptions;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS commune_held_posts (
+    id text PRIMARY KEY,
+    sender text NOT NULL,
+    room_id text NOT NULL,
+    space_room_id text NOT NULL,
+    body text NOT NULL,
+    matches text NOT NULL DEFAULT '[]',
+    status text NOT NULL DEFAULT 'open',
+    created_at bigint NOT NULL,
+    reviewed_by text NOT NULL DEFAULT '',
+    reviewed_at bigint NOT NULL DEFAULT 0,
+    note text NOT NULL DEFAULT '',
+    event_id text NOT NULL DEFAULT ''
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE commune_held_posts;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- name: CreateAuditLogEntry :exec
+INSERT INTO commune_audit_log (actor, action, target_user_id, target, space_room_id, reason, details, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+
+-- name: GetAuditLog :many
+-- Newest first, paged by id. Filters that are null match everything.
+SELECT id, actor, action, target_user_id, target, space_room_id, reason, details::jsonb as details, created_at
+FROM commune_audit_log
+WHERE (sqlc.narg('actor')::text IS NULL OR actor = sqlc.narg('actor'))
+AND (sqlc.narg('target')::text IS NULL OR target_user_id = sqlc.narg('target') OR target = sqlc.narg('target'))
+AND (sqlc.narg('space_room_id')::text IS NULL OR space_room_id = sqlc.narg('space_room_id'))
+AND (sqlc.narg('before')::bigint IS NULL OR id < sqlc.narg('before'))
+ORDER BY id DESC
+LIMIT 100;
@@ -0,0 +1,63 @@
+-- name: GetContentFilters :many
+-- Filters set in the room, the space it belongs to and the instance's
+-- public space.
+SELECT cse.room_id, cse.event_id, (ej.json::jsonb->>'content')::text as content
+FROM current_state_events cse
+JOIN event_json ej ON ej.event_id = cse.event_id
+WHERE cse.type = 'space.content_filters'
+AND (cse.room_id = sqlc.arg('room_id')::text
+    OR cse.room_id = sqlc.arg('instance_room_id')::text
+    OR cse.room_id IN (
+        SELECT sr.parent_room_id FROM space_rooms sr
+        WHERE sr.child_room_id = sqlc.arg('room_id')::text
+    ));
+
+-- name: GetRoomSpace :one
+-- The space a room belongs to, the room itself for space rooms.
+SELECT COALESCE((
+    SELECT sr.parent_room_id FROM space_rooms sr
+    WHERE sr.child_room_id = sqlc.arg('room_id')::text
+    LIMIT 1
+), sqlc.arg('room_id')::text)::text as space_room_id;
+
+-- name: CreateHeldPost :exec
+INSERT INTO commune_held_posts (id, sender, room_id, space_room_id, body, matches, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7);
+
+-- name: GetHeldPost :one
+SELECT * FROM commune_held_posts WHERE id = $1;
+
+-- name: GetSpaceHeldPosts :many
+SELECT * FROM commune_held_posts
+WHERE space_room_id = $1
+AND status = 'open'
+ORDER BY created_at ASC;
+
+-- name: GetInstanceHeldPosts :many
+SELECT * FROM commune_held_posts
+WHERE status = 'open'
+ORDER BY created_at ASC
+LIMIT 500;
+
+-- name: IsBannedFromRooms :one
+-- Current bans, the membership_state view can lag behind them.
+SELECT EXISTS (
+    SELECT 1 FROM current_state_events cse
+    JOIN room_memberships rm ON rm.event_id = cse.event_id
+    WHERE cse.type = 'm.room.member'
+    AND cse.state_key = sqlc.arg('user_id')::text
+    AND cse.room_id = ANY(sqlc.arg('room_ids')::text[])
+    AND rm.membership = 'ban'
+)::bool as banned;
+
+-- name: ReviewHeldPost :execrows
+-- Moves a post on from the status the reviewer saw, so two moderators
+-- can't both review it.
+UPDATE commune_held_posts
+SET status = sqlc.arg('status')::text,
+    reviewed_by = sqlc.arg('reviewed_by')::text,
+    reviewed_at = sqlc.arg('reviewed_at')::bigint,
+    note = sqlc.arg('note')::text,
+    event_id = sqlc.arg('event_id')::text
+WHERE id = sqlc.arg('id')::text
+AND status = sqlc.arg('from_status')::text;
@@ -0,0 +1,112 @@
+-- name: GetUserExportProfile :one
+SELECT users.name as matrix_user_id,
+    profiles.user_id as username,
+    profiles.displayname as display_name,
+    profiles.avatar_url,
+    users.creation_ts as created_at
+FROM users
+JOIN profiles ON profiles.full_user_id = users.name
+WHERE users.name = $1;
+
+-- name: GetUserEvents :many
+-- Everything a user has posted that hasn't been redacted, newest first,
+-- paged by origin_server_ts and event_id so events sharing a timestamp
+-- aren't skipped.
+SELECT ej.event_id,
+    ej.room_id,
+    events.type,
+    ej.json,
+    events.origin_server_ts,
+    COALESCE((
+        SELECT aliases.room_alias FROM aliases
+        WHERE aliases.room_id = events.room_id
+        LIMIT 1
+    ), '')::text as room_alias
+FROM events
+JOIN event_json ej ON ej.event_id = events.event_id
+LEFT JOIN redactions ON redactions.redacts = events.event_id
+WHERE events.sender = sqlc.arg('sender')
+AND events.type IN ('space.board.post', 'space.board.post.reply', 'm.reaction', 'm.room.message')
+AND (events.origin_server_ts, events.event_id) < (sqlc.arg('before_ts')::bigint, sqlc.arg('before_id')::text)
+AND redactions.redacts IS NULL
+ORDER BY events.origin_server_ts DESC, events.event_id DESC
+LIMIT 500;
+
+-- name: GetPasswordHash :one
+SELECT password_hash FROM users WHERE name = $1;
+
+-- name: DeleteUserThreepids :exec
+DELETE FROM user_threepids WHERE user_id = $1;
+
+-- name: EraseProfile :exec
+UPDATE profiles SET displayname = NULL, avatar_url = NULL
+WHERE full_user_id = $1;
+
+-- name: DeleteUserDirectory :exec
+DELETE FROM user_directory WHERE user_id = $1;
+
+-- name: DeleteUserDirectorySearch :exec
+DELETE FROM user_directory_search WHERE user_id = $1;
+
+-- name: CreateDataExport :exec
+INSERT INTO commune_data_exports (id, user_id, created_at)
+VALUES ($1, $2, $3);
+
+-- name: CompleteDataExport :exec
+UPDATE commune_data_exports
+SET status = 'ready', archive = $2, completed_at = $3
+WHERE id = $1;
+
+-- name: FailDataExport :exec
+UPDATE commune_data_exports
+SET status = 'failed', completed_at = $2
+WHERE id = $1;
+
+-- name: GetDataExports :many
+SELECT id, status, created_at, completed_at
+FROM commune_data_exports
+WHERE user_id = $1
+ORDER BY created_at DESC;
+
+-- name: HasPendingDataExport :one
+SELECT EXISTS (
+    SELECT 1 FROM commune_data_exports
+    WHERE user_id = $1 AND status = 'pending'
+);
+
+-- name: GetDataExportArchive :one
+SELECT status, archive, created_at
+FROM commune_data_exports
+WHERE id = $1 AND user_id = $2;
+
+-- name: DeleteExpiredDataExports :exec
+DELETE FROM commune_data_exports
+WHERE created_at < $1;
+
+-- name: DeleteUserDataExports :exec
+DELETE FROM commune_data_exports
+WHERE user_id = $1;
+
+-- name: ScheduleAccountDeletion :one
+INSERT INTO commune_account_deletions (user_id, requested_at, delete_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO UPDATE
+SET requested_at = EXCLUDED.requested_at, delete_at = EXCLUDED.delete_at, completed_at = 0
+RETURNING *;
+
+-- name: GetAccountDeletion :one
+SELECT * FROM commune_account_deletions
+WHERE user_id = $1 AND completed_at = 0;
+
+-- name: CancelAccountDeletion :execrows
+DELETE FROM commune_account_deletions
+WHERE user_id = $1 AND completed_at = 0;
+
+-- name: GetDueAccountDeletions :many
+SELECT user_id FROM commune_account_deletions
+WHERE delete_at <= $1 AND completed_at = 0;
+
+-- name: CompleteAccountDeletion :exec
+UPDATE commune_account_deletions
+SET completed_at = $2
+WHERE user_id = $1;
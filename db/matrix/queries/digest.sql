@@ -0,0 +1,71 @@
+-- name: GetDigestSettings :one
+SELECT frequency, last_sent_at
+FROM commune_digest_settings
+WHERE user_id = $1;
+
+-- name: UpdateDigestFrequency :exec
+INSERT INTO commune_digest_settings (user_id, frequency)
+VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE SET frequency = EXCLUDED.frequency;
+
+-- name: UpdateDigestSentAt :exec
+INSERT INTO commune_digest_settings (user_id, frequency, last_sent_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO UPDATE SET last_sent_at = EXCLUDED.last_sent_at;
+
+-- name: GetDigestCandidates :many
+SELECT DISTINCT ON (ut.user_id) ut.user_id, ut.address, profiles.user_id as username,
+    COALESCE(ds.frequency, '')::text as frequency,
+    COALESCE(ds.last_sent_at, 0)::bigint as last_sent_at
+FROM user_threepids ut
+JOIN users ON users.name = ut.user_id AND users.deactivated = 0
+JOIN profiles ON profiles.full_user_id = ut.user_id
+LEFT JOIN commune_digest_settings ds ON ds.user_id = ut.user_id
+LEFT JOIN commune_primary_emails pe ON pe.user_id = ut.user_id
+WHERE ut.medium = 'email'
+AND (pe.address IS NULL OR ut.address = pe.address)
+AND COALESCE(ds.frequency, '') != 'off'
+AND (
+    EXISTS (
+        SELECT 1 FROM event_relations er
+        JOIN events ON events.event_id = er.relates_to_id
+        JOIN events ev ON ev.event_id = er.event_id
+        WHERE events.sender = ut.user_id
+        AND ev.sender != ut.user_id
+        AND er.relation_type = 'm.nested_reply'
+        AND ev.origin_server_ts > $1
+    ) OR EXISTS (
+        SELECT 1 FROM events ev
+        JOIN event_json ej ON ej.event_id = ev.event_id
+        WHERE ev.origin_server_ts > $1
+        AND ev.sender != ut.user_id
+        AND ej.json::jsonb->'content'->'m.mentions'->'user_ids' @> to_jsonb(ARRAY[ut.user_id])
+    ) OR EXISTS (
+        SELECT 1 FROM membership_state ms
+        JOIN rooms ON rooms.room_id = ms.room_id
+        WHERE rooms.creator = ut.user_id
+        AND ms.user_id != ut.user_id
+        AND ms.membership = 'join'
+        AND ms.origin_server_ts > $1
+    )
+)
+ORDER BY ut.user_id, ut.added_at ASC;
+
+-- name: GetUnreadMentions :many
+SELECT ev.event_id, ev.sender as from_matrix_user_id,
+    ej.json::jsonb->'content'->>'body' as body,
+    ej.json::jsonb->'content'->>'title' as title,
+    ev.origin_server_ts as created_at,
+    aliases.room_alias,
+    ms.display_name
+FROM events ev
+JOIN event_json ej ON ej.event_id = ev.event_id
+JOIN aliases ON aliases.room_id = ev.room_id
+LEFT JOIN membership_state ms ON ms.user_id = ev.sender AND ms.room_id = ev.room_id
+LEFT JOIN user_read_markers rm ON rm.room_id = ev.room_id AND rm.user_id = sqlc.arg('user_id')::text
+WHERE ev.origin_server_ts > sqlc.arg('since')
+AND ev.sender != sqlc.arg('user_id')::text
+AND ej.json::jsonb->'content'->'m.mentions'->'user_ids' @> to_jsonb(ARRAY[sqlc.arg('user_id')::text])
+AND ev.stream_ordering > COALESCE(rm.stream_ordering, 0)
+ORDER BY ev.origin_server_ts DESC
+LIMIT 20;
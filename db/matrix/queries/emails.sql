@@ -0,0 +1,42 @@
+-- name: GetUserEmails :many
+SELECT ut.address, ut.validated_at, ut.added_at,
+    COALESCE(ut.address = pe.address, false)::boolean as is_primary
+FROM user_threepids ut
+LEFT JOIN commune_primary_emails pe ON pe.user_id = ut.user_id
+WHERE ut.user_id = $1 AND ut.medium = 'email'
+ORDER BY ut.added_at ASC;
+
+-- name: GetPrimaryEmail :one
+-- Falls back to the oldest address for users who never picked one.
+SELECT ut.address
+FROM user_threepids ut
+LEFT JOIN commune_primary_emails pe ON pe.user_id = ut.user_id
+WHERE ut.user_id = $1 AND ut.medium = 'email'
+AND (pe.address IS NULL OR ut.address = pe.address)
+ORDER BY ut.added_at ASC
+LIMIT 1;
+
+-- name: HasEmail :one
+SELECT EXISTS (
+    SELECT 1 FROM user_threepids
+    WHERE user_id = $1 AND medium = 'email' AND address = $2
+);
+
+-- name: SetPrimaryEmail :exec
+INSERT INTO commune_primary_emails (user_id, address, updated_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO UPDATE
+SET address = EXCLUDED.address, updated_at = EXCLUDED.updated_at;
+
+-- name: InitPrimaryEmail :exec
+INSERT INTO commune_primary_emails (user_id, address, updated_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO NOTHING;
+
+-- name: RemoveEmail :execrows
+DELETE FROM user_threepids
+WHERE user_id = $1 AND medium = 'email' AND address = $2;
+
+-- name: DeletePrimaryEmail :exec
+DELETE FROM commune_primary_emails
+WHERE user_id = $1;
@@ -67,6 +67,90 @@ LIMIT 30;
 
 
 
+-- name: GetSpaceEventsRanked :many
+SELECT ej.event_id, 
+    ej.json, 
+    ud.display_name,
+    ud.avatar_url,
+    aliases.room_alias,
+    RIGHT(events.event_id, 11) as slug,
+    COALESCE(rc.count, 0) as replies,
+    COALESCE(array_agg(json_build_object('key', re.aggregation_key, 'url', CASE WHEN re.url IS NOT NULL THEN re.url ELSE NULL END, 'senders', re.senders)) FILTER (WHERE re.aggregation_key is not null), null) as reactions,
+    ed.json::jsonb->'content'->>'m.new_content' as edited,
+    COALESCE(NULLIF(ed.json::jsonb->>'origin_server_ts', '')::BIGINT, 0) as edited_on,
+    COALESCE(ranked.upvotes, 0)::bigint as upvotes,
+    COALESCE(ranked.downvotes, 0)::bigint as downvotes,
+    ranked.score::float8 as score
+FROM (
+    SELECT evs.event_id,
+        votes.upvotes,
+        votes.downvotes,
+        CASE @sort::text
+            WHEN 'hot' THEN
+                SIGN(COALESCE(votes.upvotes, 0) - COALESCE(votes.downvotes, 0)) * 
+                LOG(GREATEST(ABS(COALESCE(votes.upvotes, 0) - COALESCE(votes.downvotes, 0)), 1)) + 
+                (evs.origin_server_ts / 1000 - 1134028003) / 45000.0
+            WHEN 'top' THEN
+                COALESCE(votes.upvotes, 0) - COALESCE(votes.downvotes, 0)
+            WHEN 'controversial' THEN
+                CASE WHEN COALESCE(votes.upvotes, 0) = 0 OR COALESCE(votes.downvotes, 0) = 0 THEN 0
+                ELSE POWER(votes.upvotes + votes.downvotes, 
+                    LEAST(votes.upvotes, votes.downvotes)::float8 / GREATEST(votes.upvotes, votes.downvotes))
+                END
+            ELSE evs.origin_server_ts
+        END::float8 as score
+    FROM events evs
+    LEFT JOIN event_votes votes ON votes.relates_to_id = evs.event_id
+    WHERE evs.room_id = $1
+    AND evs.type = 'space.board.post'
+    AND (evs.origin_server_ts > sqlc.narg('since') OR sqlc.narg('since') IS NULL)
+) ranked
+JOIN event_json ej ON ej.event_id = ranked.event_id
+LEFT JOIN events on events.event_id = ej.event_id
+LEFT JOIN aliases ON aliases.room_id = ej.room_id
+LEFT JOIN membership_state ud ON ud.user_id = events.sender
+    AND ud.room_id = ej.room_id
+LEFT JOIN event_reactions re ON re.relates_to_id = ej.event_id
+LEFT JOIN reply_count rc ON rc.relates_to_id = ej.event_id
+LEFT JOIN redactions ON redactions.redacts = ej.event_id
+LEFT JOIN (
+	SELECT DISTINCT ON(evr.relates_to_id) ejs.json, evr.relates_to_id
+	FROM event_json ejs
+	JOIN event_relations evr ON evr.event_id = ejs.event_id
+	JOIN events evs ON evr.event_id = evs.event_id
+	AND evr.relation_type = 'm.replace'
+	GROUP BY evr.relates_to_id, ejs.event_id, ejs.json, evs.origin_server_ts
+	ORDER BY evr.relates_to_id, evs.origin_server_ts DESC
+) ed ON ed.relates_to_id = ej.event_id
+WHERE NOT EXISTS (SELECT FROM event_relations WHERE event_id = ej.event_id 
+AND relation_type != 'm.reference')
+AND (
+    (sqlc.narg('topic')::text IS NOT NULL AND ej.json::jsonb->'content'->>'topic' = sqlc.narg('topic'))
+    OR
+    (sqlc.narg('topic')::text IS NULL AND ej.json::jsonb->'content'->>'topic' IS NULL)
+)
+AND (
+    sqlc.narg('cursor_score')::float8 IS NULL
+    OR (ranked.score, ej.event_id) < (sqlc.narg('cursor_score')::float8, sqlc.narg('cursor_event_id')::text)
+)
+AND redactions.redacts is null
+GROUP BY
+    ej.event_id, 
+    ed.json,
+    events.event_id, 
+    rc.count,
+    ej.json,
+    ud.display_name,
+    ud.avatar_url,
+    aliases.room_alias,
+    ranked.upvotes,
+    ranked.downvotes,
+    ranked.score
+ORDER BY ranked.score DESC, ej.event_id DESC
+LIMIT 30;
+
+
+
 -- name: GetSpaceEvent :one
 SELECT ej.event_id, 
     ej.json,
@@ -311,3 +395,32 @@ SELECT origin_server_ts
 FROM events
 ORDER BY origin_server_ts ASC
 LIMIT 1;
+
+-- name: GetMaxStreamOrdering :one
+SELECT COALESCE(MAX(stream_ordering), 0)::bigint
+FROM events;
+
+-- name: GetEventsSinceStreamOrdering :many
+SELECT event_id, room_id, type, sender, stream_ordering
+FROM events
+WHERE stream_ordering > $1
+AND type IN ('m.room.message', 'm.reaction', 'm.room.member', 'm.room.redaction', 
+    'm.room.name', 'm.room.topic', 'space.board.post', 'space.board.post.reply',
+    'm.policy.rule.user', 'm.policy.rule.server', 'm.policy.rule.room', 'm.space.child')
+ORDER BY stream_ordering ASC
+LIMIT 500;
+
+-- name: GetRoomEventsSinceStreamOrdering :many
+SELECT event_id, type, stream_ordering
+FROM events
+WHERE room_id = $1
+AND stream_ordering > $2
+AND type IN ('m.room.message', 'm.reaction', 'm.room.member', 'm.room.redaction', 
+    'm.room.name', 'm.room.topic', 'space.board.post')
+ORDER BY stream_ordering ASC
+LIMIT 100;
+
+-- name: GetEventRoomID :one
+SELECT room_id
+FROM events
+WHERE event_id = $1;
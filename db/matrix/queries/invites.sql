@@ -0,0 +1,64 @@
+-- name: CreateInviteCode :one
+INSERT INTO commune_invite_codes (code, created_by, max_uses, expires_at, created_at)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+
+-- name: GetInviteCode :one
+SELECT * FROM commune_invite_codes
+WHERE code = $1;
+
+-- name: IsInviteCodeValid :one
+SELECT EXISTS (
+    SELECT 1 FROM commune_invite_codes
+    WHERE code = sqlc.arg('code')
+    AND revoked = false
+    AND uses < max_uses
+    AND (expires_at = 0 OR expires_at > sqlc.arg('now')::bigint)
+);
+
+-- name: ConsumeInviteCode :one
+-- Only returns a row when the code could be used, so two registrations
+-- can't both take the last use.
+UPDATE commune_invite_codes
+SET uses = uses + 1
+WHERE code = sqlc.arg('code')
+AND revoked = false
+AND uses < max_uses
+AND (expires_at = 0 OR expires_at > sqlc.arg('now')::bigint)
+RETURNING code;
+
+-- name: ReleaseInviteCode :exec
+UPDATE commune_invite_codes
+SET uses = uses - 1
+WHERE code = $1 AND uses > 0;
+
+-- name: CreateInviteCodeUse :exec
+INSERT INTO commune_invite_code_uses (code, user_id, used_at)
+VALUES ($1, $2, $3)
+ON CONFLICT DO NOTHING;
+
+-- name: RevokeInviteCode :exec
+UPDATE commune_invite_codes
+SET revoked = true
+WHERE code = $1;
+
+-- name: GetInviteCodes :many
+SELECT * FROM commune_invite_codes
+WHERE (sqlc.narg('created_by')::text IS NULL OR created_by = sqlc.narg('created_by')::text)
+AND created_at < sqlc.arg('last')::bigint
+ORDER BY created_at DESC
+LIMIT 50;
+
+-- name: CountActiveInviteCodes :one
+SELECT COUNT(*) FROM commune_invite_codes
+WHERE created_by = sqlc.arg('created_by')
+AND revoked = false
+AND uses < max_uses
+AND (expires_at = 0 OR expires_at > sqlc.arg('now')::bigint);
+
+-- name: GetInviteCodeUses :many
+SELECT icu.code, icu.user_id, icu.used_at, profiles.user_id as username
+FROM commune_invite_code_uses icu
+LEFT JOIN profiles ON profiles.full_user_id = icu.user_id
+WHERE icu.code = ANY(sqlc.arg('codes')::text[])
+ORDER BY icu.used_at DESC;
@@ -24,18 +24,67 @@ SELECT
 	ms.display_name,
 	ms.avatar_url,
 	aliases.room_alias,
+	events.room_id,
+	COALESCE(sr.parent_room_id, events.room_id) as space_id,
     false as read
 FROM event_json ej
 JOIN event_relations er ON er.event_id = ej.event_id
 JOIN events ON events.event_id = er.relates_to_id
 JOIN events ev ON ev.event_id = er.event_id
 JOIN aliases ON aliases.room_id = events.room_id
+LEFT JOIN space_rooms sr ON sr.child_room_id = events.room_id
 JOIN membership_state ms ON ms.user_id = ev.sender
 WHERE ev.event_id = $1;
 
 
 
 
+-- name: GetNotificationsSince :many
+SELECT 
+	CASE WHEN (er.relation_type = 'm.annotation' AND events.type = 'space.board.post.reply') THEN 'reply.reaction'
+	ELSE CASE WHEN er.relation_type = 'm.annotation' THEN 'reaction' 
+	ELSE
+	    CASE WHEN events.type = 'space.board.post' THEN 'post.reply' 
+	    ELSE
+		CASE WHEN events.type = 'space.board.post.reply' THEN 'reply.reply'
+		END
+	    END
+	END END as type,
+	ev.sender as from_matrix_user_id, 
+	events.sender as for_matrix_user_id, 
+	CASE WHEN er.relation_type = 'm.annotation' THEN 
+        CASE WHEN ej.json::jsonb->'content'->'m.relates_to'->>'url' IS NOT NULL
+            THEN ej.json::jsonb->'content'->'m.relates_to'->>'url'
+        ELSE ej.json::jsonb->'content'->'m.relates_to'->>'key' END
+    ELSE ej.json::jsonb->'content'->>'body' END as body, 
+	ej.json::jsonb->'content'->'m.relates_to'->>'thread_event_id' as thread_event_id,
+	ev.origin_server_ts as created_at, 
+    events.type as event_type,
+	ev.event_id, 
+	er.relates_to_id as relates_to_event_id,
+	ms.display_name,
+	ms.avatar_url,
+	aliases.room_alias,
+	events.room_id,
+	COALESCE(sr.parent_room_id, events.room_id) as space_id,
+    false as read,
+	ev.stream_ordering
+FROM event_json ej
+JOIN event_relations er ON er.event_id = ej.event_id
+JOIN events ON events.event_id = er.relates_to_id
+JOIN events ev ON ev.event_id = er.event_id
+JOIN aliases ON aliases.room_id = events.room_id
+LEFT JOIN space_rooms sr ON sr.child_room_id = events.room_id
+LEFT JOIN membership_state ms ON ms.user_id = ev.sender AND ms.room_id = events.room_id
+WHERE events.sender = $1
+AND ev.sender != $1
+AND ev.stream_ordering > $2
+AND ej.json::jsonb->'content'->'m.relates_to'->>'thread_event_id' is not NULL
+AND (er.relation_type = 'm.annotation' OR er.relation_type = 'm.nested_reply')
+ORDER BY ev.stream_ordering ASC
+LIMIT 100;
+
+
 -- name: GetNotifications :many
 WITH NOTS AS (
 SELECT DISTINCT ON (ev.origin_server_ts) 
@@ -62,18 +111,22 @@ SELECT DISTINCT ON (ev.origin_server_ts)
 	ms.display_name,
 	ms.avatar_url,
 	aliases.room_alias,
-    CASE WHEN ev.origin_server_ts > $2 THEN false ELSE true END as read
+	events.room_id,
+	COALESCE(sr.parent_room_id, events.room_id) as space_id,
+    ev.stream_ordering <= COALESCE(rm.stream_ordering, 0) as read
 FROM event_json ej
 JOIN event_relations er ON er.event_id = ej.event_id
 JOIN events ON events.event_id = er.relates_to_id
 JOIN events ev ON ev.event_id = er.event_id
 JOIN aliases ON aliases.room_id = events.room_id
+LEFT JOIN space_rooms sr ON sr.child_room_id = events.room_id
+LEFT JOIN user_read_markers rm ON rm.room_id = events.room_id AND rm.user_id = $1
 JOIN membership_state ms ON ms.user_id = ev.sender
 WHERE events.sender = $1
 AND ev.sender != $1
 AND ej.json::jsonb->'content'->'m.relates_to'->>'thread_event_id' is not NULL
 AND (er.relation_type = 'm.annotation' OR er.relation_type = 'm.nested_reply')
-GROUP BY ev.event_id, ev.sender, ej.json, ev.origin_server_ts, er.relates_to_id, ms.display_name, ms.avatar_url, aliases.room_alias, events.type, er.relation_type, er.aggregation_key
+GROUP BY ev.event_id, ev.sender, ej.json, ev.origin_server_ts, ev.stream_ordering, er.relates_to_id, ms.display_name, ms.avatar_url, aliases.room_alias, events.room_id, sr.parent_room_id, rm.stream_ordering, events.type, er.relation_type, er.aggregation_key
 ),
 FOL AS (
 SELECT 'space.follow' as type,
@@ -82,15 +135,19 @@ SELECT 'space.follow' as type,
 	'' as thread_event_id,
 	ms.origin_server_ts as created_at,
     '' as event_type,
-	'' as event_id,
+	ms.event_id,
 	'' as relates_to_event_id,
 	ms.display_name,
 	ms.avatar_url,
 	'' as room_alias,
-    CASE WHEN ms.origin_server_ts > $2 THEN false ELSE true END as read
+	ms.room_id,
+	ms.room_id as space_id,
+    mev.stream_ordering <= COALESCE(rm.stream_ordering, 0) as read
 FROM membership_state ms 
+JOIN events mev ON mev.event_id = ms.event_id
+LEFT JOIN user_read_markers rm ON rm.room_id = ms.room_id AND rm.user_id = $1
 WHERE ms.user_id != $1
-AND ms.room_id = $3
+AND ms.room_id = $2
 AND ms.membership = 'join'
 )
 SELECT * FROM NOTS 
@@ -98,3 +155,61 @@ UNION ALL
 SELECT * FROM FOL
 ORDER BY created_at DESC
 LIMIT 50;
+
+-- name: GetUnreadNotificationCounts :many
+WITH unread AS (
+SELECT events.room_id, COALESCE(sr.parent_room_id, events.room_id) as space_id
+FROM event_relations er
+JOIN events ON events.event_id = er.relates_to_id
+JOIN events ev ON ev.event_id = er.event_id
+JOIN event_json ej ON ej.event_id = er.event_id
+LEFT JOIN space_rooms sr ON sr.child_room_id = events.room_id
+LEFT JOIN user_read_markers rm ON rm.room_id = events.room_id AND rm.user_id = $1
+WHERE events.sender = $1
+AND ev.sender != $1
+AND ej.json::jsonb->'content'->'m.relates_to'->>'thread_event_id' is not NULL
+AND (er.relation_type = 'm.annotation' OR er.relation_type = 'm.nested_reply')
+AND ev.stream_ordering > COALESCE(rm.stream_ordering, 0)
+UNION ALL
+SELECT ms.room_id, ms.room_id as space_id
+FROM membership_state ms
+JOIN events mev ON mev.event_id = ms.event_id
+LEFT JOIN user_read_markers rm ON rm.room_id = ms.room_id AND rm.user_id = $1
+WHERE ms.user_id != $1
+AND ms.room_id = $2
+AND ms.membership = 'join'
+AND mev.stream_ordering > COALESCE(rm.stream_ordering, 0)
+)
+SELECT room_id::text, space_id::text, COUNT(*) as count
+FROM unread
+GROUP BY room_id, space_id;
+
+-- name: GetLatestUnreadNotificationEvents :many
+-- The latest unread notification in every room, up to until when it's set.
+WITH unread AS (
+SELECT events.room_id, ev.event_id, ev.stream_ordering
+FROM event_relations er
+JOIN events ON events.event_id = er.relates_to_id
+JOIN events ev ON ev.event_id = er.event_id
+JOIN event_json ej ON ej.event_id = er.event_id
+LEFT JOIN user_read_markers rm ON rm.room_id = events.room_id AND rm.user_id = sqlc.arg('sender')::text
+WHERE events.sender = sqlc.arg('sender')::text
+AND ev.sender != sqlc.arg('sender')::text
+AND ej.json::jsonb->'content'->'m.relates_to'->>'thread_event_id' is not NULL
+AND (er.relation_type = 'm.annotation' OR er.relation_type = 'm.nested_reply')
+AND ev.stream_ordering > COALESCE(rm.stream_ordering, 0)
+AND (sqlc.narg('until')::bigint IS NULL OR ev.origin_server_ts <= sqlc.narg('until')::bigint)
+UNION ALL
+SELECT ms.room_id, mev.event_id, mev.stream_ordering
+FROM membership_state ms
+JOIN events mev ON mev.event_id = ms.event_id
+LEFT JOIN user_read_markers rm ON rm.room_id = ms.room_id AND rm.user_id = sqlc.arg('sender')::text
+WHERE ms.user_id != sqlc.arg('sender')::text
+AND ms.room_id = sqlc.arg('room_id')::text
+AND ms.membership = 'join'
+AND mev.stream_ordering > COALESCE(rm.stream_ordering, 0)
+AND (sqlc.narg('until')::bigint IS NULL OR mev.origin_server_ts <= sqlc.narg('until')::bigint)
+)
+SELECT DISTINCT ON (room_id) room_id::text, event_id::text
+FROM unread
+ORDER BY room_id, stream_ordering DESC;
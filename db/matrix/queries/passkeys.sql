@@ -0,0 +1,31 @@
+-- name: CreatePasskey :exec
+INSERT INTO commune_passkeys (id, user_id, name, credential, created_at)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: GetPasskey :one
+SELECT * FROM commune_passkeys
+WHERE id = $1;
+
+-- name: GetPasskeys :many
+SELECT * FROM commune_passkeys
+WHERE user_id = $1
+ORDER BY created_at ASC;
+
+-- name: HasPasskeys :one
+SELECT EXISTS (
+    SELECT 1 FROM commune_passkeys
+    WHERE user_id = $1
+);
+
+-- name: UpdatePasskeyCredential :exec
+UPDATE commune_passkeys
+SET credential = $2, last_used_at = $3
+WHERE id = $1;
+
+-- name: DeletePasskey :execrows
+DELETE FROM commune_passkeys
+WHERE id = $1 AND user_id = $2;
+
+-- name: DeleteUserPasskeys :exec
+DELETE FROM commune_passkeys
+WHERE user_id = $1;
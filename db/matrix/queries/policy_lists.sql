@@ -0,0 +1,50 @@
+-- name: SubscribePolicyRoom :exec
+INSERT INTO commune_policy_subscriptions (space_room_id, policy_room_id, auto_ban, subscribed_by, created_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (space_room_id, policy_room_id)
+DO UPDATE SET auto_ban = EXCLUDED.auto_ban, subscribed_by = EXCLUDED.subscribed_by;
+
+-- name: UnsubscribePolicyRoom :execrows
+DELETE FROM commune_policy_subscriptions
+WHERE space_room_id = $1
+AND policy_room_id = $2;
+
+-- name: GetPolicySubscriptions :many
+SELECT ps.policy_room_id, ps.auto_ban, ps.subscribed_by, ps.created_at,
+    COUNT(cse.event_id) as rules
+FROM commune_policy_subscriptions ps
+LEFT JOIN current_state_events cse ON cse.room_id = ps.policy_room_id
+    AND cse.type IN ('m.policy.rule.user', 'm.policy.rule.server', 'm.policy.rule.room')
+WHERE ps.space_room_id = $1
+GROUP BY ps.policy_room_id, ps.auto_ban, ps.subscribed_by, ps.created_at
+ORDER BY ps.created_at ASC;
+
+-- name: GetAllPolicySubscriptions :many
+SELECT * FROM commune_policy_subscriptions;
+
+-- name: GetSubscribedPolicyRules :many
+-- The current rules of every subscribed policy room. Rules that were
+-- removed have empty content.
+SELECT DISTINCT cse.room_id as policy_room_id,
+    cse.type,
+    COALESCE(ej.json::jsonb->'content'->>'entity', '')::text as entity,
+    COALESCE(ej.json::jsonb->'content'->>'recommendation', '')::text as recommendation,
+    COALESCE(ej.json::jsonb->'content'->>'reason', '')::text as reason
+FROM current_state_events cse
+JOIN event_json ej ON ej.event_id = cse.event_id
+WHERE cse.type IN ('m.policy.rule.user', 'm.policy.rule.server', 'm.policy.rule.room')
+AND cse.room_id IN (SELECT policy_room_id FROM commune_policy_subscriptions);
+
+-- name: GetPolicySpaceRooms :many
+-- Rooms of spaces that follow a policy room, so rules can be found from
+-- any room in the space.
+SELECT COALESCE(sr.child_room_id, '')::text as room_id,
+    COALESCE(sr.parent_room_id, '')::text as space_room_id
+FROM space_rooms sr
+WHERE sr.parent_room_id IN (SELECT space_room_id FROM commune_policy_subscriptions);
+
+-- name: GetJoinedMembers :many
+SELECT COALESCE(user_id, '')::text as user_id
+FROM membership_state
+WHERE room_id = $1
+AND membership = 'join';
@@ -0,0 +1,53 @@
+-- name: GetReportTarget :one
+-- The room an event is in and the space it belongs to. Events posted to
+-- the space room itself belong to that space.
+SELECT events.room_id,
+    events.type,
+    events.sender,
+    COALESCE(sr.parent_room_id, events.room_id)::text as space_room_id
+FROM events
+LEFT JOIN space_rooms sr ON sr.child_room_id = events.room_id
+WHERE events.event_id = $1
+LIMIT 1;
+
+-- name: HasOpenReport :one
+SELECT EXISTS (
+    SELECT 1 FROM commune_reports
+    WHERE reporter = $1
+    AND target_user_id = $2
+    AND event_id = $3
+    AND status = 'open'
+);
+
+-- name: CreateReport :exec
+INSERT INTO commune_reports (id, reporter, target_type, target_user_id, event_id, room_id, space_room_id, category, reason, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
+
+-- name: GetReport :one
+SELECT * FROM commune_reports WHERE id = $1;
+
+-- name: GetSpaceReports :many
+-- A space's queue, one row per reported target with how many people
+-- reported it.
+SELECT DISTINCT ON (r.target_user_id, r.event_id) r.*,
+    COUNT(*) OVER (PARTITION BY r.target_user_id, r.event_id) as reports
+FROM commune_reports r
+WHERE r.space_room_id = $1
+AND r.status = 'open'
+ORDER BY r.target_user_id, r.event_id, r.created_at ASC;
+
+-- name: GetInstanceReports :many
+SELECT DISTINCT ON (r.target_user_id, r.event_id) r.*,
+    COUNT(*) OVER (PARTITION BY r.target_user_id, r.event_id) as reports
+FROM commune_reports r
+WHERE r.status = 'open'
+ORDER BY r.target_user_id, r.event_id, r.created_at ASC
+LIMIT 500;
+
+-- name: ResolveReports :execrows
+-- Resolves every open report of the same target.
+UPDATE commune_reports
+SET status = $3, resolved_by = $4, resolved_at = $5, note = $6
+WHERE target_user_id = $1
+AND event_id = $2
+AND status = 'open';
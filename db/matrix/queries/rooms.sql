@@ -328,3 +328,40 @@ JOIN user_directory ud ON ud.user_id = events.sender
 WHERE spaces.space_alias = $1
 AND rs.is_profile = true
 LIMIT 1;
+
+-- name: GetPostingPolicies :many
+SELECT cse.room_id, (ej.json::jsonb->>'content')::text as content
+FROM current_state_events cse
+JOIN event_json ej ON ej.event_id = cse.event_id
+WHERE cse.type = 'm.restrict_events_to'
+AND (cse.room_id = sqlc.arg('room_id')::text OR cse.room_id IN (
+    SELECT sr.parent_room_id FROM space_rooms sr
+    WHERE sr.child_room_id = sqlc.arg('room_id')::text
+));
+
+-- name: GetMemberSince :one
+SELECT COALESCE(MIN(ev.origin_server_ts), 0)::bigint as member_since
+FROM room_memberships rm
+JOIN events ev ON ev.event_id = rm.event_id
+WHERE rm.room_id = sqlc.arg('room_id')
+AND rm.user_id = sqlc.arg('user_id')
+AND rm.membership = 'join'
+AND ev.origin_server_ts > COALESCE((
+    SELECT MAX(e.origin_server_ts)
+    FROM room_memberships r
+    JOIN events e ON e.event_id = r.event_id
+    WHERE r.room_id = sqlc.arg('room_id')
+    AND r.user_id = sqlc.arg('user_id')
+    AND r.membership != 'join'
+), 0);
+
+-- name: GetSpaceBans :many
+SELECT ms.user_id, ms.display_name, ms.avatar_url, ms.origin_server_ts as banned_at,
+    events.sender as banned_by,
+    COALESCE(ej.json::jsonb->'content'->>'reason', '')::text as reason
+FROM membership_state ms
+JOIN events ON events.event_id = ms.event_id
+JOIN event_json ej ON ej.event_id = ms.event_id
+WHERE ms.room_id = $1
+AND ms.membership = 'ban'
+ORDER BY ms.origin_server_ts DESC;
@@ -0,0 +1,61 @@
+-- name: GetTwoFactor :one
+SELECT * FROM commune_two_factor
+WHERE user_id = $1;
+
+-- name: IsTwoFactorEnabled :one
+SELECT EXISTS (
+    SELECT 1 FROM commune_two_factor
+    WHERE user_id = $1 AND enabled = true
+);
+
+-- name: CreateTwoFactorSecret :exec
+INSERT INTO commune_two_factor (user_id, secret, created_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at, last_step = 0
+WHERE commune_two_factor.enabled = false;
+
+-- name: EnableTwoFactor :exec
+UPDATE commune_two_factor
+SET enabled = true
+WHERE user_id = $1;
+
+-- name: UseTwoFactorStep :execrows
+-- A code can only be used once, so a step is only accepted once it's past
+-- the last one used.
+UPDATE commune_two_factor
+SET last_step = sqlc.arg('step')
+WHERE user_id = sqlc.arg('user_id')
+AND last_step < sqlc.arg('step');
+
+-- name: DeleteTwoFactor :exec
+DELETE FROM commune_two_factor
+WHERE user_id = $1;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO commune_recovery_codes (user_id, code_hash)
+VALUES ($1, $2);
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM commune_recovery_codes
+WHERE user_id = $1;
+
+-- name: UseRecoveryCode :execrows
+UPDATE commune_recovery_codes
+SET used_at = sqlc.arg('used_at')
+WHERE user_id = sqlc.arg('user_id')
+AND code_hash = sqlc.arg('code_hash')
+AND used_at = 0;
+
+-- name: CountRecoveryCodes :one
+SELECT COUNT(*) FROM commune_recovery_codes
+WHERE user_id = $1 AND used_at = 0;
+
+-- name: IsSpaceOwner :one
+SELECT EXISTS (
+    SELECT 1 FROM spaces
+    JOIN rooms ON rooms.room_id = spaces.room_id
+    LEFT JOIN room_state rs ON rs.room_id = spaces.room_id
+    WHERE rooms.creator = $1
+    AND rs.is_profile IS NOT TRUE
+);
@@ -18,8 +18,13 @@ SELECT users.name as matrix_user_id,
     users.creation_ts as created_at
 FROM users
 JOIN profiles ON profiles.full_user_id = users.name
+LEFT JOIN commune_primary_emails pe ON pe.user_id = users.name
 LEFT JOIN user_threepids utpid ON utpid.user_id = users.name
-WHERE (profiles.user_id = sqlc.narg('username') OR utpid.address = sqlc.narg('username')) AND users.deactivated = 0;
+    AND utpid.medium = 'email'
+    AND (pe.address IS NULL OR utpid.address = pe.address)
+WHERE (profiles.user_id = sqlc.narg('username') OR utpid.address = sqlc.narg('username')) AND users.deactivated = 0
+ORDER BY utpid.added_at ASC
+LIMIT 1;
 
 -- name: GetExternalUserID :one
 SELECT user_id 
@@ -100,6 +105,14 @@ FROM account_data ad
 WHERE ad.user_id = $1
 AND ad.account_data_type = 'm.direct';
 
+-- name: GetAccountData :one
+SELECT ad.content
+FROM account_data ad
+WHERE ad.user_id = $1
+AND ad.account_data_type = $2
+ORDER BY ad.stream_id DESC
+LIMIT 1;
+
 -- name: IsAdmin :one
 SELECT CASE WHEN admin = 1 THEN TRUE ELSE FALSE END as admin
 FROM users
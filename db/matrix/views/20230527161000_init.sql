@@ -1,3 +1,4 @@
+-- +goose Up
 CREATE EXTENSION IF NOT EXISTS unaccent;
 CREATE EXTENSION IF NOT EXISTS fuzzystrmatch;
 
@@ -53,3 +54,9 @@ begin
   end loop;
 end;
 $$ language plpgsql;
+
+-- +goose Down
+DROP FUNCTION IF EXISTS unique_random;
+DROP FUNCTION IF EXISTS random_string;
+DROP FUNCTION IF EXISTS gen_random_bytes;
+DROP FUNCTION IF EXISTS get_next_token_id;
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS space_rooms_idx;
 DROP MATERIALIZED VIEW IF EXISTS space_rooms CASCADE;
-DROP TRIGGER space_rooms_mv_trigger on current_state_events;
-DROP FUNCTION space_rooms_mv_refresh();
+DROP TRIGGER IF EXISTS space_rooms_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS space_rooms_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS space_rooms AS 
     WITH sc AS (
@@ -39,3 +40,9 @@ ON current_state_events
 FOR EACH ROW
 WHEN (NEW.type = 'm.room.create' OR NEW.type = 'm.space.parent' OR NEW.type = 'm.space.child' OR NEW.type = 'm.room.name')
 EXECUTE FUNCTION space_rooms_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS space_rooms_idx;
+DROP MATERIALIZED VIEW IF EXISTS space_rooms CASCADE;
+DROP TRIGGER IF EXISTS space_rooms_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS space_rooms_mv_refresh();
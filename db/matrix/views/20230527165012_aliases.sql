@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS aliases_idx;
 DROP MATERIALIZED VIEW IF EXISTS aliases;
-DROP TRIGGER aliases_mv_trigger on current_state_events;
-DROP FUNCTION aliases_mv_refresh();
+DROP TRIGGER IF EXISTS aliases_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS aliases_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS aliases AS 
 WITH space_children AS(
@@ -47,3 +48,9 @@ ON current_state_events
 FOR EACH ROW
 WHEN (NEW.type = 'm.room.create' OR NEW.type = 'm.space.parent' OR NEW.type = 'm.space.child' OR NEW.type = 'm.room.name')
 EXECUTE FUNCTION aliases_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS aliases_idx;
+DROP MATERIALIZED VIEW IF EXISTS aliases;
+DROP TRIGGER IF EXISTS aliases_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS aliases_mv_refresh();
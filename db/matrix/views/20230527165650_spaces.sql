@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS spaces_idx;
 DROP MATERIALIZED VIEW IF EXISTS spaces;
-DROP TRIGGER spaces_mv_trigger on current_state_events;
-DROP FUNCTION spaces_mv_refresh();
+DROP TRIGGER IF EXISTS spaces_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS spaces_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS spaces AS 
     SELECT rooms.room_id, er.json::jsonb->'content'->>'alias' as room_alias, substring(split_part(er.json::jsonb->'content'->>'alias', ':', 1) FROM 2) as space_alias, 
@@ -31,3 +32,9 @@ WHEN (NEW.type = 'm.room.create'
     OR NEW.type = 'm.space.default'
     OR NEW.type = 'm.room.canonical_alias')
 EXECUTE FUNCTION spaces_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS spaces_idx;
+DROP MATERIALIZED VIEW IF EXISTS spaces;
+DROP TRIGGER IF EXISTS spaces_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS spaces_mv_refresh();
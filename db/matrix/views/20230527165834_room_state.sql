@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS room_state_idx;
 DROP MATERIALIZED VIEW IF EXISTS room_state;
-DROP TRIGGER room_state_mv_trigger on current_state_events;
-DROP FUNCTION room_state_mv_refresh();
+DROP TRIGGER IF EXISTS room_state_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS room_state_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS room_state AS 
     SELECT DISTINCT ON (rooms.room_id) rooms.room_id, ra.room_alias, substring(split_part(ra.room_alias, ':', 1) FROM 2) as alias, COALESCE(st.type, 'chat') as type, 
@@ -71,3 +72,9 @@ WHEN (NEW.type = 'm.room.create'
     OR NEW.type = 'm.room.pinned_events'
     OR NEW.type = 'room.settings')
 EXECUTE FUNCTION room_state_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS room_state_idx;
+DROP MATERIALIZED VIEW IF EXISTS room_state;
+DROP TRIGGER IF EXISTS room_state_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS room_state_mv_refresh();
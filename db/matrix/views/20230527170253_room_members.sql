@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS room_members_idx;
 DROP MATERIALIZED VIEW IF EXISTS room_members;
-DROP TRIGGER room_members_mv_trigger on room_memberships;
-DROP FUNCTION room_members_mv_refresh();
+DROP TRIGGER IF EXISTS room_members_mv_trigger on room_memberships;
+DROP FUNCTION IF EXISTS room_members_mv_refresh();
 
 DROP INDEX IF EXISTS room_members_idx;
 DROP MATERIALIZED VIEW IF EXISTS room_members;
@@ -32,3 +33,9 @@ CREATE TRIGGER room_members_mv_trigger
 AFTER INSERT
 ON room_memberships
 EXECUTE FUNCTION room_members_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS room_members_idx;
+DROP MATERIALIZED VIEW IF EXISTS room_members;
+DROP TRIGGER IF EXISTS room_members_mv_trigger on room_memberships;
+DROP FUNCTION IF EXISTS room_members_mv_refresh();
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS membership_state_idx;
 DROP MATERIALIZED VIEW IF EXISTS membership_state;
-DROP TRIGGER membership_state_mv_trigger on room_memberships;
-DROP FUNCTION membership_state_mv_refresh();
+DROP TRIGGER IF EXISTS membership_state_mv_trigger on room_memberships;
+DROP FUNCTION IF EXISTS membership_state_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS membership_state AS 
     SELECT DISTINCT ON (rm.room_id, user_id) rm.user_id, rm.room_id, rm.membership, rm.display_name, rm.avatar_url, ev.origin_server_ts, ev.event_id
@@ -24,3 +25,9 @@ CREATE TRIGGER membership_state_mv_trigger
 AFTER INSERT
 ON room_memberships
 EXECUTE FUNCTION membership_state_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS membership_state_idx;
+DROP MATERIALIZED VIEW IF EXISTS membership_state;
+DROP TRIGGER IF EXISTS membership_state_mv_trigger on room_memberships;
+DROP FUNCTION IF EXISTS membership_state_mv_refresh();
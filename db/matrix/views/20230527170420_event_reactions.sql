@@ -1,11 +1,30 @@
-DROP INDEX IF EXISTS event_reactions_idx;
-DROP MATERIALIZED VIEW IF EXISTS event_reactions;
-DROP TRIGGER event_reactions_mv_trigger on event_relations;
-DROP FUNCTION event_reactions_mv_refresh();
-
-CREATE MATERIALIZED VIEW IF NOT EXISTS event_reactions AS 
-    SELECT er.relates_to_id, er.aggregation_key, ej.url,
-    array_agg(
+-- +goose Up
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_matviews WHERE matviewname = 'event_reactions') THEN
+        DROP MATERIALIZED VIEW event_reactions;
+    END IF;
+END;
+$$;
+DROP TRIGGER IF EXISTS event_reactions_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_reactions_mv_refresh();
+DROP TRIGGER IF EXISTS event_reactions_counter_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_reactions_counter();
+
+-- event_reactions holds the senders of every reaction key on an event. It is
+-- kept up to date by event_reactions_counter below.
+CREATE TABLE IF NOT EXISTS event_reactions (
+    relates_to_id text NOT NULL,
+    aggregation_key text NOT NULL,
+    url text,
+    senders jsonb NOT NULL DEFAULT '[]'::jsonb,
+    PRIMARY KEY (relates_to_id, aggregation_key)
+);
+
+INSERT INTO event_reactions (relates_to_id, aggregation_key, url, senders)
+    SELECT er.relates_to_id, er.aggregation_key, 
+    MAX(ej.json::jsonb->'content'->'m.relates_to'->>'url') as url,
+    jsonb_agg(
         jsonb_build_object(
             'sender', ev.sender,
             'event_id', er.event_id
@@ -13,32 +32,66 @@ CREATE MATERIALIZED VIEW IF NOT EXISTS event_reactions AS
     ) as senders
     FROM event_relations er 
     JOIN events ev ON ev.event_id = er.event_id AND er.relation_type = 'm.annotation'
-    LEFT JOIN (
-        SELECT event_json.json::jsonb->'content'->'m.relates_to'->>'url' as url, event_json.event_id FROM event_json 
-    ) as ej ON ej.event_id = er.event_id
+    LEFT JOIN event_json ej ON ej.event_id = er.event_id
     WHERE aggregation_key != 'upvote' AND aggregation_key != 'downvote'
-    GROUP BY er.aggregation_key, er.relates_to_id, ej.url;
-
-CREATE UNIQUE INDEX IF NOT EXISTS event_reactions_idx ON event_reactions (relates_to_id, aggregation_key);
+    GROUP BY er.aggregation_key, er.relates_to_id
+ON CONFLICT (relates_to_id, aggregation_key) DO UPDATE SET
+    url = EXCLUDED.url,
+    senders = EXCLUDED.senders;
 
-CREATE OR REPLACE FUNCTION event_reactions_mv_refresh()
+CREATE OR REPLACE FUNCTION event_reactions_counter()
 RETURNS trigger LANGUAGE plpgsql AS $$
 BEGIN
-    REFRESH MATERIALIZED VIEW CONCURRENTLY event_reactions;
-    RETURN NULL;
+    IF (TG_OP = 'DELETE' OR TG_OP = 'UPDATE')
+        AND OLD.relation_type = 'm.annotation'
+        AND OLD.aggregation_key NOT IN ('upvote', 'downvote') THEN
+
+        UPDATE event_reactions SET
+            senders = COALESCE((
+                SELECT jsonb_agg(s) 
+                FROM jsonb_array_elements(senders) s 
+                WHERE s->>'event_id' != OLD.event_id
+            ), '[]'::jsonb)
+        WHERE relates_to_id = OLD.relates_to_id
+        AND aggregation_key = OLD.aggregation_key;
 
-    IF (TG_OP = 'DELETE') THEN
-        REFRESH MATERIALIZED VIEW CONCURRENTLY event_reactions;
-    ELSIF (NEW.relation_type = 'm.annotation') THEN
-        REFRESH MATERIALIZED VIEW CONCURRENTLY event_reactions;
+        DELETE FROM event_reactions
+        WHERE relates_to_id = OLD.relates_to_id
+        AND aggregation_key = OLD.aggregation_key
+        AND jsonb_array_length(senders) = 0;
     END IF;
 
-    RETURN NULL; 
+    IF (TG_OP = 'INSERT' OR TG_OP = 'UPDATE')
+        AND NEW.relation_type = 'm.annotation'
+        AND NEW.aggregation_key NOT IN ('upvote', 'downvote') THEN
+
+        INSERT INTO event_reactions (relates_to_id, aggregation_key, url, senders)
+        SELECT NEW.relates_to_id, 
+            NEW.aggregation_key,
+            ej.json::jsonb->'content'->'m.relates_to'->>'url',
+            jsonb_build_array(jsonb_build_object(
+                'sender', ev.sender,
+                'event_id', NEW.event_id
+            ))
+        FROM events ev
+        LEFT JOIN event_json ej ON ej.event_id = ev.event_id
+        WHERE ev.event_id = NEW.event_id
+        ON CONFLICT (relates_to_id, aggregation_key) DO UPDATE SET
+            url = COALESCE(event_reactions.url, EXCLUDED.url),
+            senders = event_reactions.senders || EXCLUDED.senders;
+    END IF;
+
+    RETURN NULL;
 END;
 $$;
 
-CREATE TRIGGER event_reactions_mv_trigger 
+CREATE TRIGGER event_reactions_counter_trigger 
 AFTER INSERT OR UPDATE OR DELETE
 ON event_relations
 FOR EACH ROW
-EXECUTE FUNCTION event_reactions_mv_refresh();
+EXECUTE FUNCTION event_reactions_counter();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS event_reactions_counter_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_reactions_counter();
+DROP TABLE IF EXISTS event_reactions;
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS reactions_idx;
 DROP MATERIALIZED VIEW IF EXISTS reactions;
-DROP TRIGGER reactions_mv_trigger on event_relations;
-DROP FUNCTION reactions_mv_refresh();
+DROP TRIGGER IF EXISTS reactions_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS reactions_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS reactions AS 
     SELECT er.relates_to_id, er.aggregation_key, count(*) 
@@ -25,3 +26,9 @@ ON event_relations
 FOR EACH ROW
 WHEN (NEW.relation_type = 'm.annotation')
 EXECUTE FUNCTION reactions_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS reactions_idx;
+DROP MATERIALIZED VIEW IF EXISTS reactions;
+DROP TRIGGER IF EXISTS reactions_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS reactions_mv_refresh();
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS user_reactions_idx;
 DROP MATERIALIZED VIEW IF EXISTS user_reactions;
-DROP TRIGGER user_reactions_mv_trigger on event_relations;
-DROP FUNCTION user_reactions_mv_refresh();
+DROP TRIGGER IF EXISTS user_reactions_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS user_reactions_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS user_reactions AS 
     SELECT er.relates_to_id, ev.sender, array_agg(er.aggregation_key) as reactions
@@ -26,3 +27,9 @@ ON event_relations
 FOR EACH ROW
 WHEN (NEW.relation_type = 'm.annotation')
 EXECUTE FUNCTION user_reactions_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS user_reactions_idx;
+DROP MATERIALIZED VIEW IF EXISTS user_reactions;
+DROP TRIGGER IF EXISTS user_reactions_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS user_reactions_mv_refresh();
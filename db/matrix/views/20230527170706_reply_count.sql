@@ -1,39 +1,156 @@
-DROP INDEX IF EXISTS reply_count_idx;
-DROP MATERIALIZED VIEW IF EXISTS reply_count;
-DROP TRIGGER reply_count_mv_trigger on event_relations;
-DROP FUNCTION reply_count_mv_refresh();
-
-CREATE MATERIALIZED VIEW IF NOT EXISTS reply_count AS 
-    WITH RECURSIVE recursive_events AS (
-        SELECT er.event_id, er.relates_to_id, 1 AS reply_count
+-- +goose Up
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_matviews WHERE matviewname = 'reply_count') THEN
+        DROP MATERIALIZED VIEW reply_count;
+    END IF;
+END;
+$$;
+DROP TRIGGER IF EXISTS reply_count_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS reply_count_mv_refresh();
+DROP TRIGGER IF EXISTS reply_count_counter_trigger on event_relations;
+DROP FUNCTION IF EXISTS reply_count_counter();
+DROP TRIGGER IF EXISTS reply_count_redaction_trigger on redactions;
+DROP FUNCTION IF EXISTS reply_count_redaction();
+DROP FUNCTION IF EXISTS reply_count_apply(text, bigint);
+
+-- reply_count holds the number of nested replies below every event, at any
+-- depth, leaving out redacted replies. It is kept up to date by
+-- reply_count_counter and reply_count_redaction below.
+CREATE TABLE IF NOT EXISTS reply_count (
+    relates_to_id text PRIMARY KEY,
+    count bigint NOT NULL DEFAULT 0
+);
+
+INSERT INTO reply_count (relates_to_id, count)
+    WITH RECURSIVE reply_tree AS (
+        SELECT er.event_id, er.relates_to_id
         FROM event_relations er
-	LEFT JOIN redactions ON redactions.redacts = er.event_id
+        LEFT JOIN redactions ON redactions.redacts = er.event_id
         WHERE er.relation_type = 'm.nested_reply'
-	AND redactions.redacts is null
+        AND redactions.redacts IS NULL
 
-        UNION
+        UNION ALL
 
-        SELECT er.event_id, er.relates_to_id, re.reply_count + 1
-        FROM event_relations er
-        INNER JOIN recursive_events re ON er.event_id = re.relates_to_id
+        SELECT rt.event_id, er.relates_to_id
+        FROM reply_tree rt
+        JOIN event_relations er ON er.event_id = rt.relates_to_id
+        AND er.relation_type = 'm.nested_reply'
     )
     SELECT relates_to_id, COUNT(event_id) AS count
-    FROM recursive_events
-    GROUP BY relates_to_id;
+    FROM reply_tree
+    GROUP BY relates_to_id
+ON CONFLICT (relates_to_id) DO UPDATE SET
+    count = EXCLUDED.count;
+
+-- adds delta to target and every event above it in the reply tree
+CREATE OR REPLACE FUNCTION reply_count_apply(target text, delta bigint)
+RETURNS void LANGUAGE plpgsql AS $$
+DECLARE 
+    current text := target;
+    depth int := 0;
+BEGIN
+    WHILE current IS NOT NULL AND depth < 1000 LOOP
+        INSERT INTO reply_count (relates_to_id, count)
+        VALUES (current, delta)
+        ON CONFLICT (relates_to_id) DO UPDATE SET
+            count = reply_count.count + EXCLUDED.count;
 
-CREATE UNIQUE INDEX IF NOT EXISTS reply_count_idx ON reply_count (relates_to_id, count);
+        DELETE FROM reply_count 
+        WHERE relates_to_id = current AND count <= 0;
 
-CREATE OR REPLACE FUNCTION reply_count_mv_refresh()
+        SELECT relates_to_id INTO current
+        FROM event_relations
+        WHERE event_id = current
+        AND relation_type = 'm.nested_reply'
+        LIMIT 1;
+
+        IF NOT FOUND THEN
+            current := NULL;
+        END IF;
+
+        depth := depth + 1;
+    END LOOP;
+END;
+$$;
+
+-- a reply counts once unless it's redacted, its own replies count either way
+CREATE OR REPLACE FUNCTION reply_count_self(reply text)
+RETURNS bigint LANGUAGE sql STABLE AS $$
+    SELECT CASE WHEN EXISTS (
+        SELECT 1 FROM redactions WHERE redacts = reply
+    ) THEN 0 ELSE 1 END;
+$$;
+
+CREATE OR REPLACE FUNCTION reply_count_counter()
 RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE 
+    below bigint;
 BEGIN
-    REFRESH MATERIALIZED VIEW CONCURRENTLY reply_count;
+    IF (TG_OP = 'DELETE' OR TG_OP = 'UPDATE')
+        AND OLD.relation_type = 'm.nested_reply' THEN
+
+        SELECT count INTO below FROM reply_count WHERE relates_to_id = OLD.event_id;
+        PERFORM reply_count_apply(OLD.relates_to_id, -(reply_count_self(OLD.event_id) + COALESCE(below, 0)));
+    END IF;
+
+    IF (TG_OP = 'INSERT' OR TG_OP = 'UPDATE')
+        AND NEW.relation_type = 'm.nested_reply' THEN
+
+        SELECT count INTO below FROM reply_count WHERE relates_to_id = NEW.event_id;
+        PERFORM reply_count_apply(NEW.relates_to_id, reply_count_self(NEW.event_id) + COALESCE(below, 0));
+    END IF;
+
     RETURN NULL;
 END;
 $$;
 
-CREATE TRIGGER reply_count_mv_trigger 
-AFTER INSERT 
+CREATE TRIGGER reply_count_counter_trigger 
+AFTER INSERT OR UPDATE OR DELETE
 ON event_relations
 FOR EACH ROW
-WHEN (NEW.relation_type = 'm.nested_reply')
-EXECUTE FUNCTION reply_count_mv_refresh();
+EXECUTE FUNCTION reply_count_counter();
+
+-- a redacted reply stops counting. Synapse may also delete its relation,
+-- which reply_count_counter handles whichever comes first.
+CREATE OR REPLACE FUNCTION reply_count_redaction()
+RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE 
+    parent text;
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM redactions
+        WHERE redacts = NEW.redacts
+        AND event_id != NEW.event_id
+    ) THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT relates_to_id INTO parent
+    FROM event_relations
+    WHERE event_id = NEW.redacts
+    AND relation_type = 'm.nested_reply'
+    LIMIT 1;
+
+    IF FOUND THEN
+        PERFORM reply_count_apply(parent, -1);
+    END IF;
+
+    RETURN NULL;
+END;
+$$;
+
+CREATE TRIGGER reply_count_redaction_trigger 
+AFTER INSERT
+ON redactions
+FOR EACH ROW
+EXECUTE FUNCTION reply_count_redaction();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS reply_count_redaction_trigger on redactions;
+DROP FUNCTION IF EXISTS reply_count_redaction();
+DROP TRIGGER IF EXISTS reply_count_counter_trigger on event_relations;
+DROP FUNCTION IF EXISTS reply_count_counter();
+DROP FUNCTION IF EXISTS reply_count_self(text);
+DROP FUNCTION IF EXISTS reply_count_apply(text, bigint);
+DROP TABLE IF EXISTS reply_count;
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS room_topics_idx;
 DROP MATERIALIZED VIEW IF EXISTS room_topics;
-DROP TRIGGER room_topics_mv_trigger on current_state_events;
-DROP FUNCTION room_topics_mv_refresh();
+DROP TRIGGER IF EXISTS room_topics_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS room_topics_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS room_topics AS 
     SELECT ej.room_id, ej.json::json->'content'->>'topics' AS topics
@@ -25,3 +26,9 @@ ON current_state_events
 FOR EACH ROW
 WHEN (NEW.type = 'm.room.topics')
 EXECUTE FUNCTION room_topics_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS room_topics_idx;
+DROP MATERIALIZED VIEW IF EXISTS room_topics;
+DROP TRIGGER IF EXISTS room_topics_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS room_topics_mv_refresh();
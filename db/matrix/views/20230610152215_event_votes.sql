@@ -1,37 +1,80 @@
-DROP INDEX IF EXISTS event_votes_idx;
-DROP MATERIALIZED VIEW IF EXISTS event_votes;
-DROP TRIGGER event_votes_mv_trigger on event_relations;
-DROP FUNCTION event_votes_mv_refresh();
+-- +goose Up
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_matviews WHERE matviewname = 'event_votes') THEN
+        DROP MATERIALIZED VIEW event_votes;
+    END IF;
+END;
+$$;
+DROP TRIGGER IF EXISTS event_votes_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_votes_mv_refresh();
+DROP TRIGGER IF EXISTS event_votes_counter_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_votes_counter();
+
+-- event_votes is a plain table kept up to date by event_votes_counter below,
+-- instead of a materialized view that was refreshed on every relation.
+-- `shpong views verify` compares it against event_relations and repairs drift.
+CREATE TABLE IF NOT EXISTS event_votes (
+    relates_to_id text PRIMARY KEY,
+    upvotes bigint NOT NULL DEFAULT 0,
+    downvotes bigint NOT NULL DEFAULT 0
+);
 
-CREATE MATERIALIZED VIEW IF NOT EXISTS event_votes AS 
+INSERT INTO event_votes (relates_to_id, upvotes, downvotes)
     SELECT relates_to_id,
            COUNT(CASE WHEN aggregation_key = 'upvote' THEN 1 END) AS upvotes,
            COUNT(CASE WHEN aggregation_key = 'downvote' THEN 1 END) AS downvotes
     FROM event_relations
     WHERE relation_type = 'm.annotation'
-    GROUP BY relates_to_id;
-
-CREATE UNIQUE INDEX IF NOT EXISTS event_votes_idx ON event_votes (relates_to_id);
+    AND aggregation_key IN ('upvote', 'downvote')
+    GROUP BY relates_to_id
+ON CONFLICT (relates_to_id) DO UPDATE SET
+    upvotes = EXCLUDED.upvotes,
+    downvotes = EXCLUDED.downvotes;
 
-CREATE OR REPLACE FUNCTION event_votes_mv_refresh()
+CREATE OR REPLACE FUNCTION event_votes_counter()
 RETURNS trigger LANGUAGE plpgsql AS $$
 BEGIN
-    REFRESH MATERIALIZED VIEW CONCURRENTLY event_votes;
-    RETURN NULL;
+    IF (TG_OP = 'DELETE' OR TG_OP = 'UPDATE')
+        AND OLD.relation_type = 'm.annotation'
+        AND OLD.aggregation_key IN ('upvote', 'downvote') THEN
+
+        UPDATE event_votes SET
+            upvotes = upvotes - CASE WHEN OLD.aggregation_key = 'upvote' THEN 1 ELSE 0 END,
+            downvotes = downvotes - CASE WHEN OLD.aggregation_key = 'downvote' THEN 1 ELSE 0 END
+        WHERE relates_to_id = OLD.relates_to_id;
+
+        DELETE FROM event_votes 
+        WHERE relates_to_id = OLD.relates_to_id 
+        AND upvotes <= 0 AND downvotes <= 0;
+    END IF;
+
+    IF (TG_OP = 'INSERT' OR TG_OP = 'UPDATE')
+        AND NEW.relation_type = 'm.annotation'
+        AND NEW.aggregation_key IN ('upvote', 'downvote') THEN
 
-    IF (TG_OP = 'DELETE') THEN
-        REFRESH MATERIALIZED VIEW CONCURRENTLY event_votes;
-    ELSIF (NEW.relation_type = 'm.annotation') THEN
-        REFRESH MATERIALIZED VIEW CONCURRENTLY event_votes;
+        INSERT INTO event_votes (relates_to_id, upvotes, downvotes)
+        VALUES (
+            NEW.relates_to_id,
+            CASE WHEN NEW.aggregation_key = 'upvote' THEN 1 ELSE 0 END,
+            CASE WHEN NEW.aggregation_key = 'downvote' THEN 1 ELSE 0 END
+        )
+        ON CONFLICT (relates_to_id) DO UPDATE SET
+            upvotes = event_votes.upvotes + EXCLUDED.upvotes,
+            downvotes = event_votes.downvotes + EXCLUDED.downvotes;
     END IF;
 
-    RETURN NULL; 
+    RETURN NULL;
 END;
 $$;
 
-CREATE TRIGGER event_votes_mv_trigger 
+CREATE TRIGGER event_votes_counter_trigger 
 AFTER INSERT OR UPDATE OR DELETE
 ON event_relations
 FOR EACH ROW
-EXECUTE FUNCTION event_votes_mv_refresh();
+EXECUTE FUNCTION event_votes_counter();
 
+-- +goose Down
+DROP TRIGGER IF EXISTS event_votes_counter_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_votes_counter();
+DROP TABLE IF EXISTS event_votes;
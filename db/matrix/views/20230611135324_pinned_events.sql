@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS pinned_events_idx;
 DROP MATERIALIZED VIEW IF EXISTS pinned_events;
-DROP TRIGGER pinned_events_mv_trigger on current_state_events;
-DROP FUNCTION pinned_events_mv_refresh();
+DROP TRIGGER IF EXISTS pinned_events_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS pinned_events_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS pinned_events AS 
     SELECT ej.room_id, ej.json::jsonb->'content'->>'pinned' as events
@@ -25,3 +26,9 @@ ON current_state_events
 FOR EACH ROW
 WHEN (NEW.type = 'm.room.pinned_events')
 EXECUTE FUNCTION pinned_events_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS pinned_events_idx;
+DROP MATERIALIZED VIEW IF EXISTS pinned_events;
+DROP TRIGGER IF EXISTS pinned_events_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS pinned_events_mv_refresh();
@@ -1,8 +1,9 @@
+-- +goose Up
 DROP INDEX IF EXISTS search_idx;
 DROP INDEX IF EXISTS search_vec_idx;
 DROP MATERIALIZED VIEW IF EXISTS search;
-DROP TRIGGER search_mv_trigger on events;
-DROP FUNCTION search_mv_refresh();
+DROP TRIGGER IF EXISTS search_mv_trigger on events;
+DROP FUNCTION IF EXISTS search_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS search AS 
     SELECT ej.event_id, 
@@ -31,3 +32,10 @@ ON events
 FOR EACH ROW
 WHEN (NEW.type = 'space.board.post')
 EXECUTE FUNCTION search_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS search_idx;
+DROP INDEX IF EXISTS search_vec_idx;
+DROP MATERIALIZED VIEW IF EXISTS search;
+DROP TRIGGER IF EXISTS search_mv_trigger on events;
+DROP FUNCTION IF EXISTS search_mv_refresh();
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS power_levels_idx;
 DROP MATERIALIZED VIEW IF EXISTS power_levels;
-DROP TRIGGER power_levels_mv_trigger on current_state_events;
-DROP FUNCTION power_levels_mv_refresh();
+DROP TRIGGER IF EXISTS power_levels_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS power_levels_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS power_levels AS 
     SELECT cse.room_id, cast(ej.json::jsonb->'content'->>'users' as jsonb) as users,
@@ -26,3 +27,9 @@ ON current_state_events
 FOR EACH ROW
 WHEN (NEW.type = 'm.room.power_levels')
 EXECUTE FUNCTION power_levels_mv_refresh();
+
+-- +goose Down
+DROP INDEX IF EXISTS power_levels_idx;
+DROP MATERIALIZED VIEW IF EXISTS power_levels;
+DROP TRIGGER IF EXISTS power_levels_mv_trigger on current_state_events;
+DROP FUNCTION IF EXISTS power_levels_mv_refresh();
@@ -1,3 +1,4 @@
+-- +goose Up
 DROP TRIGGER IF EXISTS events_insert_trigger ON events;
 DROP FUNCTION IF EXISTS events_trigger_function();
 
@@ -35,3 +36,6 @@ WHEN (NEW.type = 'm.room.message'
     OR NEW.type = 'space.board.post.reply')
 EXECUTE FUNCTION events_trigger_function();
 
+-- +goose Down
+DROP TRIGGER IF EXISTS events_insert_trigger ON events;
+DROP FUNCTION IF EXISTS events_trigger_function();
@@ -1,7 +1,8 @@
+-- +goose Up
 DROP INDEX IF EXISTS event_threads_idx;
 DROP MATERIALIZED VIEW IF EXISTS event_threads;
-DROP TRIGGER event_threads_mv_trigger on event_relations;
-DROP FUNCTION event_threads_mv_refresh();
+DROP TRIGGER IF EXISTS event_threads_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_threads_mv_refresh();
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS event_threads AS 
     SELECT events.event_id, count(er.relates_to_id) as replies, last.last_reply
@@ -45,3 +46,8 @@ ON event_relations
 FOR EACH ROW
 EXECUTE FUNCTION event_threads_mv_refresh();
 
+-- +goose Down
+DROP INDEX IF EXISTS event_threads_idx;
+DROP MATERIALIZED VIEW IF EXISTS event_threads;
+DROP TRIGGER IF EXISTS event_threads_mv_trigger on event_relations;
+DROP FUNCTION IF EXISTS event_threads_mv_refresh();
@@ -1,3 +1,4 @@
+-- +goose Up
 DROP TRIGGER IF EXISTS presence_stream_trigger ON presence_stream;
 DROP FUNCTION IF EXISTS presence_stream_trigger_function();
 
@@ -26,3 +27,6 @@ AFTER INSERT OR UPDATE ON presence_stream
 FOR EACH ROW
 EXECUTE FUNCTION presence_stream_trigger_function();
 
+-- +goose Down
+DROP TRIGGER IF EXISTS presence_stream_trigger ON presence_stream;
+DROP FUNCTION IF EXISTS presence_stream_trigger_function();
@@ -0,0 +1,37 @@
+-- +goose Up
+-- Build the payload from the inserted row instead of joining event_json,
+-- and include stream_ordering so listeners can catch up after reconnecting.
+CREATE OR REPLACE FUNCTION events_trigger_function()
+RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    PERFORM pg_notify('events_notification', jsonb_build_object(
+        'event_id', NEW.event_id, 
+        'type', NEW.type,
+        'room_id', NEW.room_id,
+        'sender', NEW.sender,
+        'stream_ordering', NEW.stream_ordering)::text);
+
+    RETURN NEW;
+END;
+$$;
+
+-- +goose Down
+CREATE OR REPLACE FUNCTION events_trigger_function()
+RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE notification_payload text;
+BEGIN
+    SELECT 
+    jsonb_build_object(
+        'event_id', ej.event_id, 
+        'type', ev.type,
+        'room_id', ev.room_id)
+    INTO notification_payload
+    FROM event_json ej
+    JOIN events ev ON ej.event_id = ev.event_id
+    WHERE ev.event_id = NEW.event_id;
+
+  PERFORM pg_notify('events_notification', notification_payload);
+
+  RETURN NEW;
+END;
+$$;
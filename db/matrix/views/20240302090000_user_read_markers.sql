@@ -0,0 +1,13 @@
+-- +goose Up
+-- The furthest point each user has read up to in each room, from their
+-- public and private read receipts.
+CREATE OR REPLACE VIEW user_read_markers AS
+    SELECT rl.room_id, rl.user_id,
+    MAX(COALESCE(rl.event_stream_ordering, ev.stream_ordering)) as stream_ordering
+    FROM receipts_linearized rl
+    LEFT JOIN events ev ON ev.event_id = rl.event_id
+    WHERE rl.receipt_type IN ('m.read', 'm.read.private')
+    GROUP BY rl.room_id, rl.user_id;
+
+-- +goose Down
+DROP VIEW IF EXISTS user_read_markers;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- Email digest preferences, owned by commune rather than synapse.
+CREATE TABLE IF NOT EXISTS commune_digest_settings (
+    user_id text PRIMARY KEY,
+    frequency text NOT NULL,
+    last_sent_at bigint NOT NULL DEFAULT 0
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_digest_settings;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- Registration invite codes and the accounts each one produced.
+CREATE TABLE IF NOT EXISTS commune_invite_codes (
+    code text PRIMARY KEY,
+    created_by text NOT NULL,
+    max_uses integer NOT NULL DEFAULT 1,
+    uses integer NOT NULL DEFAULT 0,
+    expires_at bigint NOT NULL DEFAULT 0,
+    revoked boolean NOT NULL DEFAULT false,
+    created_at bigint NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS commune_invite_codes_created_by_idx ON commune_invite_codes (created_by);
+
+CREATE TABLE IF NOT EXISTS commune_invite_code_uses (
+    code text NOT NULL REFERENCES commune_invite_codes (code) ON DELETE CASCADE,
+    user_id text NOT NULL,
+    used_at bigint NOT NULL,
+    PRIMARY KEY (code, user_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_invite_code_uses;
+DROP TABLE IF EXISTS commune_invite_codes;
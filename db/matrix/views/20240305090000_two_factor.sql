@@ -0,0 +1,20 @@
+-- +goose Up
+-- TOTP secrets and recovery codes for two-factor login.
+CREATE TABLE IF NOT EXISTS commune_two_factor (
+    user_id text PRIMARY KEY,
+    secret text NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_step bigint NOT NULL DEFAULT 0,
+    created_at bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS commune_recovery_codes (
+    user_id text NOT NULL,
+    code_hash text NOT NULL,
+    used_at bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_recovery_codes;
+DROP TABLE IF EXISTS commune_two_factor;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- Data exports people ask for and accounts waiting out their deletion grace
+-- period.
+CREATE TABLE IF NOT EXISTS commune_data_exports (
+    id text PRIMARY KEY,
+    user_id text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    archive bytea,
+    created_at bigint NOT NULL,
+    completed_at bigint NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS commune_data_exports_user_id_idx ON commune_data_exports (user_id);
+
+CREATE TABLE IF NOT EXISTS commune_account_deletions (
+    user_id text PRIMARY KEY,
+    requested_at bigint NOT NULL,
+    delete_at bigint NOT NULL,
+    completed_at bigint NOT NULL DEFAULT 0
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_account_deletions;
+DROP TABLE IF EXISTS commune_data_exports;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- The address people log in and get mail with when they have more than
+-- one. Users without a row use their oldest address.
+CREATE TABLE IF NOT EXISTS commune_primary_emails (
+    user_id text PRIMARY KEY,
+    address text NOT NULL,
+    updated_at bigint NOT NULL
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_primary_emails;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- WebAuthn credentials. credential is the library's JSON encoding, id is
+-- the base64url credential ID so assertions can find their row.
+CREATE TABLE IF NOT EXISTS commune_passkeys (
+    id text PRIMARY KEY,
+    user_id text NOT NULL,
+    name text NOT NULL DEFAULT '',
+    credential text NOT NULL,
+    created_at bigint NOT NULL,
+    last_used_at bigint NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS commune_passkeys_user_id_idx ON commune_passkeys (user_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_passkeys;
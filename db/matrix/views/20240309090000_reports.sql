@@ -0,0 +1,26 @@
+-- +goose Up
+-- Reports of posts, replies, messages and profiles. space_room_id is the
+-- space whose moderators see the report, empty for profiles, which only
+-- admins see. Resolving sets status to what was done about it.
+CREATE TABLE IF NOT EXISTS commune_reports (
+    id text PRIMARY KEY,
+    reporter text NOT NULL,
+    target_type text NOT NULL,
+    target_user_id text NOT NULL,
+    event_id text NOT NULL DEFAULT '',
+    room_id text NOT NULL DEFAULT '',
+    space_room_id text NOT NULL DEFAULT '',
+    category text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'open',
+    created_at bigint NOT NULL,
+    resolved_by text NOT NULL DEFAULT '',
+    resolved_at bigint NOT NULL DEFAULT 0,
+    note text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS commune_reports_space_idx ON commune_reports (space_room_id, status);
+CREATE INDEX IF NOT EXISTS commune_reports_target_idx ON commune_reports (target_user_id, event_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_reports;
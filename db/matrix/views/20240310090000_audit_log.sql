@@ -0,0 +1,21 @@
+-- +goose Up
+-- What admins and moderators did. target is whatever the action was on, an
+-- event, a room or an admin API path, and details is JSON with the rest.
+CREATE TABLE IF NOT EXISTS commune_audit_log (
+    id bigserial PRIMARY KEY,
+    actor text NOT NULL,
+    action text NOT NULL,
+    target_user_id text NOT NULL DEFAULT '',
+    target text NOT NULL DEFAULT '',
+    space_room_id text NOT NULL DEFAULT '',
+    reason text NOT NULL DEFAULT '',
+    details text NOT NULL DEFAULT '{}',
+    created_at bigint NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS commune_audit_log_actor_idx ON commune_audit_log (actor, created_at);
+CREATE INDEX IF NOT EXISTS commune_audit_log_target_idx ON commune_audit_log (target_user_id, created_at);
+CREATE INDEX IF NOT EXISTS commune_audit_log_space_idx ON commune_audit_log (space_room_id, created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_audit_log;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- Policy rooms (m.policy.rule.* ban lists) followed by a space, or by the
+-- whole instance when space_room_id is empty.
+CREATE TABLE IF NOT EXISTS commune_policy_subscriptions (
+    space_room_id text NOT NULL DEFAULT '',
+    policy_room_id text NOT NULL,
+    auto_ban boolean NOT NULL DEFAULT false,
+    subscribed_by text NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY (space_room_id, policy_room_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_policy_subscriptions;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Posts a content filter held for review. body is the request the author
+-- made, sent as them once a moderator approves it.
+CREATE TABLE IF NOT EXISTS commune_held_posts (
+    id text PRIMARY KEY,
+    sender text NOT NULL,
+    room_id text NOT NULL,
+    space_room_id text NOT NULL,
+    body text NOT NULL,
+    matches text NOT NULL DEFAULT '[]',
+    status text NOT NULL DEFAULT 'open',
+    created_at bigint NOT NULL,
+    reviewed_by text NOT NULL DEFAULT '',
+    reviewed_at bigint NOT NULL DEFAULT 0,
+    note text NOT NULL DEFAULT '',
+    event_id text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS commune_held_posts_space_idx ON commune_held_posts (space_room_id, status);
+
+-- +goose Down
+DROP TABLE IF EXISTS commune_held_posts;
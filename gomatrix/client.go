@@ -466,6 +466,13 @@ func (cli *Client) JoinRoom(roomIDorAlias, serverName string, content interface{
 	return
 }
 
+// ResolveAlias returns the room ID an alias points to. See https://spec.matrix.org/v1.9/client-server-api/#get_matrixclientv3directoryroomroomalias
+func (cli *Client) ResolveAlias(alias string) (resp *RespAliasResolve, err error) {
+	urlPath := cli.BuildURL("directory", "room", alias)
+	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
 // GetDisplayName returns the display name of the user from the specified MXID. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-profile-userid-displayname
 func (cli *Client) GetDisplayName(mxid string) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildURL("profile", mxid, "displayname")
@@ -519,6 +526,20 @@ func (cli *Client) SetAvatarURL(url string) error {
 	return nil
 }
 
+// GetAccountData gets the user's account data of the given type. See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3useruseridaccount_datatype
+func (cli *Client) GetAccountData(dataType string, outContent interface{}) (err error) {
+	urlPath := cli.BuildURL("user", cli.UserID, "account_data", dataType)
+	err = cli.MakeRequest("GET", urlPath, nil, outContent)
+	return
+}
+
+// SetAccountData sets the user's account data of the given type. See https://spec.matrix.org/v1.8/client-server-api/#put_matrixclientv3useruseridaccount_datatype
+func (cli *Client) SetAccountData(dataType string, content interface{}) (err error) {
+	urlPath := cli.BuildURL("user", cli.UserID, "account_data", dataType)
+	err = cli.MakeRequest("PUT", urlPath, content, nil)
+	return
+}
+
 // GetStatus returns the status of the user from the specified MXID. See https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-presence-userid-status
 func (cli *Client) GetStatus(mxid string) (resp *RespUserStatus, err error) {
 	urlPath := cli.BuildURL("presence", mxid, "status")
@@ -615,6 +636,12 @@ func (cli *Client) MarkRead(roomID, eventID string) error {
 	return cli.MakeRequest("POST", urlPath, nil, nil)
 }
 
+// MarkReadPrivate marks eventID in roomID as read without showing the receipt to other users. See https://spec.matrix.org/v1.8/client-server-api/#private-read-receipts
+func (cli *Client) MarkReadPrivate(roomID, eventID string) error {
+	urlPath := cli.BuildURL("rooms", roomID, "receipt", "m.read.private", eventID)
+	return cli.MakeRequest("POST", urlPath, struct{}{}, nil)
+}
+
 // CreateRoom creates a new Matrix room. See https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 //
 //	resp, err := cli.CreateRoom(&gomatrix.ReqCreateRoom{
@@ -82,6 +82,7 @@ type ReqBanUser struct {
 
 // ReqUnbanUser is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-unban
 type ReqUnbanUser struct {
+	Reason string `json:"reason,omitempty"`
 	UserID string `json:"user_id"`
 }
 
@@ -35,6 +35,12 @@ type RespJoinRoom struct {
 	RoomID string `json:"room_id"`
 }
 
+// RespAliasResolve is the JSON response for https://spec.matrix.org/v1.9/client-server-api/#get_matrixclientv3directoryroomroomalias
+type RespAliasResolve struct {
+	RoomID  string   `json:"room_id"`
+	Servers []string `json:"servers"`
+}
+
 // RespLeaveRoom is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-leave
 type RespLeaveRoom struct{}
 